@@ -3,6 +3,8 @@ package client
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
@@ -41,9 +43,93 @@ func (laptopClient *LaptopClient) CreateLaptop(lp *laptop.Laptop) {
 		return
 	}
 
+	lp.Revision = res.GetRevision()
 	log.Printf("created laptop with id: %s", res.Id)
 }
 
+func (laptopClient *LaptopClient) GetLaptop(laptopID string) (*laptop.Laptop, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &laptop.GetLaptopRequest{
+		Id: laptopID,
+	}
+
+	res, err := laptopClient.service.GetLaptop(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get laptop: %v", err)
+	}
+
+	return res.GetLaptop(), nil
+}
+
+func (laptopClient *LaptopClient) UpdateLaptop(lp *laptop.Laptop) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &laptop.UpdateLaptopRequest{
+		Laptop: lp,
+	}
+
+	res, err := laptopClient.service.UpdateLaptop(ctx, req)
+	if err != nil {
+		return fmt.Errorf("cannot update laptop: %v", err)
+	}
+
+	lp.Revision = res.GetRevision()
+	log.Printf("updated laptop with id: %s to revision %d", res.GetId(), res.GetRevision())
+	return nil
+}
+
+func (laptopClient *LaptopClient) DeleteLaptop(laptopID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &laptop.DeleteLaptopRequest{
+		Id: laptopID,
+	}
+
+	res, err := laptopClient.service.DeleteLaptop(ctx, req)
+	if err != nil {
+		return fmt.Errorf("cannot delete laptop: %v", err)
+	}
+
+	log.Printf("deleted laptop with id: %s", res.GetId())
+	return nil
+}
+
+func (laptopClient *LaptopClient) ListLaptops(pageSize uint32) error {
+	pageToken := ""
+	for {
+		res, err := laptopClient.listLaptopsPage(pageSize, pageToken)
+		if err != nil {
+			return fmt.Errorf("cannot list laptops: %v", err)
+		}
+
+		for _, lp := range res.GetLaptops() {
+			log.Print("- listed: ", lp.GetId(), " ", lp.GetBrand(), " ", lp.GetName())
+		}
+
+		pageToken = res.GetNextPageToken()
+		if pageToken == "" {
+			return nil
+		}
+	}
+}
+
+// listLaptopsPage fetches one page with its own deadline, so long catalogs can be listed in full
+func (laptopClient *LaptopClient) listLaptopsPage(pageSize uint32, pageToken string) (*laptop.ListLaptopsResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &laptop.ListLaptopsRequest{
+		PageSize:  pageSize,
+		PageToken: pageToken,
+	}
+
+	return laptopClient.service.ListLaptops(ctx, req)
+}
+
 func (laptopClient *LaptopClient) SearchLaptop(filter *laptop.Filter) {
 	log.Print("search filter: ", filter)
 
@@ -76,6 +162,36 @@ func (laptopClient *LaptopClient) SearchLaptop(filter *laptop.Filter) {
 	}
 }
 
+// WatchLaptops logs laptop changes until the stream fails, and returns the token
+// to resume watching from
+func (laptopClient *LaptopClient) WatchLaptops(filter *laptop.Filter, resumeToken string) (string, error) {
+	req := &laptop.WatchLaptopsRequest{
+		Filter:      filter,
+		ResumeToken: resumeToken,
+	}
+
+	stream, err := laptopClient.service.WatchLaptops(context.Background(), req)
+	if err != nil {
+		return resumeToken, fmt.Errorf("cannot watch laptops: %v", err)
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return resumeToken, fmt.Errorf("cannot receive stream response: %v", err)
+		}
+
+		event := res.GetEvent()
+		resumeToken = event.GetResumeToken()
+		log.Printf("- %s: %s", event.GetType(), event.GetLaptop().GetId())
+	}
+}
+
+// Attempts UploadImage makes to send an image, interrupted uploads are resumed where they stopped
+const maxUploadAttempts = 5
+
+const uploadRetryDelay = time.Second
+
 func (laptopClient *LaptopClient) UploadImage(laptopID string, imagePath string) {
 	file, err := os.Open(imagePath)
 	if err != nil {
@@ -83,38 +199,97 @@ func (laptopClient *LaptopClient) UploadImage(laptopID string, imagePath string)
 	}
 	defer file.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// the server rejects the upload if the content it receives has another checksum
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		log.Fatal("cannot compute image checksum: ", err)
+	}
+
+	info := &laptop.ImageInfo{
+		LaptopId:  laptopID,
+		ImageType: filepath.Ext(imagePath),
+		Checksum:  hex.EncodeToString(hash.Sum(nil)),
+	}
+
+	for attempt := 1; ; attempt++ {
+		res, err := laptopClient.sendImage(file, info)
+		if err == nil {
+			image := res.GetImage()
+			log.Printf("image uploaded with id: %s, size: %d, type: %s, %dx%d, checksum: %s",
+				res.GetId(), res.GetSize(), image.GetMimeType(), image.GetWidth(), image.GetHeight(), res.GetChecksum())
+			return
+		}
+
+		if info.GetUploadId() == "" || attempt == maxUploadAttempts || !isRetryableUploadError(err) {
+			log.Fatal("cannot upload image: ", err)
+		}
+
+		log.Printf("upload %s is interrupted, resuming it: %v", info.GetUploadId(), err)
+		time.Sleep(uploadRetryDelay)
+
+		query, err := laptopClient.queryUpload(info.GetUploadId())
+		if err != nil {
+			log.Fatal("cannot query upload: ", err)
+		} else if image := query.GetImage(); image != nil {
+			log.Printf("image uploaded with id: %s, size: %d, checksum: %s", image.GetId(), image.GetSize(), image.GetChecksum())
+			return
+		}
+
+		info.Offset = query.GetSize()
+	}
+}
+
+// sendImage uploads the image from the offset in the info,
+// and sets the upload ID in it once the server sends it
+func (laptopClient *LaptopClient) sendImage(file *os.File, info *laptop.ImageInfo) (*laptop.UploadImageResponse, error) {
+	_, err := file.Seek(int64(info.GetOffset()), io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("cannot seek image file: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	stream, err := laptopClient.service.UploadImage(ctx)
 	if err != nil {
-		log.Fatal("cannot upload image: ", err)
+		return nil, err
 	}
 
 	req := &laptop.UploadImageRequest{
 		Data: &laptop.UploadImageRequest_Info{
-			Info: &laptop.ImageInfo{
-				LaptopId:  laptopID,
-				ImageType: filepath.Ext(imagePath),
-			},
+			Info: info,
 		},
 	}
 
 	err = stream.Send(req)
+	if err != nil {
+		_, err = stream.CloseAndRecv()
+		return nil, err
+	}
 
+	header, err := stream.Header()
 	if err != nil {
-		log.Fatal("cannot send image info: ", err, stream.RecvMsg(nil))
+		return nil, err
 	}
 
+	uploadID := header.Get("upload-id")
+	if len(uploadID) == 0 {
+		// the server ended the stream without accepting the upload
+		_, err = stream.CloseAndRecv()
+		return nil, err
+	}
+	info.UploadId = uploadID[0]
+
 	reader := bufio.NewReader(file)
-	buffer := make([]byte, 1024)
+	buffer := make([]byte, 64<<10)
 
 	for {
 		n, err := reader.Read(buffer)
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			log.Fatal("cannot read chunk to buffer: ", err)
+			return nil, fmt.Errorf("cannot read chunk to buffer: %w", err)
 		}
 
 		req := &laptop.UploadImageRequest{
@@ -125,16 +300,164 @@ func (laptopClient *LaptopClient) UploadImage(laptopID string, imagePath string)
 
 		err = stream.Send(req)
 		if err != nil {
-			log.Fatal("cannot send chunk to server: ", err, stream.RecvMsg(nil))
+			// the error of the stream is only returned by receiving
+			_, err = stream.CloseAndRecv()
+			return nil, err
 		}
 	}
 
-	res, err := stream.CloseAndRecv()
+	return stream.CloseAndRecv()
+}
+
+func (laptopClient *LaptopClient) queryUpload(uploadID string) (*laptop.QueryUploadResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return laptopClient.service.QueryUpload(ctx, &laptop.QueryUploadRequest{UploadId: uploadID})
+}
+
+// isRetryableUploadError tells whether an upload failed because of the connection,
+// not because the server rejected the image
+func isRetryableUploadError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.Canceled:
+		return true
+	default:
+		return false
+	}
+}
+
+// DownloadImage saves a rendition of an image into the folder and returns the path of the file
+func (laptopClient *LaptopClient) DownloadImage(
+	imageID string,
+	rendition laptop.DownloadImageRequest_Rendition,
+	imageFolder string,
+) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req := &laptop.DownloadImageRequest{
+		ImageId:   imageID,
+		Rendition: rendition,
+	}
+
+	stream, err := laptopClient.service.DownloadImage(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("cannot download image: %v", err)
+	}
+
+	res, err := stream.Recv()
 	if err != nil {
-		log.Fatal("cannot receive response: ", err)
+		return "", fmt.Errorf("cannot receive image metadata: %v", err)
 	}
 
-	log.Printf("image uploaded with id: %s, size: %d", res.GetId(), res.GetSize())
+	image := res.GetImage()
+	if image == nil {
+		return "", fmt.Errorf("image metadata is missing")
+	}
+
+	name := image.GetId()
+	if maxSize := res.GetRendition().GetMaxSize(); maxSize != 0 {
+		name = fmt.Sprintf("%s-%d", name, maxSize)
+	}
+
+	imagePath := filepath.Join(imageFolder, name+res.GetRendition().GetImageType())
+	file, err := os.Create(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("cannot create image file: %v", err)
+	}
+
+	err = receiveImageChunks(stream, file)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+
+	if err != nil {
+		// a partial image would look like a complete download
+		os.Remove(imagePath)
+		return "", err
+	}
+
+	log.Printf("image downloaded to %s, size: %d", imagePath, res.GetRendition().GetSize())
+	return imagePath, nil
+}
+
+func receiveImageChunks(stream laptop.LaptopService_DownloadImageClient, file *os.File) error {
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("cannot receive chunk: %v", err)
+		}
+
+		_, err = file.Write(res.GetChunkData())
+		if err != nil {
+			return fmt.Errorf("cannot write image file: %v", err)
+		}
+	}
+}
+
+func (laptopClient *LaptopClient) ListImages(laptopID string) ([]*laptop.Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := laptopClient.service.ListImages(ctx, &laptop.ListImagesRequest{LaptopId: laptopID})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list images: %v", err)
+	}
+
+	for _, image := range res.GetImages() {
+		log.Printf("image %s%s, size: %d", image.GetId(), image.GetImageType(), image.GetSize())
+	}
+	return res.GetImages(), nil
+}
+
+func (laptopClient *LaptopClient) DeleteImage(imageID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := laptopClient.service.DeleteImage(ctx, &laptop.DeleteImageRequest{ImageId: imageID})
+	if err != nil {
+		return fmt.Errorf("cannot delete image: %v", err)
+	}
+
+	log.Printf("deleted image %s", imageID)
+	return nil
+}
+
+// ReorderImages sets the gallery order of all images of a laptop
+func (laptopClient *LaptopClient) ReorderImages(laptopID string, imageIDs []string) ([]*laptop.Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &laptop.ReorderImagesRequest{
+		LaptopId: laptopID,
+		ImageIds: imageIDs,
+	}
+
+	res, err := laptopClient.service.ReorderImages(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reorder images: %v", err)
+	}
+
+	log.Printf("reordered %d images of laptop %s", len(res.GetImages()), laptopID)
+	return res.GetImages(), nil
+}
+
+func (laptopClient *LaptopClient) SetPrimaryImage(imageID string) (*laptop.Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := laptopClient.service.SetPrimaryImage(ctx, &laptop.SetPrimaryImageRequest{ImageId: imageID})
+	if err != nil {
+		return nil, fmt.Errorf("cannot set primary image: %v", err)
+	}
+
+	log.Printf("image %s is the primary image of laptop %s", imageID, res.GetImage().GetLaptopId())
+	return res.GetImage(), nil
 }
 
 func (laptopClient *LaptopClient) RateLaptop(laptopIDs []string, scores []float64) error {
@@ -185,3 +508,90 @@ func (laptopClient *LaptopClient) RateLaptop(laptopIDs []string, scores []float6
 	err = <-waitResponse
 	return err
 }
+
+func (laptopClient *LaptopClient) GetRating(laptopID string) (*laptop.Rating, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &laptop.GetRatingRequest{LaptopId: laptopID}
+	res, err := laptopClient.service.GetRating(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get rating: %v", err)
+	}
+
+	log.Printf("laptop %s has %d ratings, average score: %.2f",
+		laptopID, res.GetRating().GetRatedCount(), res.GetRating().GetAverageScore())
+	return res.GetRating(), nil
+}
+
+func (laptopClient *LaptopClient) RetractRating(laptopID string) (*laptop.Rating, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &laptop.RetractRatingRequest{LaptopId: laptopID}
+	res, err := laptopClient.service.RetractRating(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot retract rating: %v", err)
+	}
+
+	log.Printf("rating of laptop %s retracted, %d ratings left", laptopID, res.GetRating().GetRatedCount())
+	return res.GetRating(), nil
+}
+
+func (laptopClient *LaptopClient) GetRatingSummary(laptopID string) (*laptop.RatingSummary, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &laptop.GetRatingSummaryRequest{LaptopId: laptopID}
+	res, err := laptopClient.service.GetRatingSummary(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get rating summary: %v", err)
+	}
+
+	summary := res.GetSummary()
+	log.Printf("laptop %s has %d ratings, median score: %.2f", laptopID, summary.GetRatedCount(), summary.GetMedianScore())
+	for _, bucket := range summary.GetHistogram() {
+		log.Printf("%2d: %d", bucket.GetScore(), bucket.GetCount())
+	}
+	return summary, nil
+}
+
+func (laptopClient *LaptopClient) SubmitReview(req *laptop.SubmitReviewRequest) (*laptop.Review, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := laptopClient.service.SubmitReview(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot submit review: %v", err)
+	}
+
+	log.Printf("review submitted with id: %s", res.GetReview().GetId())
+	return res.GetReview(), nil
+}
+
+func (laptopClient *LaptopClient) ListReviews(laptopID string, sortBy laptop.ListReviewsRequest_SortBy, pageSize uint32) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &laptop.ListReviewsRequest{
+		LaptopId: laptopID,
+		SortBy:   sortBy,
+		PageSize: pageSize,
+	}
+
+	for {
+		res, err := laptopClient.service.ListReviews(ctx, req)
+		if err != nil {
+			return fmt.Errorf("cannot list reviews: %v", err)
+		}
+
+		for _, review := range res.GetReviews() {
+			log.Printf("%q by %s who rated it %g, %d found it helpful", review.GetTitle(), review.GetAuthor(), review.GetAuthorScore(), review.GetHelpfulVotes())
+		}
+
+		if res.GetNextPageToken() == "" {
+			return nil
+		}
+		req.PageToken = res.GetNextPageToken()
+	}
+}
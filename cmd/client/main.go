@@ -79,9 +79,27 @@ func authMethods() map[string]bool {
 	const laptopServicePath = "/store.management.system.LaptopService/"
 
 	return map[string]bool{
-		laptopServicePath + "CreateLaptop": true,
-		laptopServicePath + "UploadImage":  true,
-		laptopServicePath + "RateLaptop":   true,
+		laptopServicePath + "CreateLaptop":      true,
+		laptopServicePath + "GetLaptop":         true,
+		laptopServicePath + "UpdateLaptop":      true,
+		laptopServicePath + "DeleteLaptop":      true,
+		laptopServicePath + "ListLaptops":       true,
+		laptopServicePath + "UploadImage":       true,
+		laptopServicePath + "DownloadImage":     true,
+		laptopServicePath + "ListImages":        true,
+		laptopServicePath + "DeleteImage":       true,
+		laptopServicePath + "QueryUpload":       true,
+		laptopServicePath + "ReorderImages":     true,
+		laptopServicePath + "SetPrimaryImage":   true,
+		laptopServicePath + "RateLaptop":        true,
+		laptopServicePath + "GetRating":         true,
+		laptopServicePath + "GetRatingSummary":  true,
+		laptopServicePath + "RetractRating":     true,
+		laptopServicePath + "SubmitReview":      true,
+		laptopServicePath + "ListReviews":       true,
+		laptopServicePath + "VoteReviewHelpful": true,
+		laptopServicePath + "HideReview":        true,
+		laptopServicePath + "UnhideReview":      true,
 	}
 }
 
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/arcbjorn/store-management-system/pb/auth"
@@ -12,11 +21,14 @@ import (
 	"github.com/arcbjorn/store-management-system/services"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
+	_ "modernc.org/sqlite"
 )
 
 const (
 	secretKey     = "secret"
 	tokenDuration = 15 * time.Minute
+	// watch streams never end by themselves, so they are cut off after this
+	shutdownTimeout = 10 * time.Second
 )
 
 func createUser(userStore services.UserStore, username, password, role string) error {
@@ -24,7 +36,12 @@ func createUser(userStore services.UserStore, username, password, role string) e
 	if err != nil {
 		return err
 	}
-	return userStore.Save(user)
+	err = userStore.Save(user)
+	if errors.Is(err, services.ErrAlreadyExists) {
+		// users persisted by a previous run
+		return nil
+	}
+	return err
 }
 
 func seedUsers(userStore services.UserStore) error {
@@ -39,31 +56,251 @@ func accessibleRoles() map[string][]string {
 	const laptopServicePath = "/store.management.system.LaptopService/"
 
 	return map[string][]string{
-		laptopServicePath + "CreateLaptop": {"admin"},
-		laptopServicePath + "UploadImage":  {"admin"},
-		laptopServicePath + "RateLaptop":   {"admin", "user"},
+		laptopServicePath + "CreateLaptop":      {"admin"},
+		laptopServicePath + "GetLaptop":         {"admin", "user"},
+		laptopServicePath + "UpdateLaptop":      {"admin"},
+		laptopServicePath + "DeleteLaptop":      {"admin"},
+		laptopServicePath + "ListLaptops":       {"admin", "user"},
+		laptopServicePath + "UploadImage":       {"admin"},
+		laptopServicePath + "DownloadImage":     {"admin", "user"},
+		laptopServicePath + "ListImages":        {"admin", "user"},
+		laptopServicePath + "DeleteImage":       {"admin"},
+		laptopServicePath + "QueryUpload":       {"admin"},
+		laptopServicePath + "ReorderImages":     {"admin"},
+		laptopServicePath + "SetPrimaryImage":   {"admin"},
+		laptopServicePath + "RateLaptop":        {"admin", "user"},
+		laptopServicePath + "GetRating":         {"admin", "user"},
+		laptopServicePath + "GetRatingSummary":  {"admin", "user"},
+		laptopServicePath + "RetractRating":     {"admin", "user"},
+		laptopServicePath + "SubmitReview":      {"admin", "user"},
+		laptopServicePath + "ListReviews":       {"admin", "user"},
+		laptopServicePath + "VoteReviewHelpful": {"admin", "user"},
+		laptopServicePath + "HideReview":        {"admin"},
+		laptopServicePath + "UnhideReview":      {"admin"},
+	}
+}
+
+type stores struct {
+	userStore   services.UserStore
+	laptopStore services.LaptopStore
+	ratingStore services.RatingStore
+	reviewStore services.ReviewStore
+	// closers release the files and the database of the stores
+	closers []io.Closer
+}
+
+// close releases the files and the database of the stores, they must not be used afterwards
+func (stores *stores) close() {
+	for _, closer := range stores.closers {
+		err := closer.Close()
+		if err != nil {
+			log.Printf("cannot close store: %v", err)
+		}
+	}
+}
+
+func newStores(
+	kind string,
+	dataDir string,
+	snapshotInterval int,
+	database string,
+	ranking services.RatingRanking,
+) (*stores, error) {
+	switch kind {
+	case "memory":
+		return &stores{
+			userStore:   services.NewInMemoryUserStore(),
+			laptopStore: services.NewInMemoryLaptopStore(),
+			ratingStore: services.NewInMemoryRatingStore(ranking),
+			reviewStore: services.NewInMemoryReviewStore(),
+		}, nil
+	case "file":
+		laptopStore, err := services.NewFileLaptopStore(dataDir, snapshotInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		ratingStore, err := services.NewFileRatingStore(dataDir, snapshotInterval, ranking)
+		if err != nil {
+			return nil, err
+		}
+
+		reviewStore, err := services.NewFileReviewStore(dataDir, snapshotInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		return &stores{
+			userStore:   services.NewInMemoryUserStore(),
+			laptopStore: laptopStore,
+			ratingStore: ratingStore,
+			reviewStore: reviewStore,
+			closers:     []io.Closer{laptopStore, ratingStore, reviewStore},
+		}, nil
+	case "sql":
+		err := os.MkdirAll(filepath.Dir(database), 0755)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create database directory: %w", err)
+		}
+
+		db, err := sql.Open("sqlite", database)
+		if err != nil {
+			return nil, err
+		}
+
+		// SQLite allows a single writer, queue the writes here instead of failing on a busy database
+		db.SetMaxOpenConns(1)
+
+		err = services.MigrateSQL(db)
+		if err != nil {
+			return nil, err
+		}
+
+		return &stores{
+			userStore:   services.NewSQLUserStore(db),
+			laptopStore: services.NewSQLLaptopStore(db),
+			ratingStore: services.NewSQLRatingStore(db, ranking),
+			reviewStore: services.NewSQLReviewStore(db),
+			closers:     []io.Closer{db},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown store backend: %s", kind)
 	}
 }
 
+func exportCatalog(stores *stores, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	err = services.ExportCatalog(context.Background(), stores.laptopStore, stores.ratingStore, writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
 func main() {
 	port := flag.Int("port", 0, "the server port")
+	storeKind := flag.String("store", "memory", "the store backend: memory, file or sql")
+	dataDir := flag.String("data-dir", "data", "the directory of the file store")
+	snapshotInterval := flag.Int("snapshot-interval", 1000, "the number of logged changes between file store snapshots")
+	database := flag.String("database", "data/store.db", "the SQLite database of the sql store")
+	minScore := flag.Float64("min-score", 1, "the lowest score a laptop can be rated with")
+	maxScore := flag.Float64("max-score", 10, "the highest score a laptop can be rated with")
+	priorMean := flag.Float64("rating-prior-mean", 0, "the score a laptop is assumed to have before it is rated, the middle of the score range by default")
+	priorWeight := flag.Float64("rating-prior-weight", 5, "the number of scores the assumed score counts as")
+	halfLife := flag.Duration("rating-half-life", 0, "the age at which a score counts half in the decayed score, 0 disables it")
+	exportPath := flag.String("export", "", "write the laptops and ratings to this file and exit")
+	laptopImageQuota := flag.Int64("image-quota-per-laptop", 0, "the bytes the images of a laptop can use, 0 for no limit")
+	totalImageQuota := flag.Int64("image-quota-total", 0, "the bytes all images can use, 0 for no limit")
+	imageGracePeriod := flag.Duration("image-grace-period", 24*time.Hour, "how long orphaned images and files are kept")
+	imageSweepInterval := flag.Duration("image-sweep-interval", time.Hour, "how often orphaned images and files are looked for")
+	imageStoreKind := flag.String("image-store", "disk", "the image store backend: disk or s3, which has no quotas and does not sweep orphaned images")
+	imageDir := flag.String("image-dir", "img", "the directory of the disk image store")
+	s3Endpoint := flag.String("s3-endpoint", "", "the URL of the S3 compatible API of the s3 image store")
+	s3Region := flag.String("s3-region", "us-east-1", "the region of the s3 image store bucket")
+	s3Bucket := flag.String("s3-bucket", "", "the bucket of the s3 image store, its credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
 	flag.Parse()
+
+	priorMeanSet := false
+	flag.Visit(func(f *flag.Flag) {
+		priorMeanSet = priorMeanSet || f.Name == "rating-prior-mean"
+	})
+	if !priorMeanSet {
+		*priorMean = (*minScore + *maxScore) / 2
+	}
+
+	ranking := services.RatingRanking{
+		PriorMean:   *priorMean,
+		PriorWeight: *priorWeight,
+		HalfLife:    *halfLife,
+	}
+	err := ranking.Validate()
+	if err != nil {
+		log.Fatal("invalid rating ranking: ", err)
+	}
+
+	stores, err := newStores(*storeKind, *dataDir, *snapshotInterval, *database, ranking)
+	if err != nil {
+		log.Fatal("cannot create stores: ", err)
+	}
+
+	if *exportPath != "" {
+		err = exportCatalog(stores, *exportPath)
+		stores.close()
+		if err != nil {
+			log.Fatal("cannot export catalog: ", err)
+		}
+		log.Printf("exported catalog to %s", *exportPath)
+		return
+	}
+
 	log.Printf("start server on port %d", *port)
 
-	userStore := services.NewInMemoryUserStore()
-	err := seedUsers(userStore)
+	err = seedUsers(stores.userStore)
 	if err != nil {
 		log.Fatal("cannot seed users")
 	}
 
 	jwtManager := services.NewJWTManager(secretKey, tokenDuration)
-	authServer := services.NewAuthServer(userStore, jwtManager)
+	authServer := services.NewAuthServer(stores.userStore, jwtManager)
 
-	laptopStore := services.NewInMemoryLaptopStore()
-	imageStore := services.NewDiskImageStore("img")
-	ratingStore := services.NewInMemoryRatingStore()
+	sweepContext, stopSweeping := context.WithCancel(context.Background())
+	defer stopSweeping()
 
-	laptopServer := services.NewLaptopServer(laptopStore, imageStore, ratingStore)
+	var imageStore services.ImageStore
+	imageQuota := services.ImageQuota{PerLaptop: *laptopImageQuota, Total: *totalImageQuota}
+
+	switch *imageStoreKind {
+	case "disk":
+		diskImageStore, err := services.NewDiskImageStore(*imageDir)
+		if err != nil {
+			log.Fatal("cannot create image store: ", err)
+		}
+
+		err = diskImageStore.SetQuota(imageQuota)
+		if err != nil {
+			log.Fatal("invalid image quota: ", err)
+		}
+
+		imageSweeper := services.NewImageSweeper(diskImageStore, stores.laptopStore, *imageGracePeriod)
+		go imageSweeper.Run(sweepContext, *imageSweepInterval)
+		imageStore = diskImageStore
+		stores.closers = append(stores.closers, diskImageStore)
+	case "s3":
+		if imageQuota != (services.ImageQuota{}) {
+			log.Fatal("image quotas are only enforced by the disk image store")
+		}
+
+		imageStore, err = services.NewS3ImageStore(services.S3Config{
+			Endpoint:        *s3Endpoint,
+			Region:          *s3Region,
+			Bucket:          *s3Bucket,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+		if err != nil {
+			log.Fatal("cannot create image store: ", err)
+		}
+
+		log.Print("the s3 image store keeps the images of deleted laptops, they are not swept")
+	default:
+		log.Fatalf("unknown image store backend: %s", *imageStoreKind)
+	}
+
+	laptopServer := services.NewLaptopServer(stores.laptopStore, imageStore, stores.ratingStore, stores.reviewStore)
+	err = laptopServer.SetScoreRange(*minScore, *maxScore)
+	if err != nil {
+		log.Fatal("invalid score range: ", err)
+	}
 
 	authInterceptor := services.NewAuthInterceptor(jwtManager, accessibleRoles())
 
@@ -82,8 +319,26 @@ func main() {
 		log.Fatal("cannot start server: ", err)
 	}
 
+	// on an interrupt the requests in progress get some time to finish before the stores are closed
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		log.Print("stop server")
+		timer := time.AfterFunc(shutdownTimeout, grpcServer.Stop)
+		grpcServer.GracefulStop()
+		timer.Stop()
+		close(stopped)
+	}()
+
 	err = grpcServer.Serve(listener)
 	if err != nil {
 		log.Fatal("cannot start server: ", err)
 	}
+
+	<-stopped
+	stopSweeping()
+	stores.close()
 }
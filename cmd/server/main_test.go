@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessibleRoles(t *testing.T) {
+	t.Parallel()
+
+	const laptopServicePath = "/store.management.system.LaptopService/"
+	roles := accessibleRoles()
+
+	// changing the gallery of a laptop is up to admins, like uploading and deleting its images
+	for _, method := range []string{"UploadImage", "DeleteImage", "ReorderImages", "SetPrimaryImage"} {
+		require.Equal(t, []string{"admin"}, roles[laptopServicePath+method], method)
+	}
+}
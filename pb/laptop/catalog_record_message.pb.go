@@ -0,0 +1,198 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.27.1
+// 	protoc        v3.17.3
+// source: messages/catalog_record_message.proto
+
+package laptop
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type CatalogRecord struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Types that are assignable to Record:
+	//	*CatalogRecord_Laptop
+	//	*CatalogRecord_Rating
+	Record isCatalogRecord_Record `protobuf_oneof:"record"`
+}
+
+func (x *CatalogRecord) Reset() {
+	*x = CatalogRecord{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_messages_catalog_record_message_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CatalogRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CatalogRecord) ProtoMessage() {}
+
+func (x *CatalogRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_messages_catalog_record_message_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CatalogRecord.ProtoReflect.Descriptor instead.
+func (*CatalogRecord) Descriptor() ([]byte, []int) {
+	return file_messages_catalog_record_message_proto_rawDescGZIP(), []int{0}
+}
+
+func (m *CatalogRecord) GetRecord() isCatalogRecord_Record {
+	if m != nil {
+		return m.Record
+	}
+	return nil
+}
+
+func (x *CatalogRecord) GetLaptop() *Laptop {
+	if x, ok := x.GetRecord().(*CatalogRecord_Laptop); ok {
+		return x.Laptop
+	}
+	return nil
+}
+
+func (x *CatalogRecord) GetRating() *Rating {
+	if x, ok := x.GetRecord().(*CatalogRecord_Rating); ok {
+		return x.Rating
+	}
+	return nil
+}
+
+type isCatalogRecord_Record interface {
+	isCatalogRecord_Record()
+}
+
+type CatalogRecord_Laptop struct {
+	Laptop *Laptop `protobuf:"bytes,1,opt,name=laptop,proto3,oneof"`
+}
+
+type CatalogRecord_Rating struct {
+	Rating *Rating `protobuf:"bytes,2,opt,name=rating,proto3,oneof"`
+}
+
+func (*CatalogRecord_Laptop) isCatalogRecord_Record() {}
+
+func (*CatalogRecord_Rating) isCatalogRecord_Record() {}
+
+var File_messages_catalog_record_message_proto protoreflect.FileDescriptor
+
+var file_messages_catalog_record_message_proto_rawDesc = []byte{
+	0x0a, 0x25, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x2f, 0x63, 0x61, 0x74, 0x61, 0x6c,
+	0x6f, 0x67, 0x5f, 0x72, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67,
+	0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x17, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x6d,
+	0x61, 0x6e, 0x61, 0x67, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x2e, 0x73, 0x79, 0x73, 0x74, 0x65, 0x6d,
+	0x1a, 0x1d, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x2f, 0x6c, 0x61, 0x70, 0x74, 0x6f,
+	0x70, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a,
+	0x1d, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x2f, 0x72, 0x61, 0x74, 0x69, 0x6e, 0x67,
+	0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x8f,
+	0x01, 0x0a, 0x0d, 0x43, 0x61, 0x74, 0x61, 0x6c, 0x6f, 0x67, 0x52, 0x65, 0x63, 0x6f, 0x72, 0x64,
+	0x12, 0x39, 0x0a, 0x06, 0x6c, 0x61, 0x70, 0x74, 0x6f, 0x70, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x1f, 0x2e, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x6d, 0x61, 0x6e, 0x61, 0x67, 0x65, 0x6d,
+	0x65, 0x6e, 0x74, 0x2e, 0x73, 0x79, 0x73, 0x74, 0x65, 0x6d, 0x2e, 0x4c, 0x61, 0x70, 0x74, 0x6f,
+	0x70, 0x48, 0x00, 0x52, 0x06, 0x6c, 0x61, 0x70, 0x74, 0x6f, 0x70, 0x12, 0x39, 0x0a, 0x06, 0x72,
+	0x61, 0x74, 0x69, 0x6e, 0x67, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1f, 0x2e, 0x73, 0x74,
+	0x6f, 0x72, 0x65, 0x2e, 0x6d, 0x61, 0x6e, 0x61, 0x67, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x2e, 0x73,
+	0x79, 0x73, 0x74, 0x65, 0x6d, 0x2e, 0x52, 0x61, 0x74, 0x69, 0x6e, 0x67, 0x48, 0x00, 0x52, 0x06,
+	0x72, 0x61, 0x74, 0x69, 0x6e, 0x67, 0x42, 0x08, 0x0a, 0x06, 0x72, 0x65, 0x63, 0x6f, 0x72, 0x64,
+	0x42, 0x09, 0x5a, 0x07, 0x2f, 0x6c, 0x61, 0x70, 0x74, 0x6f, 0x70, 0x62, 0x06, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x33,
+}
+
+var (
+	file_messages_catalog_record_message_proto_rawDescOnce sync.Once
+	file_messages_catalog_record_message_proto_rawDescData = file_messages_catalog_record_message_proto_rawDesc
+)
+
+func file_messages_catalog_record_message_proto_rawDescGZIP() []byte {
+	file_messages_catalog_record_message_proto_rawDescOnce.Do(func() {
+		file_messages_catalog_record_message_proto_rawDescData = protoimpl.X.CompressGZIP(file_messages_catalog_record_message_proto_rawDescData)
+	})
+	return file_messages_catalog_record_message_proto_rawDescData
+}
+
+var file_messages_catalog_record_message_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_messages_catalog_record_message_proto_goTypes = []interface{}{
+	(*CatalogRecord)(nil), // 0: store.management.system.CatalogRecord
+	(*Laptop)(nil),        // 1: store.management.system.Laptop
+	(*Rating)(nil),        // 2: store.management.system.Rating
+}
+var file_messages_catalog_record_message_proto_depIdxs = []int32{
+	1, // 0: store.management.system.CatalogRecord.laptop:type_name -> store.management.system.Laptop
+	2, // 1: store.management.system.CatalogRecord.rating:type_name -> store.management.system.Rating
+	2, // [2:2] is the sub-list for method output_type
+	2, // [2:2] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_messages_catalog_record_message_proto_init() }
+func file_messages_catalog_record_message_proto_init() {
+	if File_messages_catalog_record_message_proto != nil {
+		return
+	}
+	file_messages_laptop_message_proto_init()
+	file_messages_rating_message_proto_init()
+	if !protoimpl.UnsafeEnabled {
+		file_messages_catalog_record_message_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CatalogRecord); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_messages_catalog_record_message_proto_msgTypes[0].OneofWrappers = []interface{}{
+		(*CatalogRecord_Laptop)(nil),
+		(*CatalogRecord_Rating)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_messages_catalog_record_message_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_messages_catalog_record_message_proto_goTypes,
+		DependencyIndexes: file_messages_catalog_record_message_proto_depIdxs,
+		MessageInfos:      file_messages_catalog_record_message_proto_msgTypes,
+	}.Build()
+	File_messages_catalog_record_message_proto = out.File
+	file_messages_catalog_record_message_proto_rawDesc = nil
+	file_messages_catalog_record_message_proto_goTypes = nil
+	file_messages_catalog_record_message_proto_depIdxs = nil
+}
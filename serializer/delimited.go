@@ -0,0 +1,80 @@
+package serializer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Largest record ReadDelimitedProtobuf accepts, so a corrupted length cannot make it allocate gigabytes
+const maxRecordSize = 64 << 20
+
+var ErrCorruptRecord = errors.New("record is corrupted")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Write proto message as a record prefixed with its length and checksum
+func WriteDelimitedProtobuf(writer io.Writer, message proto.Message) error {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("cannot marshal proto message to binary: %w", err)
+	}
+
+	header := make([]byte, binary.MaxVarintLen64+4)
+	n := binary.PutUvarint(header, uint64(len(data)))
+	binary.LittleEndian.PutUint32(header[n:], crc32.Checksum(data, crcTable))
+
+	// a single write keeps a record in one piece as far as the file system allows
+	_, err = writer.Write(append(header[:n+4], data...))
+	if err != nil {
+		return fmt.Errorf("cannot write record: %w", err)
+	}
+
+	return nil
+}
+
+// Read the next record written by WriteDelimitedProtobuf. It returns io.EOF when
+// there are no more records, and io.ErrUnexpectedEOF or ErrCorruptRecord when
+// the record was only partially written or got damaged.
+func ReadDelimitedProtobuf(reader *bufio.Reader, message proto.Message) error {
+	size, err := binary.ReadUvarint(reader)
+	if err == io.EOF {
+		return io.EOF
+	} else if err != nil {
+		return fmt.Errorf("cannot read record size: %w", unexpectedEOF(err))
+	}
+
+	if size > maxRecordSize {
+		return fmt.Errorf("record size %d is too large: %w", size, ErrCorruptRecord)
+	}
+
+	buffer := make([]byte, 4+size)
+	_, err = io.ReadFull(reader, buffer)
+	if err != nil {
+		return fmt.Errorf("cannot read record: %w", unexpectedEOF(err))
+	}
+
+	data := buffer[4:]
+	if binary.LittleEndian.Uint32(buffer) != crc32.Checksum(data, crcTable) {
+		return fmt.Errorf("checksum mismatch: %w", ErrCorruptRecord)
+	}
+
+	err = proto.Unmarshal(data, message)
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal binary to proto message: %w", err)
+	}
+
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
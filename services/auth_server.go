@@ -23,7 +23,7 @@ func (server *AuthServer) Login(
 ) (*auth.LoginResponse, error) {
 	user, err := server.userStore.Find(req.GetUsername())
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot find user: &v", err)
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
 	}
 	if user == nil || !user.IsCorrectPassword(req.GetPassword()) {
 		return nil, status.Errorf(codes.NotFound, "incorrect username / password")
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/arcbjorn/store-management-system/serializer"
+)
+
+// Number of laptops or ratings ExportCatalog reads from a store at once
+const exportPageSize = 500
+
+// ExportCatalog writes every laptop and then every rating to writer, as
+// CatalogRecord messages in the format of serializer.WriteDelimitedProtobuf.
+// Stores are read page by page, so changes made meanwhile may or may not be included.
+func ExportCatalog(ctx context.Context, laptopStore LaptopStore, ratingStore RatingStore, writer io.Writer) error {
+	afterID := ""
+	for {
+		laptops, err := laptopStore.List(ctx, afterID, exportPageSize)
+		if err != nil {
+			return fmt.Errorf("cannot list laptops: %w", err)
+		}
+
+		for _, lp := range laptops {
+			record := &laptop.CatalogRecord{
+				Record: &laptop.CatalogRecord_Laptop{Laptop: lp},
+			}
+
+			err := serializer.WriteDelimitedProtobuf(writer, record)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(laptops) < exportPageSize {
+			break
+		}
+		afterID = laptops[len(laptops)-1].GetId()
+	}
+
+	afterID = ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		ratings, err := ratingStore.List(afterID, exportPageSize)
+		if err != nil {
+			return fmt.Errorf("cannot list ratings: %w", err)
+		}
+
+		for _, rating := range ratings {
+			record := &laptop.CatalogRecord{
+				Record: &laptop.CatalogRecord_Rating{Rating: toRatingMessage(rating.LaptopID, rating)},
+			}
+
+			err := serializer.WriteDelimitedProtobuf(writer, record)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(ratings) < exportPageSize {
+			return nil
+		}
+		afterID = ratings[len(ratings)-1].LaptopID
+	}
+}
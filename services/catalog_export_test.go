@@ -0,0 +1,61 @@
+package services_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/arcbjorn/store-management-system/sample"
+	"github.com/arcbjorn/store-management-system/serializer"
+	"github.com/arcbjorn/store-management-system/services"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportCatalog(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	ratingStore := services.NewInMemoryRatingStore(services.DefaultRatingRanking())
+
+	laptopIDs := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		lp := sample.NewLaptop()
+		require.NoError(t, laptopStore.Save(lp))
+		laptopIDs[lp.Id] = true
+
+		_, err := ratingStore.Add(lp.Id, "user1", 7)
+		require.NoError(t, err)
+	}
+
+	buffer := &bytes.Buffer{}
+	err := services.ExportCatalog(context.Background(), laptopStore, ratingStore, buffer)
+	require.NoError(t, err)
+
+	exportedLaptops := map[string]bool{}
+	exportedRatings := map[string]bool{}
+
+	reader := bufio.NewReader(buffer)
+	for {
+		record := &laptop.CatalogRecord{}
+		err := serializer.ReadDelimitedProtobuf(reader, record)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		if lp := record.GetLaptop(); lp != nil {
+			require.Empty(t, exportedRatings, "laptops come before ratings")
+			exportedLaptops[lp.GetId()] = true
+		} else {
+			require.Equal(t, uint32(1), record.GetRating().GetRatedCount())
+			require.Equal(t, 7.0, record.GetRating().GetAverageScore())
+			exportedRatings[record.GetRating().GetLaptopId()] = true
+		}
+	}
+
+	require.Equal(t, laptopIDs, exportedLaptops)
+	require.Equal(t, laptopIDs, exportedRatings)
+}
@@ -0,0 +1,346 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/arcbjorn/store-management-system/serializer"
+)
+
+const (
+	imageIndexFile = ".images.index"
+	imageLogFile   = ".images.log"
+	// the number of logged changes between snapshots of the image index
+	imageIndexSnapshotInterval = 1000
+)
+
+func (store *DiskImageStore) indexPath() string {
+	return filepath.Join(store.imageFolder, imageIndexFile)
+}
+
+func (store *DiskImageStore) logPath() string {
+	return filepath.Join(store.imageFolder, imageLogFile)
+}
+
+func (store *DiskImageStore) renditionPath(checksum string, maxSize int, imageType string) string {
+	return filepath.Join(store.imageFolder, fmt.Sprintf("%s-%d%s", checksum, maxSize, imageType))
+}
+
+// loadIndex reads the images of the snapshot, as written by compact
+func (store *DiskImageStore) loadIndex() error {
+	file, err := os.Open(store.indexPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot open image index: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		image := &laptop.Image{}
+		err := serializer.ReadDelimitedProtobuf(reader, image)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			// the index is renamed into place once complete, so this is not a torn write
+			return fmt.Errorf("cannot read image index: %w", err)
+		}
+
+		store.index(image)
+	}
+}
+
+// replayLog applies the logged changes. A record that was cut short or damaged
+// by a crash ends the log, which is truncated right before it.
+func (store *DiskImageStore) replayLog() error {
+	file, err := os.Open(store.logPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot open image log: %w", err)
+	}
+	defer file.Close()
+
+	counter := &countingReader{reader: file}
+	reader := bufio.NewReader(counter)
+
+	for {
+		offset := counter.count - int64(reader.Buffered())
+
+		change := &laptop.ImageIndexRecord{}
+		err := serializer.ReadDelimitedProtobuf(reader, change)
+		if err == io.EOF {
+			store.logSize = offset
+			return nil
+		}
+
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, serializer.ErrCorruptRecord) {
+			log.Printf("truncate image log at offset %d after a broken record: %v", offset, err)
+			store.logSize = offset
+			return os.Truncate(store.logPath(), offset)
+		} else if err != nil {
+			return fmt.Errorf("cannot read image log: %w", err)
+		}
+
+		store.apply(change)
+		store.logRecords++
+	}
+}
+
+// change logs the change of the images before applying it, it returns the blobs
+// no image refers to anymore. The mutex must be held.
+func (store *DiskImageStore) change(change *laptop.ImageIndexRecord) ([]*diskImageBlob, error) {
+	err := serializer.WriteDelimitedProtobuf(store.logFile, change)
+	if err == nil {
+		err = store.logFile.Sync()
+	}
+
+	if err != nil {
+		// drop whatever part of the record made it to the file, so later records stay readable
+		store.logFile.Truncate(store.logSize)
+		return nil, fmt.Errorf("cannot log image change: %w", err)
+	}
+
+	fileInfo, err := store.logFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot log image change: %w", err)
+	}
+	store.logSize = fileInfo.Size()
+
+	released := store.apply(change)
+
+	store.logRecords++
+	if store.logRecords >= imageIndexSnapshotInterval {
+		err = store.compact()
+		if err != nil {
+			// the log still has every change, so compaction is retried on the next one
+			log.Printf("cannot compact image log: %v", err)
+		}
+	}
+
+	return released, nil
+}
+
+// apply adds, replaces or deletes the images of the change,
+// it returns the blobs no image refers to anymore
+func (store *DiskImageStore) apply(change *laptop.ImageIndexRecord) []*diskImageBlob {
+	released := []*diskImageBlob{}
+	for _, image := range change.GetImages() {
+		if !change.GetDeleted() {
+			store.index(image)
+		} else if blob := store.release(image.GetId()); blob != nil {
+			released = append(released, blob)
+		}
+	}
+	return released
+}
+
+// index adds or replaces an image, along with the renditions of its content
+func (store *DiskImageStore) index(image *laptop.Image) {
+	info := toImageInfo(image)
+	info.Path = filepath.Join(store.imageFolder, info.Checksum+info.Type)
+
+	// renditions are kept by the content they were made of
+	renditions := info.Renditions
+	info.Renditions = nil
+	info.Primary = false
+	for _, rendition := range renditions {
+		rendition.Path = store.renditionPath(info.Checksum, rendition.MaxSize, rendition.Type)
+	}
+
+	blob := store.blobs[info.Checksum]
+	if blob == nil {
+		blob = &diskImageBlob{path: info.Path, size: info.Size}
+		store.blobs[info.Checksum] = blob
+		store.blobUsage += blob.size
+	}
+	blob.renditions = renditions
+
+	if store.images[info.ID] == nil {
+		blob.references++
+		store.laptopUsage[info.LaptopID] += info.Size
+	}
+	store.images[info.ID] = info
+	if image.GetIsPrimary() {
+		store.primary[info.LaptopID] = info.ID
+	}
+}
+
+// release removes an image, it returns the blob of its content once no image refers to it
+func (store *DiskImageStore) release(imageID string) *diskImageBlob {
+	info := store.images[imageID]
+	if info == nil {
+		return nil
+	}
+
+	store.laptopUsage[info.LaptopID] -= info.Size
+	if store.laptopUsage[info.LaptopID] == 0 {
+		delete(store.laptopUsage, info.LaptopID)
+	}
+
+	blob := store.blobs[info.Checksum]
+	blob.references--
+	store.forget(info)
+	if blob.references > 0 {
+		return nil
+	}
+
+	delete(store.blobs, info.Checksum)
+	store.blobUsage -= blob.size
+	return blob
+}
+
+// compact writes every image to a new snapshot of the index and empties the log
+func (store *DiskImageStore) compact() error {
+	ids := make([]string, 0, len(store.images))
+	for id := range store.images {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	tmpPath := store.indexPath() + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("cannot create image index: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, id := range ids {
+		err = serializer.WriteDelimitedProtobuf(writer, toImageMessage(store.find(id)))
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write image index: %w", err)
+	}
+
+	err = os.Rename(tmpPath, store.indexPath())
+	if err != nil {
+		return fmt.Errorf("cannot replace image index: %w", err)
+	}
+
+	err = syncDir(store.imageFolder)
+	if err != nil {
+		return err
+	}
+
+	// replaying changes the snapshot already holds is harmless
+	err = store.logFile.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("cannot truncate image log: %w", err)
+	}
+
+	store.logSize = 0
+	store.logRecords = 0
+	return nil
+}
+
+// imagesByLaptop returns the IDs of all images by laptop ID
+func (store *DiskImageStore) imagesByLaptop() map[string][]string {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	images := make(map[string][]string)
+	for _, info := range store.images {
+		images[info.LaptopID] = append(images[info.LaptopID], info.ID)
+	}
+	return images
+}
+
+// removeOrphanFiles deletes the files last modified before the time which no image refers to,
+// and the files of uploads that are not in progress. It returns the names of the deleted files.
+// The folder is scanned without the lock, so uploads and downloads go on meanwhile.
+func (store *DiskImageStore) removeOrphanFiles(before time.Time) ([]string, error) {
+	store.mutex.RLock()
+	referenced := store.referencedFiles()
+	store.mutex.RUnlock()
+
+	entries, err := os.ReadDir(store.imageFolder)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image folder: %w", err)
+	}
+
+	orphans := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || referenced[name] {
+			continue
+		}
+
+		fileInfo, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot stat image file: %w", err)
+		} else if fileInfo.ModTime().Before(before) {
+			orphans = append(orphans, name)
+		}
+	}
+
+	removed := []string{}
+	if len(orphans) == 0 {
+		return removed, nil
+	}
+
+	// an image may have been committed with the same content since the scan
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	referenced = store.referencedFiles()
+	for _, name := range orphans {
+		if referenced[name] {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(store.imageFolder, name))
+		if err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("cannot delete orphan image file: %w", err)
+		}
+		removed = append(removed, name)
+	}
+
+	return removed, nil
+}
+
+// referencedFiles returns the names of the files in the image folder that are in use,
+// the mutex must be held
+func (store *DiskImageStore) referencedFiles() map[string]bool {
+	referenced := map[string]bool{imageIndexFile: true, imageLogFile: true}
+	for imageID := range store.uploading {
+		uploadFile := filepath.Base(store.uploadPath(imageID))
+		referenced[uploadFile] = true
+		referenced[uploadFile+".json"] = true
+	}
+	for checksum := range store.publishing {
+		for _, imageType := range imageTypes {
+			referenced[checksum+imageType] = true
+		}
+	}
+	for _, blob := range store.blobs {
+		referenced[filepath.Base(blob.path)] = true
+		for _, rendition := range blob.renditions {
+			referenced[filepath.Base(rendition.Path)] = true
+		}
+	}
+
+	return referenced
+}
@@ -0,0 +1,344 @@
+package services_test
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/arcbjorn/store-management-system/services"
+)
+
+const fakeS3MinPartSize = 5 << 20
+
+// fakeS3 serves the part of the S3 API the image store uses from memory: objects with conditional
+// writes and multipart uploads. Like S3, it checks the signature of every request.
+type fakeS3 struct {
+	mutex        sync.Mutex
+	config       services.S3Config
+	objects      map[string]*fakeS3Object
+	uploads      map[string]*fakeS3Upload
+	nextUploadID int
+	// requests counts the requests by operation, such as CompleteMultipartUpload
+	requests map[string]int
+}
+
+type fakeS3Object struct {
+	data        []byte
+	etag        string
+	contentType string
+}
+
+type fakeS3Upload struct {
+	key         string
+	contentType string
+	parts       map[int][]byte
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, services.S3Config) {
+	fake := &fakeS3{
+		config: services.S3Config{
+			Region:          "eu-west-1",
+			Bucket:          "laptop-images",
+			AccessKeyID:     "test-access-key",
+			SecretAccessKey: "test-secret-key",
+		},
+		objects:  make(map[string]*fakeS3Object),
+		uploads:  make(map[string]*fakeS3Upload),
+		requests: make(map[string]int),
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	config := fake.config
+	config.Endpoint = server.URL
+	return fake, config
+}
+
+// keys returns the keys of all objects, sorted
+func (fake *fakeS3) keys() []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	keys := []string{}
+	for key := range fake.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (fake *fakeS3) count(operation string) int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return fake.requests[operation]
+}
+
+func (fake *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeFakeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	if code := fake.authenticate(r, body); code != "" {
+		writeFakeS3Error(w, http.StatusForbidden, code)
+		return
+	}
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if path[0] != fake.config.Bucket {
+		writeFakeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	} else if len(path) < 2 || path[1] == "" {
+		writeFakeS3Error(w, http.StatusBadRequest, "InvalidRequest")
+		return
+	}
+	key := path[1]
+	query := r.URL.Query()
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	switch {
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		fake.requests["UploadPart"]++
+		upload := fake.uploads[query.Get("uploadId")]
+		number, err := strconv.Atoi(query.Get("partNumber"))
+		if upload == nil || upload.key != key {
+			writeFakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		} else if err != nil || number < 1 || number > 10000 {
+			writeFakeS3Error(w, http.StatusBadRequest, "InvalidArgument")
+		} else {
+			upload.parts[number] = body
+			w.Header().Set("ETag", fakeS3ETag(body))
+		}
+
+	case r.Method == http.MethodPut:
+		fake.requests["PutObject"]++
+		current := fake.objects[key]
+		match := r.Header.Get("If-Match")
+		if (match != "" && (current == nil || current.etag != match)) ||
+			(r.Header.Get("If-None-Match") == "*" && current != nil) {
+			writeFakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+
+		object := &fakeS3Object{data: body, etag: fakeS3ETag(body), contentType: r.Header.Get("Content-Type")}
+		fake.objects[key] = object
+		w.Header().Set("ETag", object.etag)
+
+	case r.Method == http.MethodGet:
+		fake.requests["GetObject"]++
+		object := fake.objects[key]
+		if object == nil {
+			writeFakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		w.Header().Set("ETag", object.etag)
+		w.Header().Set("Content-Type", object.contentType)
+		w.Write(object.data)
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		fake.requests["AbortMultipartUpload"]++
+		if fake.uploads[query.Get("uploadId")] == nil {
+			writeFakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+
+		delete(fake.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete:
+		fake.requests["DeleteObject"]++
+		delete(fake.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		fake.requests["CreateMultipartUpload"]++
+		fake.nextUploadID++
+		uploadID := fmt.Sprintf("upload-%d", fake.nextUploadID)
+		fake.uploads[uploadID] = &fakeS3Upload{
+			key:         key,
+			contentType: r.Header.Get("Content-Type"),
+			parts:       make(map[int][]byte),
+		}
+
+		writeFakeS3XML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadID string `xml:"UploadId"`
+		}{Bucket: fake.config.Bucket, Key: key, UploadID: uploadID})
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		fake.requests["CompleteMultipartUpload"]++
+		fake.completeMultipartUpload(w, key, query.Get("uploadId"), body)
+
+	default:
+		writeFakeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (fake *fakeS3) completeMultipartUpload(w http.ResponseWriter, key string, uploadID string, body []byte) {
+	upload := fake.uploads[uploadID]
+	if upload == nil || upload.key != key {
+		writeFakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	request := struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}{}
+	if xml.Unmarshal(body, &request) != nil || len(request.Parts) == 0 {
+		writeFakeS3Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	data := []byte{}
+	digests := []byte{}
+	for i, part := range request.Parts {
+		content, ok := upload.parts[part.PartNumber]
+		if !ok || fakeS3ETag(content) != part.ETag {
+			writeFakeS3Error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		} else if i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber {
+			writeFakeS3Error(w, http.StatusBadRequest, "InvalidPartOrder")
+			return
+		} else if i < len(request.Parts)-1 && len(content) < fakeS3MinPartSize {
+			writeFakeS3Error(w, http.StatusBadRequest, "EntityTooSmall")
+			return
+		}
+
+		data = append(data, content...)
+		digest := md5.Sum(content)
+		digests = append(digests, digest[:]...)
+	}
+
+	digest := md5.Sum(digests)
+	object := &fakeS3Object{
+		data:        data,
+		etag:        fmt.Sprintf("\"%x-%d\"", digest, len(request.Parts)),
+		contentType: upload.contentType,
+	}
+	fake.objects[key] = object
+	delete(fake.uploads, uploadID)
+
+	writeFakeS3XML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: fake.config.Bucket, Key: key, ETag: object.etag})
+}
+
+// authenticate returns the error code of S3 for a request without a valid signature
+func (fake *fakeS3) authenticate(r *http.Request, body []byte) string {
+	payloadHash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(payloadHash[:]) {
+		return "XAmzContentSHA256Mismatch"
+	}
+
+	fields := map[string]string{}
+	authorization := strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	for _, field := range strings.Split(authorization, ",") {
+		pair := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(pair) == 2 {
+			fields[pair[0]] = pair[1]
+		}
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) != len("20060102T150405Z") {
+		return "AccessDenied"
+	}
+	scope := amzDate[:8] + "/" + fake.config.Region + "/s3/aws4_request"
+	if fields["Credential"] != fake.config.AccessKeyID+"/"+scope {
+		return "InvalidAccessKeyId"
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	canonicalHeaders := ""
+	for _, name := range signedHeaders {
+		value := strings.Join(r.Header.Values(name), ",")
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders += name + ":" + strings.TrimSpace(value) + "\n"
+	}
+
+	query := r.URL.Query()
+	names := []string{}
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := []string{}
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, fakeS3Escape(name)+"="+fakeS3Escape(value))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.Join(pairs, "&"),
+		canonicalHeaders,
+		fields["SignedHeaders"],
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + fake.config.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], fake.config.Region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+
+	if !hmac.Equal([]byte(fields["Signature"]), []byte(hex.EncodeToString(key))) {
+		return "SignatureDoesNotMatch"
+	}
+	return ""
+}
+
+func fakeS3Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func fakeS3ETag(content []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(content))
+}
+
+func writeFakeS3Error(w http.ResponseWriter, statusCode int, code string) {
+	w.WriteHeader(statusCode)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: http.StatusText(statusCode)})
+}
+
+func writeFakeS3XML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
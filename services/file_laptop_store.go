@@ -0,0 +1,257 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/arcbjorn/store-management-system/serializer"
+)
+
+const (
+	laptopSnapshotFile = "laptops.snapshot"
+	laptopLogFile      = "laptops.log"
+)
+
+// FileLaptopStore serves laptops from memory and persists every change to an
+// append-only log in the data directory before applying it. Every
+// snapshotInterval changes the log is compacted into a snapshot of the whole
+// catalog. Opening the store loads the snapshot and replays the log on top.
+type FileLaptopStore struct {
+	*InMemoryLaptopStore
+	dataDir          string
+	logFile          *os.File
+	logSize          int64
+	logRecords       int
+	snapshotInterval int
+}
+
+func NewFileLaptopStore(dataDir string, snapshotInterval int) (*FileLaptopStore, error) {
+	if snapshotInterval <= 0 {
+		return nil, fmt.Errorf("snapshot interval must be positive: %d", snapshotInterval)
+	}
+
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create data directory: %w", err)
+	}
+
+	store := &FileLaptopStore{
+		InMemoryLaptopStore: NewInMemoryLaptopStore(),
+		dataDir:             dataDir,
+		snapshotInterval:    snapshotInterval,
+	}
+
+	err = store.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.replayLog()
+	if err != nil {
+		return nil, err
+	}
+
+	store.logFile, err = os.OpenFile(store.path(laptopLogFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open laptop log: %w", err)
+	}
+
+	store.journal = store
+	return store, nil
+}
+
+// Close releases the log file, the store must not be used afterwards
+func (store *FileLaptopStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.logFile.Close()
+}
+
+func (store *FileLaptopStore) path(name string) string {
+	return filepath.Join(store.dataDir, name)
+}
+
+func (store *FileLaptopStore) loadSnapshot() error {
+	file, err := os.Open(store.path(laptopSnapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot open laptop snapshot: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		event := &laptop.LaptopEvent{}
+		err := serializer.ReadDelimitedProtobuf(reader, event)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			// snapshots are renamed into place once complete, so this is not a torn write
+			return fmt.Errorf("cannot read laptop snapshot: %w", err)
+		}
+
+		store.apply(event.GetType(), event.GetLaptop())
+	}
+}
+
+// replayLog applies the logged changes. A record that was cut short or damaged
+// by a crash ends the log, which is truncated right before it.
+func (store *FileLaptopStore) replayLog() error {
+	file, err := os.Open(store.path(laptopLogFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot open laptop log: %w", err)
+	}
+	defer file.Close()
+
+	counter := &countingReader{reader: file}
+	reader := bufio.NewReader(counter)
+
+	for {
+		offset := counter.count - int64(reader.Buffered())
+
+		event := &laptop.LaptopEvent{}
+		err := serializer.ReadDelimitedProtobuf(reader, event)
+		if err == io.EOF {
+			store.logSize = offset
+			return nil
+		}
+
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, serializer.ErrCorruptRecord) {
+			log.Printf("truncate laptop log at offset %d after a broken record: %v", offset, err)
+			store.logSize = offset
+			return os.Truncate(store.path(laptopLogFile), offset)
+		} else if err != nil {
+			return fmt.Errorf("cannot read laptop log: %w", err)
+		}
+
+		store.apply(event.GetType(), event.GetLaptop())
+		store.logRecords++
+	}
+}
+
+func (store *FileLaptopStore) record(eventType laptop.LaptopEvent_Type, lp *laptop.Laptop) error {
+	event := &laptop.LaptopEvent{
+		Type:   eventType,
+		Laptop: lp,
+	}
+
+	err := serializer.WriteDelimitedProtobuf(store.logFile, event)
+	if err == nil {
+		err = store.logFile.Sync()
+	}
+
+	if err != nil {
+		// drop whatever part of the record made it to the file, so later records stay readable
+		store.logFile.Truncate(store.logSize)
+		return err
+	}
+
+	info, err := store.logFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	store.logSize = info.Size()
+	return nil
+}
+
+func (store *FileLaptopStore) committed() {
+	store.logRecords++
+	if store.logRecords < store.snapshotInterval {
+		return
+	}
+
+	err := store.compact()
+	if err != nil {
+		// the log still has every change, so compaction is retried on the next one
+		log.Printf("cannot compact laptop log: %v", err)
+	}
+}
+
+// compact writes the whole catalog to a new snapshot and empties the log
+func (store *FileLaptopStore) compact() error {
+	tmpPath := store.path(laptopSnapshotFile + ".tmp")
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("cannot create laptop snapshot: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, id := range store.ids {
+		event := &laptop.LaptopEvent{
+			Type:   laptop.LaptopEvent_CREATED,
+			Laptop: store.data[id],
+		}
+
+		err = serializer.WriteDelimitedProtobuf(writer, event)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write laptop snapshot: %w", err)
+	}
+
+	err = os.Rename(tmpPath, store.path(laptopSnapshotFile))
+	if err != nil {
+		return fmt.Errorf("cannot replace laptop snapshot: %w", err)
+	}
+
+	err = syncDir(store.dataDir)
+	if err != nil {
+		return err
+	}
+
+	// replaying changes the snapshot already holds is harmless, so a crash
+	// before the truncation does not lose or duplicate anything
+	err = store.logFile.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("cannot truncate laptop log: %w", err)
+	}
+
+	store.logSize = 0
+	store.logRecords = 0
+	return nil
+}
+
+// syncDir makes a rename inside the directory durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("cannot open directory: %w", err)
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	counter.count += int64(n)
+	return n, err
+}
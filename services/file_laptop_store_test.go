@@ -0,0 +1,109 @@
+package services_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arcbjorn/store-management-system/sample"
+	"github.com/arcbjorn/store-management-system/services"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLaptopStoreRecovery(t *testing.T) {
+	t.Parallel()
+
+	dataDir := t.TempDir()
+
+	store, err := services.NewFileLaptopStore(dataDir, 1000)
+	require.NoError(t, err)
+
+	updated := sample.NewLaptop()
+	deleted := sample.NewLaptop()
+	require.NoError(t, store.Save(updated))
+	require.NoError(t, store.Save(deleted))
+
+	updated.PriceUsd = 1234
+	require.NoError(t, store.Update(updated))
+	require.NoError(t, store.Delete(deleted.Id))
+	require.NoError(t, store.Close())
+
+	// simulate a crash in the middle of appending a record
+	logFile, err := os.OpenFile(filepath.Join(dataDir, "laptops.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = logFile.Write([]byte{0x7f, 0x01, 0x02})
+	require.NoError(t, err)
+	require.NoError(t, logFile.Close())
+
+	store, err = services.NewFileLaptopStore(dataDir, 1000)
+	require.NoError(t, err)
+
+	found, err := store.Find(updated.Id)
+	require.NoError(t, err)
+	requireSameLaptop(t, updated, found)
+	require.Equal(t, uint64(2), found.GetRevision())
+
+	found, err = store.Find(deleted.Id)
+	require.NoError(t, err)
+	require.Nil(t, found)
+
+	// the broken tail is gone, so new records are readable after the next restart
+	added := sample.NewLaptop()
+	require.NoError(t, store.Save(added))
+	require.NoError(t, store.Close())
+
+	store, err = services.NewFileLaptopStore(dataDir, 1000)
+	require.NoError(t, err)
+	defer store.Close()
+
+	found, err = store.Find(added.Id)
+	require.NoError(t, err)
+	requireSameLaptop(t, added, found)
+}
+
+func TestFileLaptopStoreSnapshot(t *testing.T) {
+	t.Parallel()
+
+	dataDir := t.TempDir()
+
+	store, err := services.NewFileLaptopStore(dataDir, 3)
+	require.NoError(t, err)
+
+	laptopIDs := []string{}
+	for i := 0; i < 4; i++ {
+		lp := sample.NewLaptop()
+		require.NoError(t, store.Save(lp))
+		laptopIDs = append(laptopIDs, lp.Id)
+	}
+	require.NoError(t, store.Close())
+
+	require.FileExists(t, filepath.Join(dataDir, "laptops.snapshot"))
+	info, err := os.Stat(filepath.Join(dataDir, "laptops.log"))
+	require.NoError(t, err)
+	require.NotZero(t, info.Size(), "the change after the snapshot stays in the log")
+
+	store, err = services.NewFileLaptopStore(dataDir, 3)
+	require.NoError(t, err)
+	defer store.Close()
+
+	for _, id := range laptopIDs {
+		found, err := store.Find(id)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+	}
+}
+
+func TestFileStoresSnapshotInterval(t *testing.T) {
+	t.Parallel()
+
+	dataDir := t.TempDir()
+
+	_, err := services.NewFileLaptopStore(dataDir, 0)
+	require.Error(t, err)
+
+	_, err = services.NewFileRatingStore(dataDir, -1, services.DefaultRatingRanking())
+	require.Error(t, err)
+
+	_, err = services.NewFileReviewStore(dataDir, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,370 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/arcbjorn/store-management-system/serializer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	ratingSnapshotFile = "user_ratings.snapshot"
+	ratingLogFile      = "user_ratings.log"
+	// files of the totals of every laptop, written before scores were recorded per user
+	legacyRatingSnapshotFile = "ratings.snapshot"
+	legacyRatingLogFile      = "ratings.log"
+)
+
+// FileRatingStore serves ratings from memory and persists them the same way
+// FileLaptopStore does. Every log record sets or retracts the score of one
+// user, so replaying a record twice is harmless. The files are named after the
+// record type, so the ones of older versions are never read as the wrong type.
+type FileRatingStore struct {
+	*InMemoryRatingStore
+	// serializes changes, so they are applied in the order they are logged
+	mutex            sync.Mutex
+	dataDir          string
+	logFile          *os.File
+	logSize          int64
+	logRecords       int
+	snapshotInterval int
+}
+
+func NewFileRatingStore(dataDir string, snapshotInterval int, ranking RatingRanking) (*FileRatingStore, error) {
+	if snapshotInterval <= 0 {
+		return nil, fmt.Errorf("snapshot interval must be positive: %d", snapshotInterval)
+	}
+
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create data directory: %w", err)
+	}
+
+	store := &FileRatingStore{
+		InMemoryRatingStore: NewInMemoryRatingStore(ranking),
+		dataDir:             dataDir,
+		snapshotInterval:    snapshotInterval,
+	}
+
+	_, err = store.load(ratingSnapshotFile, false)
+	if err != nil {
+		return nil, err
+	}
+
+	store.logRecords, err = store.load(ratingLogFile, true)
+	if err != nil {
+		return nil, err
+	}
+
+	store.logFile, err = os.OpenFile(store.path(ratingLogFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open rating log: %w", err)
+	}
+
+	info, err := store.logFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	store.logSize = info.Size()
+
+	err = store.migrateLegacyTotals()
+	if err != nil {
+		store.logFile.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// migrateLegacyTotals turns the totals of the legacy files into scores of legacyRatingUser
+// names and writes them to a snapshot. The legacy files are kept with a .migrated suffix.
+// Once there is a snapshot or a logged score, the legacy files are ignored.
+func (store *FileRatingStore) migrateLegacyTotals() error {
+	_, err := os.Stat(store.path(ratingSnapshotFile))
+	if err == nil || store.logRecords > 0 {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot find rating snapshot: %w", err)
+	}
+
+	totals := make(map[string]*laptop.Rating)
+	legacyFiles := []string{}
+	for _, name := range []string{legacyRatingSnapshotFile, legacyRatingLogFile} {
+		found, err := loadLegacyTotals(store.path(name), totals, name == legacyRatingLogFile)
+		if err != nil {
+			return err
+		}
+		if found {
+			legacyFiles = append(legacyFiles, name)
+		}
+	}
+
+	if len(legacyFiles) == 0 {
+		return nil
+	}
+
+	ratedAt := time.Now()
+	for laptopID, total := range totals {
+		for i := uint32(1); i <= total.GetRatedCount(); i++ {
+			username := fmt.Sprintf("%s%d", legacyRatingUser, i)
+			store.add(laptopID, username, total.GetScoreSum()/float64(total.GetRatedCount()), ratedAt)
+		}
+	}
+
+	err = store.compact()
+	if err != nil {
+		return fmt.Errorf("cannot migrate legacy ratings: %w", err)
+	}
+
+	for _, name := range legacyFiles {
+		err = os.Rename(store.path(name), store.path(name+".migrated"))
+		if err != nil {
+			return fmt.Errorf("cannot keep legacy ratings: %w", err)
+		}
+	}
+
+	log.Printf("migrated the legacy ratings of %d laptops", len(totals))
+	return syncDir(store.dataDir)
+}
+
+// loadLegacyTotals reads the latest totals of every laptop from a legacy file.
+// A broken record ends a legacy log, as it did when the log was written.
+func loadLegacyTotals(path string, totals map[string]*laptop.Rating, skipBroken bool) (bool, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("cannot open legacy ratings: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		total := &laptop.Rating{}
+		err := serializer.ReadDelimitedProtobuf(reader, total)
+		if err == io.EOF {
+			return true, nil
+		}
+
+		broken := errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, serializer.ErrCorruptRecord)
+		if broken && skipBroken {
+			log.Printf("ignore the legacy ratings of %s after a broken record: %v", path, err)
+			return true, nil
+		} else if err != nil {
+			return false, fmt.Errorf("cannot read legacy ratings: %w", err)
+		}
+
+		if total.GetRatedCount() == 0 {
+			delete(totals, total.GetLaptopId())
+		} else {
+			totals[total.GetLaptopId()] = total
+		}
+	}
+}
+
+// Close releases the log file, the store must not be used afterwards
+func (store *FileRatingStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.logFile.Close()
+}
+
+func (store *FileRatingStore) Add(laptopID string, username string, score float64) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ratedAt := time.Now()
+
+	err := store.record(&laptop.UserRating{
+		LaptopId: laptopID,
+		Username: username,
+		Score:    score,
+		RatedAt:  timestamppb.New(ratedAt),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rating, err := store.add(laptopID, username, score, ratedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	store.committed()
+	return rating, nil
+}
+
+func (store *FileRatingStore) Retract(laptopID string, username string) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.score(laptopID, username); !ok {
+		return nil, ErrNotFound
+	}
+
+	err := store.record(&laptop.UserRating{
+		LaptopId:  laptopID,
+		Username:  username,
+		Retracted: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rating, err := store.InMemoryRatingStore.Retract(laptopID, username)
+	if err != nil {
+		return nil, err
+	}
+
+	store.committed()
+	return rating, nil
+}
+
+func (store *FileRatingStore) record(change *laptop.UserRating) error {
+	err := serializer.WriteDelimitedProtobuf(store.logFile, change)
+	if err == nil {
+		err = store.logFile.Sync()
+	}
+
+	if err != nil {
+		// drop whatever part of the record made it to the file, so later records stay readable
+		store.logFile.Truncate(store.logSize)
+		return fmt.Errorf("cannot write rating log: %w", err)
+	}
+
+	info, err := store.logFile.Stat()
+	if err != nil {
+		return err
+	}
+	store.logSize = info.Size()
+
+	return nil
+}
+
+func (store *FileRatingStore) committed() {
+	store.logRecords++
+	if store.logRecords < store.snapshotInterval {
+		return
+	}
+
+	err := store.compact()
+	if err != nil {
+		// the log still has every change, so compaction is retried on the next one
+		log.Printf("cannot compact rating log: %v", err)
+	}
+}
+
+func (store *FileRatingStore) path(name string) string {
+	return filepath.Join(store.dataDir, name)
+}
+
+// load applies the records of a snapshot or log file and returns how many it read.
+// A broken record ends a log, which is truncated right before it.
+func (store *FileRatingStore) load(name string, truncateBroken bool) (int, error) {
+	file, err := os.Open(store.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("cannot open %s: %w", name, err)
+	}
+	defer file.Close()
+
+	counter := &countingReader{reader: file}
+	reader := bufio.NewReader(counter)
+
+	for records := 0; ; records++ {
+		offset := counter.count - int64(reader.Buffered())
+
+		change := &laptop.UserRating{}
+		err := serializer.ReadDelimitedProtobuf(reader, change)
+		if err == io.EOF {
+			return records, nil
+		}
+
+		broken := errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, serializer.ErrCorruptRecord)
+		if broken && truncateBroken {
+			log.Printf("truncate %s at offset %d after a broken record: %v", name, offset, err)
+			return records, os.Truncate(store.path(name), offset)
+		} else if err != nil {
+			return 0, fmt.Errorf("cannot read %s: %w", name, err)
+		}
+
+		if change.GetRetracted() {
+			store.InMemoryRatingStore.Retract(change.GetLaptopId(), change.GetUsername())
+		} else {
+			// scores logged before they had a time count as given now
+			ratedAt := time.Now()
+			if change.GetRatedAt() != nil {
+				ratedAt = change.GetRatedAt().AsTime()
+			}
+			store.add(change.GetLaptopId(), change.GetUsername(), change.GetScore(), ratedAt)
+		}
+	}
+}
+
+// compact writes the scores of all users to a new snapshot and empties the log
+func (store *FileRatingStore) compact() error {
+	tmpPath := store.path(ratingSnapshotFile + ".tmp")
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("cannot create rating snapshot: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	store.eachScore(func(laptopID string, username string, score timedScore) {
+		if err == nil {
+			err = serializer.WriteDelimitedProtobuf(writer, &laptop.UserRating{
+				LaptopId: laptopID,
+				Username: username,
+				Score:    score.score,
+				RatedAt:  timestamppb.New(score.ratedAt),
+			})
+		}
+	})
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write rating snapshot: %w", err)
+	}
+
+	err = os.Rename(tmpPath, store.path(ratingSnapshotFile))
+	if err != nil {
+		return fmt.Errorf("cannot replace rating snapshot: %w", err)
+	}
+
+	err = syncDir(store.dataDir)
+	if err != nil {
+		return err
+	}
+
+	err = store.logFile.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("cannot truncate rating log: %w", err)
+	}
+
+	store.logSize = 0
+	store.logRecords = 0
+	return nil
+}
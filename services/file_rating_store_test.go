@@ -0,0 +1,109 @@
+package services_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/arcbjorn/store-management-system/sample"
+	"github.com/arcbjorn/store-management-system/serializer"
+	"github.com/arcbjorn/store-management-system/services"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileRatingStoreRecovery(t *testing.T) {
+	t.Parallel()
+
+	dataDir := t.TempDir()
+
+	store, err := services.NewFileRatingStore(dataDir, 3, services.DefaultRatingRanking())
+	require.NoError(t, err)
+
+	laptopID1 := sample.NewLaptop().Id
+	laptopID2 := sample.NewLaptop().Id
+
+	// the third score triggers a snapshot, the following ones stay in the log
+	for i, score := range []float64{6, 8, 10} {
+		_, err := store.Add(laptopID1, fmt.Sprintf("user%d", i), score)
+		require.NoError(t, err)
+	}
+	_, err = store.Add(laptopID2, "user0", 5)
+	require.NoError(t, err)
+	_, err = store.Retract(laptopID1, "user1")
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	require.FileExists(t, filepath.Join(dataDir, "user_ratings.snapshot"))
+
+	store, err = services.NewFileRatingStore(dataDir, 3, services.DefaultRatingRanking())
+	require.NoError(t, err)
+	defer store.Close()
+
+	rating, err := store.Get(laptopID1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), rating.Count)
+	require.Equal(t, 16.0, rating.Sum)
+
+	// a repeated rating replaces the score of the user
+	rating, err = store.Add(laptopID2, "user0", 7)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), rating.Count)
+	require.Equal(t, 7.0, rating.Sum)
+
+	ratings, err := store.List("", 0)
+	require.NoError(t, err)
+	require.Len(t, ratings, 2)
+}
+
+func TestFileRatingStoreLegacyTotals(t *testing.T) {
+	t.Parallel()
+
+	dataDir := t.TempDir()
+
+	// before scores were recorded per user, the files held the totals of every laptop
+	writeTotals := func(name string, totals ...*laptop.Rating) {
+		file, err := os.Create(filepath.Join(dataDir, name))
+		require.NoError(t, err)
+		defer file.Close()
+
+		for _, total := range totals {
+			require.NoError(t, serializer.WriteDelimitedProtobuf(file, total))
+		}
+	}
+	writeTotals("ratings.snapshot",
+		&laptop.Rating{LaptopId: "laptop1", RatedCount: 2, ScoreSum: 10},
+		&laptop.Rating{LaptopId: "laptop2", RatedCount: 1, ScoreSum: 3},
+	)
+	writeTotals("ratings.log", &laptop.Rating{LaptopId: "laptop1", RatedCount: 3, ScoreSum: 18})
+
+	store, err := services.NewFileRatingStore(dataDir, 3, services.DefaultRatingRanking())
+	require.NoError(t, err)
+
+	rating, err := store.Get("laptop1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), rating.Count)
+	require.Equal(t, 18.0, rating.Sum)
+
+	summary, err := store.Summary("laptop1")
+	require.NoError(t, err)
+	require.Equal(t, 6.0, summary.Median, "every legacy score is the average")
+
+	_, err = store.Add("laptop2", "user1", 5)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	require.FileExists(t, filepath.Join(dataDir, "ratings.snapshot.migrated"))
+	require.FileExists(t, filepath.Join(dataDir, "ratings.log.migrated"))
+	require.NoFileExists(t, filepath.Join(dataDir, "ratings.log"))
+
+	store, err = services.NewFileRatingStore(dataDir, 3, services.DefaultRatingRanking())
+	require.NoError(t, err)
+	defer store.Close()
+
+	rating, err = store.Get("laptop2")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), rating.Count)
+	require.Equal(t, 8.0, rating.Sum)
+}
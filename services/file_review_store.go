@@ -0,0 +1,214 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/arcbjorn/store-management-system/serializer"
+)
+
+const (
+	reviewSnapshotFile = "reviews.snapshot"
+	reviewLogFile      = "reviews.log"
+)
+
+// FileReviewStore serves reviews from memory and persists them the same way
+// FileLaptopStore does. Every log record carries the whole review after the
+// change and the users who voted for it, so replaying a record twice is harmless.
+type FileReviewStore struct {
+	*InMemoryReviewStore
+	dataDir          string
+	logFile          *os.File
+	logSize          int64
+	logRecords       int
+	snapshotInterval int
+}
+
+func NewFileReviewStore(dataDir string, snapshotInterval int) (*FileReviewStore, error) {
+	if snapshotInterval <= 0 {
+		return nil, fmt.Errorf("snapshot interval must be positive: %d", snapshotInterval)
+	}
+
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create data directory: %w", err)
+	}
+
+	store := &FileReviewStore{
+		InMemoryReviewStore: NewInMemoryReviewStore(),
+		dataDir:             dataDir,
+		snapshotInterval:    snapshotInterval,
+	}
+
+	_, err = store.load(reviewSnapshotFile, false)
+	if err != nil {
+		return nil, err
+	}
+
+	store.logRecords, err = store.load(reviewLogFile, true)
+	if err != nil {
+		return nil, err
+	}
+
+	store.logFile, err = os.OpenFile(store.path(reviewLogFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open review log: %w", err)
+	}
+
+	info, err := store.logFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	store.logSize = info.Size()
+	store.journal = store
+	return store, nil
+}
+
+// Close releases the log file, the store must not be used afterwards
+func (store *FileReviewStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.logFile.Close()
+}
+
+func (store *FileReviewStore) path(name string) string {
+	return filepath.Join(store.dataDir, name)
+}
+
+// load applies the records of a snapshot or log file and returns how many it read.
+// A broken record ends a log, which is truncated right before it.
+func (store *FileReviewStore) load(name string, truncateBroken bool) (int, error) {
+	file, err := os.Open(store.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("cannot open %s: %w", name, err)
+	}
+	defer file.Close()
+
+	counter := &countingReader{reader: file}
+	reader := bufio.NewReader(counter)
+
+	for records := 0; ; records++ {
+		offset := counter.count - int64(reader.Buffered())
+
+		change := &laptop.ReviewRecord{}
+		err := serializer.ReadDelimitedProtobuf(reader, change)
+		if err == io.EOF {
+			return records, nil
+		}
+
+		broken := errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, serializer.ErrCorruptRecord)
+		if broken && truncateBroken {
+			log.Printf("truncate %s at offset %d after a broken record: %v", name, offset, err)
+			return records, os.Truncate(store.path(name), offset)
+		} else if err != nil {
+			return 0, fmt.Errorf("cannot read %s: %w", name, err)
+		}
+
+		store.apply(change)
+	}
+}
+
+func (store *FileReviewStore) record(change *laptop.ReviewRecord) error {
+	err := serializer.WriteDelimitedProtobuf(store.logFile, change)
+	if err == nil {
+		err = store.logFile.Sync()
+	}
+
+	if err != nil {
+		// drop whatever part of the record made it to the file, so later records stay readable
+		store.logFile.Truncate(store.logSize)
+		return fmt.Errorf("cannot write review log: %w", err)
+	}
+
+	info, err := store.logFile.Stat()
+	if err != nil {
+		return err
+	}
+	store.logSize = info.Size()
+
+	return nil
+}
+
+func (store *FileReviewStore) committed() {
+	store.logRecords++
+	if store.logRecords < store.snapshotInterval {
+		return
+	}
+
+	err := store.compact()
+	if err != nil {
+		// the log still has every change, so compaction is retried on the next one
+		log.Printf("cannot compact review log: %v", err)
+	}
+}
+
+// compact writes every review with its voters to a new snapshot and empties the log
+func (store *FileReviewStore) compact() error {
+	ids := make([]string, 0, len(store.reviews))
+	for id := range store.reviews {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	tmpPath := store.path(reviewSnapshotFile + ".tmp")
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("cannot create review snapshot: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, id := range ids {
+		change := &laptop.ReviewRecord{Review: store.reviews[id]}
+		for username := range store.voters[id] {
+			change.Voters = append(change.Voters, username)
+		}
+		sort.Strings(change.Voters)
+
+		err = serializer.WriteDelimitedProtobuf(writer, change)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write review snapshot: %w", err)
+	}
+
+	err = os.Rename(tmpPath, store.path(reviewSnapshotFile))
+	if err != nil {
+		return fmt.Errorf("cannot replace review snapshot: %w", err)
+	}
+
+	err = syncDir(store.dataDir)
+	if err != nil {
+		return err
+	}
+
+	err = store.logFile.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("cannot truncate review log: %w", err)
+	}
+
+	store.logSize = 0
+	store.logRecords = 0
+	return nil
+}
@@ -0,0 +1,60 @@
+package services_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/arcbjorn/store-management-system/sample"
+	"github.com/arcbjorn/store-management-system/services"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileReviewStoreRecovery(t *testing.T) {
+	t.Parallel()
+
+	dataDir := t.TempDir()
+
+	store, err := services.NewFileReviewStore(dataDir, 3)
+	require.NoError(t, err)
+
+	laptopID := sample.NewLaptop().Id
+
+	// the third change triggers a snapshot, the following ones stay in the log
+	first, err := store.Save(&laptop.Review{LaptopId: laptopID, Author: "user1", Title: "good"})
+	require.NoError(t, err)
+	_, err = store.Vote(first.GetId(), "user2")
+	require.NoError(t, err)
+	second, err := store.Save(&laptop.Review{LaptopId: laptopID, Author: "user2", Title: "fine"})
+	require.NoError(t, err)
+	_, err = store.Save(&laptop.Review{LaptopId: laptopID, Author: "user1", Title: "great"})
+	require.NoError(t, err)
+	_, err = store.SetHidden(second.GetId(), true)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	require.FileExists(t, filepath.Join(dataDir, "reviews.snapshot"))
+
+	store, err = services.NewFileReviewStore(dataDir, 3)
+	require.NoError(t, err)
+	defer store.Close()
+
+	found, err := store.Find(first.GetId())
+	require.NoError(t, err)
+	require.Equal(t, "great", found.GetTitle())
+	require.Equal(t, uint32(1), found.GetHelpfulVotes())
+
+	// the voters are kept along with the count
+	_, err = store.Vote(first.GetId(), "user2")
+	require.ErrorIs(t, err, services.ErrAlreadyExists)
+
+	reviews, err := store.List(laptopID, laptop.ListReviewsRequest_NEWEST, false, nil, 0)
+	require.NoError(t, err)
+	require.Len(t, reviews, 1)
+
+	// a second review of the same author still edits the first one
+	edited, err := store.Save(&laptop.Review{LaptopId: laptopID, Author: "user2", Title: "ok"})
+	require.NoError(t, err)
+	require.Equal(t, second.GetId(), edited.GetId())
+	require.True(t, edited.GetHidden())
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrUnsupportedImage is returned when the content of an upload is not an image of a supported type
+var ErrUnsupportedImage = errors.New("unsupported image")
+
+// File extensions of the supported image types, by MIME type
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// http.DetectContentType never looks at more bytes than this
+const sniffLen = 512
+
+// ImageFormat describes the content of an image, as detected from its bytes
+type ImageFormat struct {
+	MimeType string
+	// Type is the file extension the image is stored with
+	Type   string
+	Width  int
+	Height int
+}
+
+// normalizeImageType turns the image type a client declares into the file extension
+// of a supported type, with "" for no type and false for an unsupported one
+func normalizeImageType(imageType string) (string, bool) {
+	imageType = strings.ToLower(strings.TrimPrefix(imageType, "."))
+	switch imageType {
+	case "":
+		return "", true
+	case "jpeg":
+		imageType = "jpg"
+	}
+
+	for _, extension := range imageTypes {
+		if extension == "."+imageType {
+			return extension, true
+		}
+	}
+	return "", false
+}
+
+// imageInspector detects the format of an image while it is being written,
+// without keeping more than its first bytes in memory
+type imageInspector struct {
+	head   []byte
+	pipe   *io.PipeWriter
+	result chan imageConfigResult
+}
+
+type imageConfigResult struct {
+	config image.Config
+	format string
+	err    error
+}
+
+func newImageInspector() *imageInspector {
+	reader, writer := io.Pipe()
+	inspector := &imageInspector{
+		pipe:   writer,
+		result: make(chan imageConfigResult, 1),
+	}
+
+	go func() {
+		config, format, err := decodeImageConfig(reader)
+		// keep reading until the inspector is closed, so writes never block
+		io.Copy(io.Discard, reader)
+		inspector.result <- imageConfigResult{config, format, err}
+	}()
+
+	return inspector
+}
+
+func (inspector *imageInspector) Write(p []byte) (int, error) {
+	if missing := sniffLen - len(inspector.head); missing > 0 {
+		if missing > len(p) {
+			missing = len(p)
+		}
+		inspector.head = append(inspector.head, p[:missing]...)
+	}
+
+	return inspector.pipe.Write(p)
+}
+
+// Close stops the inspection, it can be called more than once
+func (inspector *imageInspector) Close() error {
+	return inspector.pipe.Close()
+}
+
+// Detect closes the inspector and returns the format of everything written to it
+func (inspector *imageInspector) Detect() (*ImageFormat, error) {
+	inspector.Close()
+	result := <-inspector.result
+
+	mimeType := http.DetectContentType(inspector.head)
+	imageType, ok := imageTypes[mimeType]
+	if !ok {
+		return nil, fmt.Errorf("%w: content type is %s", ErrUnsupportedImage, mimeType)
+	}
+
+	if result.err != nil {
+		return nil, fmt.Errorf("%w: cannot decode %s: %v", ErrUnsupportedImage, mimeType, result.err)
+	} else if "image/"+result.format != mimeType {
+		return nil, fmt.Errorf("%w: %s content is decoded as %s", ErrUnsupportedImage, mimeType, result.format)
+	}
+
+	format := &ImageFormat{
+		MimeType: mimeType,
+		Type:     imageType,
+		Width:    result.config.Width,
+		Height:   result.config.Height,
+	}
+	return format, nil
+}
+
+// decodeImageConfig reads the dimensions of an image with the standard image packages,
+// which have no WebP decoder, so the headers of WebP images are parsed here
+func decodeImageConfig(reader io.Reader) (image.Config, string, error) {
+	buffered := bufio.NewReader(reader)
+
+	header, _ := buffered.Peek(12)
+	if len(header) == 12 && string(header[:4]) == "RIFF" && string(header[8:]) == "WEBP" {
+		config, err := decodeWebPConfig(buffered)
+		return config, "webp", err
+	}
+
+	return image.DecodeConfig(buffered)
+}
+
+// decodeWebPConfig reads the canvas size from the first chunk of a WebP image,
+// see https://developers.google.com/speed/webp/docs/riff_container
+func decodeWebPConfig(reader io.Reader) (image.Config, error) {
+	header := make([]byte, 30)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return image.Config{}, fmt.Errorf("cannot read webp header: %w", err)
+	}
+
+	var width, height int
+	chunk := header[20:]
+
+	switch string(header[12:16]) {
+	case "VP8 ":
+		// lossy: a 3 byte frame tag, a start code and two 14 bit dimensions
+		if !bytes.Equal(chunk[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			return image.Config{}, errors.New("invalid webp VP8 start code")
+		}
+		width = int(binary.LittleEndian.Uint16(chunk[6:8]) & 0x3fff)
+		height = int(binary.LittleEndian.Uint16(chunk[8:10]) & 0x3fff)
+	case "VP8L":
+		// lossless: a signature byte and two 14 bit dimensions minus one
+		if chunk[0] != 0x2f {
+			return image.Config{}, errors.New("invalid webp VP8L signature")
+		}
+		bits := binary.LittleEndian.Uint32(chunk[1:5])
+		width = int(bits&0x3fff) + 1
+		height = int(bits>>14&0x3fff) + 1
+	case "VP8X":
+		// extended: flags, 3 reserved bytes and two 24 bit dimensions minus one
+		width = int(uint32(chunk[4])|uint32(chunk[5])<<8|uint32(chunk[6])<<16) + 1
+		height = int(uint32(chunk[7])|uint32(chunk[8])<<8|uint32(chunk[9])<<16) + 1
+	default:
+		return image.Config{}, fmt.Errorf("unknown webp chunk %q", header[12:16])
+	}
+
+	return image.Config{Width: width, Height: height}, nil
+}
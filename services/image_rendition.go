@@ -0,0 +1,143 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// Longest sides of the resized renditions generated for every uploaded image
+var renditionSizes = []int{128, 512}
+
+const renditionJPEGQuality = 85
+
+// Images with more pixels than a large camera photo are kept without renditions,
+// decoding them would take more memory than their size on disk lets on
+const maxRenditionPixels = 6000 * 4000
+
+// ImageRendition is a resized version of an image
+type ImageRendition struct {
+	ImageFormat
+	// MaxSize is the longest side the image was resized to
+	MaxSize int
+	Path    string
+	Size    int64
+}
+
+// renditionContent is an encoded rendition that is not stored yet
+type renditionContent struct {
+	maxSize int
+	format  ImageFormat
+	data    []byte
+}
+
+// generateRenditions decodes an image and resizes it to every rendition size smaller than it.
+// JPEG renditions stay JPEG, PNG and GIF ones are PNG, only the first frame of an animation is kept.
+// The standard library cannot decode WebP, so WebP images have no renditions.
+// The dimensions of the format are checked before decoding, an image with too many pixels is an error.
+func generateRenditions(content io.Reader, format ImageFormat) ([]*renditionContent, error) {
+	if format.MimeType == "image/webp" {
+		return nil, nil
+	} else if int64(format.Width)*int64(format.Height) > maxRenditionPixels {
+		return nil, fmt.Errorf("image of %dx%d pixels is too large to resize", format.Width, format.Height)
+	}
+
+	original, _, err := image.Decode(content)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image: %w", err)
+	}
+
+	renditions := []*renditionContent{}
+	for _, maxSize := range renditionSizes {
+		bounds := original.Bounds()
+		if bounds.Dx() <= maxSize && bounds.Dy() <= maxSize {
+			continue
+		}
+
+		resized := resizeImage(original, maxSize)
+
+		rendition := &renditionContent{
+			maxSize: maxSize,
+			format: ImageFormat{
+				MimeType: "image/png",
+				Type:     ".png",
+				Width:    resized.Bounds().Dx(),
+				Height:   resized.Bounds().Dy(),
+			},
+		}
+
+		var buffer bytes.Buffer
+		if format.MimeType == "image/jpeg" {
+			rendition.format.MimeType = "image/jpeg"
+			rendition.format.Type = ".jpg"
+			err = jpeg.Encode(&buffer, resized, &jpeg.Options{Quality: renditionJPEGQuality})
+		} else {
+			err = png.Encode(&buffer, resized)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode %dpx rendition: %w", maxSize, err)
+		}
+
+		rendition.data = buffer.Bytes()
+		renditions = append(renditions, rendition)
+	}
+
+	return renditions, nil
+}
+
+// resizeImage scales an image down so its longest side is maxSize,
+// every pixel is the average of the pixels of the original it covers.
+// Only the rows of the original covered by one row of the result are converted at a time.
+func resizeImage(original image.Image, maxSize int) *image.RGBA {
+	bounds := original.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+
+	width, height := maxSize, maxSize
+	if srcWidth > srcHeight {
+		height = maxInt(1, srcHeight*maxSize/srcWidth)
+	} else {
+		width = maxInt(1, srcWidth*maxSize/srcHeight)
+	}
+
+	band := image.NewRGBA(image.Rect(0, 0, srcWidth, srcHeight/height+1))
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcHeight/height, maxInt((y+1)*srcHeight/height, y*srcHeight/height+1)
+		draw.Draw(band, image.Rect(0, 0, srcWidth, y1-y0), original, image.Pt(bounds.Min.X, bounds.Min.Y+y0), draw.Src)
+
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcWidth/width, maxInt((x+1)*srcWidth/width, x*srcWidth/width+1)
+
+			var sum [4]int
+			for sy := 0; sy < y1-y0; sy++ {
+				row := band.Pix[sy*band.Stride+x0*4 : sy*band.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+
+			count := (y1 - y0) * (x1 - x0)
+			offset := y*dst.Stride + x*4
+			for i := range sum {
+				dst.Pix[offset+i] = uint8(sum[i] / count)
+			}
+		}
+	}
+
+	return dst
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
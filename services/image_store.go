@@ -1,67 +1,905 @@
 package services
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/arcbjorn/store-management-system/pb/laptop"
 	"github.com/google/uuid"
 )
 
+// ErrUploadInProgress is returned when resuming an upload that is still being written
+var ErrUploadInProgress = errors.New("upload is in progress")
+
+// ErrImageQuotaExceeded is returned when storing an image would use more storage than allowed
+var ErrImageQuotaExceeded = errors.New("image storage quota exceeded")
+
+// ErrInvalidImageOrder is returned when reordering images with other IDs than the images of the laptop
+var ErrInvalidImageOrder = errors.New("image order does not match the images of the laptop")
+
 type ImageStore interface {
-	Save(laptopID string, imageType string, imageData bytes.Buffer) (string, error)
+	// Create starts writing a new image of a laptop, which only becomes visible once it is committed.
+	// The ID of the image identifies the upload until then.
+	Create(laptopID string) (ImageWriter, error)
+	// Resume continues a suspended upload from its offset,
+	// it returns ErrNotFound if there is no such upload, or ErrUploadInProgress
+	Resume(imageID string) (ImageWriter, error)
+	// FindUpload returns nil if there is no upload with the ID, committed images are not uploads anymore
+	FindUpload(imageID string) (*ImageUpload, error)
+	// Find returns nil if there is no image with the ID
+	Find(imageID string) (*ImageInfo, error)
+	// Open returns the content of the rendition of an image with the max size, or of the original for 0.
+	// It returns ErrNotFound if there is no such image or rendition, the caller must close it.
+	Open(imageID string, maxSize int) (io.ReadCloser, error)
+	// AddRendition stores a resized version of an image, it returns ErrNotFound if there is no image with the ID
+	AddRendition(imageID string, maxSize int, format ImageFormat, content []byte) (*ImageRendition, error)
+	// List returns the images of a laptop in gallery order
+	List(laptopID string) ([]*ImageInfo, error)
+	// FindPrimary returns the main image of a laptop, or nil if the laptop has no images
+	FindPrimary(laptopID string) (*ImageInfo, error)
+	// Reorder sets the gallery order of the images of a laptop, which must all be listed exactly once,
+	// otherwise it returns ErrInvalidImageOrder
+	Reorder(laptopID string, imageIDs []string) ([]*ImageInfo, error)
+	// SetPrimary makes an image the main image of its laptop, it returns ErrNotFound if there is no image with the ID
+	SetPrimary(imageID string) (*ImageInfo, error)
+	// Delete returns ErrNotFound if there is no image with the ID
+	Delete(imageID string) error
+}
+
+// ImageWriter receives the content of a new image
+type ImageWriter interface {
+	io.Writer
+	// ID returns the ID of the image being uploaded
+	ID() string
+	// Offset returns the size of the content received so far
+	Offset() int64
+	// Replay writes the content received so far, such as before the upload was resumed
+	Replay(w io.Writer) error
+	// Checksum returns the hex encoded SHA-256 digest of the content written so far
+	Checksum() string
+	// Commit stores the written content as an image of the format, which must be one of
+	// the supported image types, at the end of the gallery of its laptop.
+	// The first image of a laptop becomes its primary image.
+	Commit(format ImageFormat, details ImageDetails) (*ImageInfo, error)
+	// Abort discards the written content, it does nothing once the image is committed
+	Abort() error
+	// Suspend keeps the written content, so the upload can be resumed,
+	// it does nothing once the image is committed or aborted
+	Suspend() error
+}
+
+// ImageDetails describes an image to the people viewing it
+type ImageDetails struct {
+	Caption string
+	AltText string
+}
+
+// ImageUpload is an image that is not completely received yet
+type ImageUpload struct {
+	ID       string
+	LaptopID string
+	// Size is the part of the content which is safely stored, an upload continues from there
+	Size int64
 }
 
+// Received content of an upload is made durable at least this often
+const uploadSyncInterval = 1 << 20
+
+// ImageQuota limits the storage used by the original images, 0 means no limit
+type ImageQuota struct {
+	// PerLaptop is the size of all images of a laptop
+	PerLaptop int64
+	// Total is the size of all distinct image contents
+	Total int64
+}
+
+// DiskImageStore keeps every distinct content once, in a file named after its checksum,
+// which is deleted with its renditions once no image refers to it anymore.
+// Uploads are written to hidden files next to a state file with their durable offset,
+// so they can be resumed after a restart. Every change to the metadata of the images is
+// appended to a hidden log file before it is applied, and the log is compacted into
+// a hidden index file every imageIndexSnapshotInterval changes.
 type DiskImageStore struct {
 	mutex       sync.RWMutex
 	imageFolder string
+	logFile     *os.File
+	logSize     int64
+	logRecords  int
+	quota       ImageQuota
+	// the size of the images by laptop ID, and of all distinct contents
+	laptopUsage map[string]int64
+	blobUsage   int64
 	images      map[string]*ImageInfo
+	blobs       map[string]*diskImageBlob
+	uploading   map[string]bool
+	// the number of commits publishing a content by checksum, Delete keeps the files of these
+	publishing map[string]int
+	// ID of the primary image by laptop ID
+	primary map[string]string
+}
+
+// diskUploadState is the content of the state file of an upload
+type diskUploadState struct {
+	LaptopID string `json:"laptop_id"`
+	Offset   int64  `json:"offset"`
+}
+
+type diskImageBlob struct {
+	path       string
+	size       int64
+	references int
+	renditions []*ImageRendition
 }
 
 type ImageInfo struct {
-	LaptopID string
-	Type     string
-	Path     string
+	ID        string
+	LaptopID  string
+	Type      string
+	MimeType  string
+	Width     int
+	Height    int
+	Path      string
+	Size      int64
+	Checksum  string
+	CreatedAt time.Time
+	// Renditions are ordered by max size
+	Renditions []*ImageRendition
+	ImageDetails
+	// Position orders the images of a laptop, the lowest comes first
+	Position int
+	Primary  bool
 }
 
-func NewDiskImageStore(imageFolder string) *DiskImageStore {
-	return &DiskImageStore{
+func (info *ImageInfo) clone() *ImageInfo {
+	other := *info
+	other.Renditions = append([]*ImageRendition(nil), info.Renditions...)
+	return &other
+}
+
+// ImageFormat returns the format of the original image
+func (info *ImageInfo) ImageFormat() ImageFormat {
+	return ImageFormat{
+		MimeType: info.MimeType,
+		Type:     info.Type,
+		Width:    info.Width,
+		Height:   info.Height,
+	}
+}
+
+// Rendition returns nil if the image has no rendition with the max size
+func (info *ImageInfo) Rendition(maxSize int) *ImageRendition {
+	for _, rendition := range info.Renditions {
+		if rendition.MaxSize == maxSize {
+			return rendition
+		}
+	}
+	return nil
+}
+
+// NewDiskImageStore loads the index of the images in the folder and replays the log on top,
+// creating the folder if needed
+func NewDiskImageStore(imageFolder string) (*DiskImageStore, error) {
+	err := os.MkdirAll(imageFolder, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create image folder: %w", err)
+	}
+
+	store := &DiskImageStore{
 		imageFolder: imageFolder,
+		laptopUsage: make(map[string]int64),
 		images:      make(map[string]*ImageInfo),
+		blobs:       make(map[string]*diskImageBlob),
+		uploading:   make(map[string]bool),
+		publishing:  make(map[string]int),
+		primary:     make(map[string]string),
 	}
+
+	err = store.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.replayLog()
+	if err != nil {
+		return nil, err
+	}
+
+	store.logFile, err = os.OpenFile(store.logPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image log: %w", err)
+	}
+
+	return store, nil
+}
+
+// Close releases the log file, the store must not be used afterwards
+func (store *DiskImageStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.logFile.Close()
+}
+
+// SetQuota limits the storage of the images committed from now on
+func (store *DiskImageStore) SetQuota(quota ImageQuota) error {
+	if quota.PerLaptop < 0 || quota.Total < 0 {
+		return fmt.Errorf("quota cannot be negative: %+v", quota)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.quota = quota
+	return nil
+}
+
+// checkQuota tells whether there is room for a new image, the mutex must be held
+func (store *DiskImageStore) checkQuota(info *ImageInfo) error {
+	err := store.checkLaptopQuota(info.LaptopID, info.Size)
+	if err != nil {
+		return err
+	}
+
+	// a content that is stored already takes no more room
+	if store.quota.Total > 0 && store.blobs[info.Checksum] == nil {
+		if used := store.blobUsage + info.Size; used > store.quota.Total {
+			return fmt.Errorf("%w: images would use %d of %d bytes", ErrImageQuotaExceeded, used, store.quota.Total)
+		}
+	}
+
+	return nil
 }
 
-func (store *DiskImageStore) Save(
-	laptopID string,
-	imageType string,
-	imageData bytes.Buffer,
-) (string, error) {
+// checkLaptopQuota tells whether there is room for a new image of the size among the images of the laptop,
+// the mutex must be held
+func (store *DiskImageStore) checkLaptopQuota(laptopID string, size int64) error {
+	if store.quota.PerLaptop > 0 {
+		if used := store.laptopUsage[laptopID] + size; used > store.quota.PerLaptop {
+			return fmt.Errorf("%w: images of laptop %s would use %d of %d bytes",
+				ErrImageQuotaExceeded, laptopID, used, store.quota.PerLaptop)
+		}
+	}
+
+	return nil
+}
+
+// Create writes the image to a hidden file in the image folder, which is
+// renamed into place on commit, so readers never see a partial image
+func (store *DiskImageStore) Create(laptopID string) (ImageWriter, error) {
 	imageID, err := uuid.NewRandom()
 	if err != nil {
-		return "", fmt.Errorf("cannot generate image id: %w", err)
+		return nil, fmt.Errorf("cannot generate image id: %w", err)
+	}
+
+	writer := &diskImageWriter{
+		store: store,
+		hash:  sha256.New(),
+		info: &ImageInfo{
+			ID:       imageID.String(),
+			LaptopID: laptopID,
+		},
+	}
+
+	writer.file, err = os.OpenFile(store.uploadPath(writer.info.ID), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create image file: %w", err)
+	}
+
+	err = writer.persist()
+	if err != nil {
+		writer.file.Close()
+		os.Remove(writer.file.Name())
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.uploading[writer.info.ID] = true
+	return writer, nil
+}
+
+// Resume drops whatever was written after the durable offset of the upload
+func (store *DiskImageStore) Resume(imageID string) (ImageWriter, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.uploading[imageID] {
+		return nil, ErrUploadInProgress
+	}
+
+	state, err := store.readUploadState(imageID)
+	if err != nil {
+		return nil, err
+	} else if state == nil {
+		return nil, ErrNotFound
+	}
+
+	file, err := os.OpenFile(store.uploadPath(imageID), os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image file: %w", err)
+	}
+
+	writer := &diskImageWriter{
+		store: store,
+		file:  file,
+		hash:  sha256.New(),
+		info: &ImageInfo{
+			ID:       imageID,
+			LaptopID: state.LaptopID,
+			Size:     state.Offset,
+		},
+		synced: state.Offset,
+	}
+
+	err = file.Truncate(state.Offset)
+	if err == nil {
+		_, err = io.Copy(writer.hash, io.NewSectionReader(file, 0, state.Offset))
+	}
+	if err == nil {
+		_, err = file.Seek(state.Offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot resume image file: %w", err)
+	}
+
+	store.uploading[imageID] = true
+	return writer, nil
+}
+
+func (store *DiskImageStore) FindUpload(imageID string) (*ImageUpload, error) {
+	state, err := store.readUploadState(imageID)
+	if err != nil || state == nil {
+		return nil, err
+	}
+
+	upload := &ImageUpload{
+		ID:       imageID,
+		LaptopID: state.LaptopID,
+		Size:     state.Offset,
+	}
+	return upload, nil
+}
+
+// readUploadState returns nil if there is no upload with the ID
+func (store *DiskImageStore) readUploadState(imageID string) (*diskUploadState, error) {
+	if _, err := uuid.Parse(imageID); err != nil {
+		// the ID is part of the file name
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(store.uploadPath(imageID) + ".json")
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read upload state: %w", err)
+	}
+
+	state := &diskUploadState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse upload state: %w", err)
+	}
+
+	return state, nil
+}
+
+func (store *DiskImageStore) uploadPath(imageID string) string {
+	return filepath.Join(store.imageFolder, ".upload-"+imageID)
+}
+
+func (store *DiskImageStore) Find(imageID string) (*ImageInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.find(imageID), nil
+}
+
+// find returns a copy of the image with the renditions of its content
+func (store *DiskImageStore) find(imageID string) *ImageInfo {
+	info := store.images[imageID]
+	if info == nil {
+		return nil
+	}
+
+	other := info.clone()
+	other.Renditions = append(other.Renditions, store.blobs[info.Checksum].renditions...)
+	other.Primary = store.primary[info.LaptopID] == imageID
+	return other
+}
+
+func (store *DiskImageStore) Open(imageID string, maxSize int) (io.ReadCloser, error) {
+	info, err := store.Find(imageID)
+	if err != nil {
+		return nil, err
+	} else if info == nil {
+		return nil, ErrNotFound
+	}
+
+	path := info.Path
+	if maxSize != 0 {
+		rendition := info.Rendition(maxSize)
+		if rendition == nil {
+			return nil, ErrNotFound
+		}
+		path = rendition.Path
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image file: %w", err)
+	}
+
+	return file, nil
+}
+
+// AddRendition writes the rendition next to the original, named after its checksum and max size,
+// so it is shared by all images with the same content
+func (store *DiskImageStore) AddRendition(
+	imageID string,
+	maxSize int,
+	format ImageFormat,
+	content []byte,
+) (*ImageRendition, error) {
+	if imageTypes[format.MimeType] != format.Type {
+		return nil, fmt.Errorf("%w: type %q of %s", ErrUnsupportedImage, format.Type, format.MimeType)
+	}
+
+	store.mutex.RLock()
+	info := store.images[imageID]
+	store.mutex.RUnlock()
+	if info == nil {
+		return nil, ErrNotFound
+	}
+
+	rendition := &ImageRendition{
+		ImageFormat: format,
+		MaxSize:     maxSize,
+		Path:        store.renditionPath(info.Checksum, maxSize, format.Type),
+		Size:        int64(len(content)),
+	}
+
+	// the file is written without the lock, it is only published under it
+	err := writeFileAtomically(rendition.Path, content)
+	if err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	image := store.find(imageID)
+	if image == nil {
+		// deleted meanwhile, along with the renditions it had then
+		store.removeUnreferenced(info.Checksum, rendition.Path)
+		return nil, ErrNotFound
+	}
+	renditions := []*ImageRendition{}
+	for _, other := range image.Renditions {
+		if other.MaxSize != maxSize {
+			renditions = append(renditions, other)
+		}
+	}
+	renditions = append(renditions, rendition)
+	sort.Slice(renditions, func(i, j int) bool {
+		return renditions[i].MaxSize < renditions[j].MaxSize
+	})
+	image.Renditions = renditions
+
+	_, err = store.change(&laptop.ImageIndexRecord{Images: []*laptop.Image{toImageMessage(image)}})
+	if err != nil {
+		return nil, err
 	}
 
-	imagePath := fmt.Sprintf("%s/%s%s", store.imageFolder, imageID, imageType)
+	other := *rendition
+	return &other, nil
+}
+
+func (store *DiskImageStore) List(laptopID string) ([]*ImageInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.list(laptopID), nil
+}
+
+func (store *DiskImageStore) list(laptopID string) []*ImageInfo {
+	images := []*ImageInfo{}
+	for _, info := range store.images {
+		if info.LaptopID == laptopID {
+			images = append(images, store.find(info.ID))
+		}
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Position != images[j].Position {
+			return images[i].Position < images[j].Position
+		}
+		if !images[i].CreatedAt.Equal(images[j].CreatedAt) {
+			return images[i].CreatedAt.Before(images[j].CreatedAt)
+		}
+		return images[i].ID < images[j].ID
+	})
+
+	return images
+}
+
+func (store *DiskImageStore) FindPrimary(laptopID string) (*ImageInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	imageID, ok := store.primary[laptopID]
+	if !ok {
+		return nil, nil
+	}
+	return store.find(imageID), nil
+}
+
+func (store *DiskImageStore) Reorder(laptopID string, imageIDs []string) ([]*ImageInfo, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	images := store.list(laptopID)
+	if len(imageIDs) != len(images) {
+		return nil, ErrInvalidImageOrder
+	}
+
+	positions := make(map[string]int, len(imageIDs))
+	for position, imageID := range imageIDs {
+		info := store.images[imageID]
+		if info == nil || info.LaptopID != laptopID {
+			return nil, ErrInvalidImageOrder
+		} else if _, ok := positions[imageID]; ok {
+			return nil, ErrInvalidImageOrder
+		}
+
+		positions[imageID] = position
+	}
+
+	change := &laptop.ImageIndexRecord{}
+	for _, image := range images {
+		image.Position = positions[image.ID]
+		change.Images = append(change.Images, toImageMessage(image))
+	}
+
+	_, err := store.change(change)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.list(laptopID), nil
+}
+
+func (store *DiskImageStore) SetPrimary(imageID string) (*ImageInfo, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	info := store.find(imageID)
+	if info == nil {
+		return nil, ErrNotFound
+	}
+
+	info.Primary = true
+	_, err := store.change(&laptop.ImageIndexRecord{Images: []*laptop.Image{toImageMessage(info)}})
+	if err != nil {
+		return nil, err
+	}
+
+	return store.find(imageID), nil
+}
+
+func (store *DiskImageStore) Delete(imageID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	info := store.find(imageID)
+	if info == nil {
+		return ErrNotFound
+	}
+
+	change := &laptop.ImageIndexRecord{
+		Images:  []*laptop.Image{toImageMessage(info)},
+		Deleted: true,
+	}
+
+	released, err := store.change(change)
+	if err != nil {
+		return err
+	}
+
+	// readers that opened the files before keep reading them until they close them,
+	// and files that cannot be removed now are swept as orphans
+	paths := []string{}
+	for _, blob := range released {
+		if store.publishing[info.Checksum] > 0 {
+			// a commit of the same content is renaming its file into place
+			continue
+		}
+
+		paths = append(paths, blob.path)
+		for _, rendition := range blob.renditions {
+			paths = append(paths, rendition.Path)
+		}
+	}
+
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot delete image file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// forget removes a deleted image, the first image left in the gallery
+// becomes the primary image of the laptop if it was the primary one
+func (store *DiskImageStore) forget(info *ImageInfo) {
+	delete(store.images, info.ID)
+	if store.primary[info.LaptopID] != info.ID {
+		return
+	}
+
+	delete(store.primary, info.LaptopID)
+	if images := store.list(info.LaptopID); len(images) > 0 {
+		store.primary[info.LaptopID] = images[0].ID
+	}
+}
+
+type diskImageWriter struct {
+	store *DiskImageStore
+	file  *os.File
+	hash  hash.Hash
+	info  *ImageInfo
+	// size of the content at the last persisted offset
+	synced int64
+	done   bool
+}
+
+// Write fails once the images of the laptop would use more than their quota,
+// the total quota is only checked on commit, as the content may be stored already
+func (writer *diskImageWriter) Write(p []byte) (int, error) {
+	writer.store.mutex.RLock()
+	err := writer.store.checkLaptopQuota(writer.info.LaptopID, writer.info.Size+int64(len(p)))
+	writer.store.mutex.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := writer.file.Write(p)
+	writer.hash.Write(p[:n])
+	writer.info.Size += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	if writer.info.Size-writer.synced >= uploadSyncInterval {
+		err = writer.persist()
+	}
+	return n, err
+}
+
+func (writer *diskImageWriter) ID() string {
+	return writer.info.ID
+}
 
-	file, err := os.Create(imagePath)
+func (writer *diskImageWriter) Offset() int64 {
+	return writer.info.Size
+}
+
+func (writer *diskImageWriter) Replay(w io.Writer) error {
+	_, err := io.Copy(w, io.NewSectionReader(writer.file, 0, writer.info.Size))
+	if err != nil {
+		return fmt.Errorf("cannot read image file: %w", err)
+	}
+	return nil
+}
+
+// persist makes the written content durable and records its size as the offset of the upload
+func (writer *diskImageWriter) persist() error {
+	err := writer.file.Sync()
 	if err != nil {
-		return "", fmt.Errorf("cannot create image file: %w", err)
+		return fmt.Errorf("cannot write image file: %w", err)
+	}
+
+	state := &diskUploadState{
+		LaptopID: writer.info.LaptopID,
+		Offset:   writer.info.Size,
 	}
 
-	_, err = imageData.WriteTo(file)
+	data, err := json.Marshal(state)
 	if err != nil {
-		return "", fmt.Errorf("cannot write image to file: %w", err)
+		return fmt.Errorf("cannot encode upload state: %w", err)
+	}
+
+	err = writeFileAtomically(writer.file.Name()+".json", data)
+	if err != nil {
+		return err
+	}
+
+	writer.synced = writer.info.Size
+	return nil
+}
+
+// finish ends the upload, removing its files unless it is suspended
+func (writer *diskImageWriter) finish(keep bool) {
+	writer.done = true
+	writer.file.Close()
+	if !keep {
+		os.Remove(writer.file.Name())
+		os.Remove(writer.file.Name() + ".json")
+	}
+
+	writer.store.mutex.Lock()
+	defer writer.store.mutex.Unlock()
+
+	delete(writer.store.uploading, writer.info.ID)
+}
+
+func (writer *diskImageWriter) Checksum() string {
+	return hex.EncodeToString(writer.hash.Sum(nil))
+}
+
+// Commit renames the written file after its checksum,
+// or drops it if there is a file with the same content already
+func (writer *diskImageWriter) Commit(format ImageFormat, details ImageDetails) (*ImageInfo, error) {
+	if writer.done {
+		return nil, fmt.Errorf("image writer is already closed")
+	}
+
+	// the type ends up in the file name, so only the known extensions are allowed
+	if imageTypes[format.MimeType] != format.Type {
+		return nil, fmt.Errorf("%w: type %q of %s", ErrUnsupportedImage, format.Type, format.MimeType)
+	}
+	writer.done = true
+
+	writer.info.Type = format.Type
+	writer.info.MimeType = format.MimeType
+	writer.info.Width = format.Width
+	writer.info.Height = format.Height
+	writer.info.Checksum = writer.Checksum()
+	writer.info.ImageDetails = details
+	writer.info.Path = filepath.Join(writer.store.imageFolder, writer.info.Checksum+format.Type)
+
+	err := writer.file.Sync()
+	if err == nil {
+		err = writer.file.Close()
+	} else {
+		writer.file.Close()
+	}
+	if err == nil {
+		// without its state the upload cannot be resumed anymore
+		err = os.Remove(writer.file.Name() + ".json")
+	}
+	if err != nil {
+		writer.finish(false)
+		return nil, fmt.Errorf("cannot write image file: %w", err)
+	}
+
+	store := writer.store
+	image := writer.info.clone()
+
+	store.mutex.Lock()
+	delete(store.uploading, image.ID)
+	stored := store.blobs[image.Checksum] != nil
+	store.publishing[image.Checksum]++
+	store.mutex.Unlock()
+
+	// the file is renamed into place without the lock, files with the same content are interchangeable
+	if stored {
+		os.Remove(writer.file.Name())
+	} else {
+		err = os.Rename(writer.file.Name(), image.Path)
+		if err == nil {
+			err = syncDir(store.imageFolder)
+		} else {
+			os.Remove(writer.file.Name())
+		}
 	}
 
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	store.images[imageID.String()] = &ImageInfo{
-		LaptopID: laptopID,
-		Type:     imageType,
-		Path:     imagePath,
+	store.publishing[image.Checksum]--
+	if store.publishing[image.Checksum] == 0 {
+		delete(store.publishing, image.Checksum)
+	}
+
+	if err != nil {
+		store.removeUnreferenced(image.Checksum, image.Path)
+		return nil, fmt.Errorf("cannot rename image file: %w", err)
+	}
+
+	err = store.checkQuota(image)
+	if err != nil {
+		store.removeUnreferenced(image.Checksum, image.Path)
+		return nil, err
+	}
+
+	if blob := store.blobs[image.Checksum]; blob != nil {
+		image.Renditions = blob.renditions
+	}
+
+	image.CreatedAt = time.Now()
+	images := store.list(image.LaptopID)
+	if len(images) > 0 {
+		image.Position = images[len(images)-1].Position + 1
+	} else {
+		image.Primary = true
+	}
+
+	_, err = store.change(&laptop.ImageIndexRecord{Images: []*laptop.Image{toImageMessage(image)}})
+	if err != nil {
+		store.removeUnreferenced(image.Checksum, image.Path)
+		return nil, err
+	}
+
+	return store.find(image.ID), nil
+}
+
+// removeUnreferenced deletes a file of a content unless an image refers to the content,
+// or a commit is publishing it. The mutex must be held.
+func (store *DiskImageStore) removeUnreferenced(checksum string, path string) {
+	if store.blobs[checksum] == nil && store.publishing[checksum] == 0 {
+		os.Remove(path)
+	}
+}
+
+func (writer *diskImageWriter) Abort() error {
+	if writer.done {
+		return nil
+	}
+
+	writer.finish(false)
+	return nil
+}
+
+func (writer *diskImageWriter) Suspend() error {
+	if writer.done {
+		return nil
+	}
+
+	err := writer.persist()
+	writer.finish(true)
+	return err
+}
+
+// writeFileAtomically writes the file next to its path and renames it into place
+func writeFileAtomically(path string, content []byte) error {
+	folder := filepath.Dir(path)
+
+	file, err := os.CreateTemp(folder, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("cannot create image file: %w", err)
+	}
+
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("cannot write image file: %w", err)
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("cannot rename image file: %w", err)
 	}
 
-	return imageID.String(), nil
+	return syncDir(folder)
 }
@@ -0,0 +1,388 @@
+package services_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/arcbjorn/store-management-system/sample"
+	"github.com/arcbjorn/store-management-system/services"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestImageStore(t *testing.T, imageFolder string) *services.DiskImageStore {
+	store, err := services.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// imageFiles returns the names of the files in the image folder, without the index and log of the store
+func imageFiles(t *testing.T, imageFolder string) []string {
+	entries, err := os.ReadDir(imageFolder)
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, entry := range entries {
+		if entry.Name() != ".images.index" && entry.Name() != ".images.log" {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func TestDiskImageStoreWriter(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	store := newTestImageStore(t, imageFolder)
+	laptopID := sample.NewLaptop().Id
+
+	aborted, err := store.Create(laptopID)
+	require.NoError(t, err)
+	_, err = aborted.Write([]byte("partial"))
+	require.NoError(t, err)
+	require.NoError(t, aborted.Abort())
+
+	writer, err := store.Create(laptopID)
+	require.NoError(t, err)
+
+	images, err := store.List(laptopID)
+	require.NoError(t, err)
+	require.Empty(t, images, "an image is not visible before it is committed")
+
+	for _, chunk := range []string{"first ", "second"} {
+		_, err = writer.Write([]byte(chunk))
+		require.NoError(t, err)
+	}
+
+	_, err = writer.Commit(services.ImageFormat{MimeType: "image/jpeg", Type: "/../escape"}, services.ImageDetails{})
+	require.ErrorIs(t, err, services.ErrUnsupportedImage)
+
+	info, err := writer.Commit(services.ImageFormat{MimeType: "image/jpeg", Type: ".jpg"}, services.ImageDetails{})
+	require.NoError(t, err)
+	require.EqualValues(t, 12, info.Size)
+	require.NoError(t, writer.Abort(), "aborting a committed image does nothing")
+
+	// only the committed image is left, without temporary files
+	entries := imageFiles(t, imageFolder)
+	require.Len(t, entries, 1)
+	require.Equal(t, info.Checksum+".jpg", entries[0])
+
+	content, err := store.Open(info.ID, 0)
+	require.NoError(t, err)
+	defer content.Close()
+
+	data, err := io.ReadAll(content)
+	require.NoError(t, err)
+	require.Equal(t, "first second", string(data))
+}
+
+func TestDiskImageStoreRenditions(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	store := newTestImageStore(t, imageFolder)
+
+	writer, err := store.Create(sample.NewLaptop().Id)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("original"))
+	require.NoError(t, err)
+	original := services.ImageFormat{MimeType: "image/png", Type: ".png", Width: 1000, Height: 800}
+	info, err := writer.Commit(original, services.ImageDetails{})
+	require.NoError(t, err)
+
+	format := services.ImageFormat{MimeType: "image/png", Type: ".png", Width: 128, Height: 102}
+	_, err = store.AddRendition("unknown", 128, format, []byte("small"))
+	require.ErrorIs(t, err, services.ErrNotFound)
+
+	rendition, err := store.AddRendition(info.ID, 128, format, []byte("small"))
+	require.NoError(t, err)
+	require.EqualValues(t, 5, rendition.Size)
+
+	found, err := store.Find(info.ID)
+	require.NoError(t, err)
+	require.Equal(t, rendition, found.Rendition(128))
+	require.Nil(t, found.Rendition(512))
+
+	content, err := store.Open(info.ID, 128)
+	require.NoError(t, err)
+	data, err := io.ReadAll(content)
+	require.NoError(t, err)
+	require.NoError(t, content.Close())
+	require.Equal(t, "small", string(data))
+
+	_, err = store.Open(info.ID, 512)
+	require.ErrorIs(t, err, services.ErrNotFound)
+
+	// deleting an image deletes its renditions
+	require.NoError(t, store.Delete(info.ID))
+	entries := imageFiles(t, imageFolder)
+	require.Empty(t, entries)
+}
+
+func TestDiskImageStoreDeduplicatesContent(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	store := newTestImageStore(t, imageFolder)
+	format := services.ImageFormat{MimeType: "image/png", Type: ".png"}
+
+	ids := []string{}
+	for _, laptopID := range []string{sample.NewLaptop().Id, sample.NewLaptop().Id} {
+		writer, err := store.Create(laptopID)
+		require.NoError(t, err)
+		_, err = writer.Write([]byte("same content"))
+		require.NoError(t, err)
+
+		info, err := writer.Commit(format, services.ImageDetails{})
+		require.NoError(t, err)
+		// sha256 of "same content"
+		require.Equal(t, "a636bd7cd42060a4d07fa1bfbcc010eb7794c2ba721e1e3e4c20335a15b66eaf", info.Checksum)
+		ids = append(ids, info.ID)
+	}
+	require.NotEqual(t, ids[0], ids[1])
+
+	entries := imageFiles(t, imageFolder)
+	require.Len(t, entries, 1, "both images share the same file")
+
+	// the file is kept until the last image with its content is deleted
+	require.NoError(t, store.Delete(ids[0]))
+	content, err := store.Open(ids[1], 0)
+	require.NoError(t, err)
+	data, err := io.ReadAll(content)
+	require.NoError(t, err)
+	require.NoError(t, content.Close())
+	require.Equal(t, "same content", string(data))
+
+	require.NoError(t, store.Delete(ids[1]))
+	entries = imageFiles(t, imageFolder)
+	require.Empty(t, entries)
+}
+
+func TestDiskImageStoreResume(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	laptopID := sample.NewLaptop().Id
+
+	writer, err := newTestImageStore(t, imageFolder).Create(laptopID)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("first "))
+	require.NoError(t, err)
+	require.NoError(t, writer.Suspend())
+
+	// the upload survives a restart
+	store := newTestImageStore(t, imageFolder)
+	upload, err := store.FindUpload(writer.ID())
+	require.NoError(t, err)
+	require.Equal(t, &services.ImageUpload{ID: writer.ID(), LaptopID: laptopID, Size: 6}, upload)
+
+	resumed, err := store.Resume(writer.ID())
+	require.NoError(t, err)
+	require.EqualValues(t, 6, resumed.Offset())
+
+	_, err = store.Resume(writer.ID())
+	require.ErrorIs(t, err, services.ErrUploadInProgress)
+
+	var received bytes.Buffer
+	require.NoError(t, resumed.Replay(&received))
+	require.Equal(t, "first ", received.String())
+
+	_, err = resumed.Write([]byte("second"))
+	require.NoError(t, err)
+
+	info, err := resumed.Commit(services.ImageFormat{MimeType: "image/jpeg", Type: ".jpg"}, services.ImageDetails{})
+	require.NoError(t, err)
+	require.Equal(t, writer.ID(), info.ID)
+	require.EqualValues(t, 12, info.Size)
+
+	digest := sha256.Sum256([]byte("first second"))
+	require.Equal(t, hex.EncodeToString(digest[:]), info.Checksum)
+
+	upload, err = store.FindUpload(writer.ID())
+	require.NoError(t, err)
+	require.Nil(t, upload)
+
+	_, err = store.Resume(writer.ID())
+	require.ErrorIs(t, err, services.ErrNotFound)
+
+	entries := imageFiles(t, imageFolder)
+	require.Len(t, entries, 1)
+}
+
+func TestDiskImageStoreIndex(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	store := newTestImageStore(t, imageFolder)
+	laptopID := sample.NewLaptop().Id
+
+	ids := []string{}
+	for _, content := range []string{"first", "second"} {
+		writer, err := store.Create(laptopID)
+		require.NoError(t, err)
+		_, err = writer.Write([]byte(content))
+		require.NoError(t, err)
+
+		details := services.ImageDetails{Caption: content, AltText: "a laptop"}
+		info, err := writer.Commit(services.ImageFormat{MimeType: "image/png", Type: ".png", Width: 800, Height: 600}, details)
+		require.NoError(t, err)
+		ids = append(ids, info.ID)
+	}
+
+	rendition := services.ImageFormat{MimeType: "image/png", Type: ".png", Width: 128, Height: 96}
+	_, err := store.AddRendition(ids[1], 128, rendition, []byte("small"))
+	require.NoError(t, err)
+	_, err = store.SetPrimary(ids[1])
+	require.NoError(t, err)
+	_, err = store.Reorder(laptopID, []string{ids[1], ids[0]})
+	require.NoError(t, err)
+
+	expected, err := store.List(laptopID)
+	require.NoError(t, err)
+
+	// a restarted store finds the same images
+	loaded, err := newTestImageStore(t, imageFolder).List(laptopID)
+	require.NoError(t, err)
+	require.Len(t, loaded, len(expected))
+	for i := range expected {
+		require.True(t, expected[i].CreatedAt.Equal(loaded[i].CreatedAt))
+		loaded[i].CreatedAt = expected[i].CreatedAt
+		require.Equal(t, expected[i], loaded[i])
+	}
+
+	require.True(t, loaded[0].Primary)
+	require.Equal(t, "second", loaded[0].Caption)
+	require.NotNil(t, loaded[0].Rendition(128))
+
+	// simulate a crash in the middle of appending a record
+	logFile, err := os.OpenFile(filepath.Join(imageFolder, ".images.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = logFile.Write([]byte{0x7f, 0x01, 0x02})
+	require.NoError(t, err)
+	require.NoError(t, logFile.Close())
+
+	store = newTestImageStore(t, imageFolder)
+	loaded, err = store.List(laptopID)
+	require.NoError(t, err)
+	require.Len(t, loaded, len(expected))
+
+	// a change that cannot be logged is not applied
+	writer, err := store.Create(laptopID)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("third"))
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	require.Error(t, store.Delete(ids[0]))
+	info, err := store.Find(ids[0])
+	require.NoError(t, err)
+	require.NotNil(t, info)
+
+	_, err = writer.Commit(services.ImageFormat{MimeType: "image/png", Type: ".png"}, services.ImageDetails{})
+	require.Error(t, err)
+	loaded, err = store.List(laptopID)
+	require.NoError(t, err)
+	require.Len(t, loaded, len(expected))
+	require.Len(t, imageFiles(t, imageFolder), 3, "the files of the images and the rendition")
+}
+
+func TestDiskImageStoreConcurrentCommits(t *testing.T) {
+	t.Parallel()
+
+	store := newTestImageStore(t, t.TempDir())
+	laptopID := sample.NewLaptop().Id
+	format := services.ImageFormat{MimeType: "image/png", Type: ".png"}
+	first := saveTestImage(t, store, laptopID, format, []byte("same"))
+
+	// the content stays on disk while commits of it race with the deletion of the image using it
+	var wg sync.WaitGroup
+	errs := make(chan error, 11)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writer, err := store.Create(laptopID)
+			if err == nil {
+				_, err = writer.Write([]byte("same"))
+			}
+			if err == nil {
+				_, err = writer.Commit(format, services.ImageDetails{})
+			}
+			errs <- err
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs <- store.Delete(first)
+	}()
+	wg.Wait()
+
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	images, err := store.List(laptopID)
+	require.NoError(t, err)
+	require.Len(t, images, 10)
+	for _, info := range images {
+		content, err := store.Open(info.ID, 0)
+		require.NoError(t, err)
+		require.NoError(t, content.Close())
+	}
+}
+
+func TestDiskImageStoreQuota(t *testing.T) {
+	t.Parallel()
+
+	store := newTestImageStore(t, t.TempDir())
+	require.Error(t, store.SetQuota(services.ImageQuota{PerLaptop: -1}))
+	require.NoError(t, store.SetQuota(services.ImageQuota{PerLaptop: 10, Total: 15}))
+
+	commit := func(laptopID string, content string) error {
+		writer, err := store.Create(laptopID)
+		require.NoError(t, err)
+		defer writer.Abort()
+
+		_, err = writer.Write([]byte(content))
+		if err != nil {
+			return err
+		}
+		_, err = writer.Commit(services.ImageFormat{MimeType: "image/png", Type: ".png"}, services.ImageDetails{})
+		return err
+	}
+
+	laptopID := sample.NewLaptop().Id
+	require.NoError(t, commit(laptopID, "first!"))
+
+	// the quota of a laptop is checked as the content is received
+	writer, err := store.Create(laptopID)
+	require.NoError(t, err)
+	defer writer.Abort()
+	_, err = writer.Write([]byte("four"))
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("!"))
+	require.ErrorIs(t, err, services.ErrImageQuotaExceeded)
+	require.EqualValues(t, 4, writer.Offset())
+
+	otherID := sample.NewLaptop().Id
+	require.NoError(t, commit(otherID, "second"))
+	require.ErrorIs(t, commit(sample.NewLaptop().Id, "third!"), services.ErrImageQuotaExceeded)
+	require.NoError(t, commit(sample.NewLaptop().Id, "first!"), "stored content takes no more room")
+
+	images, err := store.List(laptopID)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+
+	// deleted images make room again
+	require.NoError(t, store.Delete(images[0].ID))
+	require.NoError(t, commit(laptopID, "second"))
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ImageSweeper removes what the image store keeps for nothing: images of laptops that
+// do not exist anymore, and files in the image folder which the index does not know,
+// such as the leftovers of interrupted uploads. Both are only removed once they have
+// been orphaned for the grace period, so uploads in flight are left alone.
+type ImageSweeper struct {
+	mutex       sync.Mutex
+	imageStore  *DiskImageStore
+	laptopStore LaptopStore
+	gracePeriod time.Duration
+	// when the laptop of an image was first found missing, by image ID
+	orphanedAt map[string]time.Time
+}
+
+func NewImageSweeper(imageStore *DiskImageStore, laptopStore LaptopStore, gracePeriod time.Duration) *ImageSweeper {
+	return &ImageSweeper{
+		imageStore:  imageStore,
+		laptopStore: laptopStore,
+		gracePeriod: gracePeriod,
+		orphanedAt:  make(map[string]time.Time),
+	}
+}
+
+// Run sweeps at every interval until the context is done
+func (sweeper *ImageSweeper) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := sweeper.Sweep()
+			if err != nil {
+				log.Printf("cannot sweep images: %v", err)
+			} else if removed > 0 {
+				log.Printf("swept %d orphaned images and files", removed)
+			}
+		}
+	}
+}
+
+// Sweep returns the number of images and files it removed
+func (sweeper *ImageSweeper) Sweep() (int, error) {
+	sweeper.mutex.Lock()
+	defer sweeper.mutex.Unlock()
+
+	now := time.Now()
+	removed := 0
+	orphanedAt := make(map[string]time.Time)
+
+	for laptopID, imageIDs := range sweeper.imageStore.imagesByLaptop() {
+		lp, err := sweeper.laptopStore.Find(laptopID)
+		if err != nil {
+			return removed, err
+		} else if lp != nil {
+			continue
+		}
+
+		for _, imageID := range imageIDs {
+			since, ok := sweeper.orphanedAt[imageID]
+			if !ok {
+				since = now
+			}
+
+			if now.Sub(since) < sweeper.gracePeriod {
+				orphanedAt[imageID] = since
+				continue
+			}
+
+			err := sweeper.imageStore.Delete(imageID)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return removed, err
+			}
+			removed++
+		}
+	}
+
+	// images that are gone or whose laptop is back are forgotten
+	sweeper.orphanedAt = orphanedAt
+
+	files, err := sweeper.imageStore.removeOrphanFiles(now.Add(-sweeper.gracePeriod))
+	removed += len(files)
+	return removed, err
+}
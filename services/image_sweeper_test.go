@@ -0,0 +1,78 @@
+package services_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arcbjorn/store-management-system/sample"
+	"github.com/arcbjorn/store-management-system/services"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageSweeper(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	imageStore := newTestImageStore(t, imageFolder)
+	laptopStore := services.NewInMemoryLaptopStore()
+
+	lp := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(lp))
+
+	format := services.ImageFormat{MimeType: "image/jpeg", Type: ".jpg"}
+	kept := saveTestImage(t, imageStore, lp.GetId(), format, []byte("kept"))
+	orphan := saveTestImage(t, imageStore, sample.NewLaptop().Id, format, []byte("orphan"))
+
+	old := time.Now().Add(-2 * time.Hour)
+	stray := filepath.Join(imageFolder, "stray.jpg")
+	require.NoError(t, os.WriteFile(stray, []byte("stray"), 0644))
+	require.NoError(t, os.Chtimes(stray, old, old))
+	fresh := filepath.Join(imageFolder, "fresh.jpg")
+	require.NoError(t, os.WriteFile(fresh, []byte("fresh"), 0644))
+
+	abandoned, err := imageStore.Create(lp.GetId())
+	require.NoError(t, err)
+	require.NoError(t, abandoned.Suspend())
+	for _, name := range []string{".upload-" + abandoned.ID(), ".upload-" + abandoned.ID() + ".json"} {
+		require.NoError(t, os.Chtimes(filepath.Join(imageFolder, name), old, old))
+	}
+
+	inProgress, err := imageStore.Create(lp.GetId())
+	require.NoError(t, err)
+	defer inProgress.Abort()
+
+	// the stray file and the abandoned upload are older than the grace period,
+	// the image of the missing laptop is only found orphaned now
+	removed, err := services.NewImageSweeper(imageStore, laptopStore, time.Hour).Sweep()
+	require.NoError(t, err)
+	require.Equal(t, 3, removed)
+	require.NoFileExists(t, stray)
+	require.FileExists(t, fresh)
+
+	info, err := imageStore.Find(orphan)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+
+	upload, err := imageStore.FindUpload(abandoned.ID())
+	require.NoError(t, err)
+	require.Nil(t, upload)
+
+	removed, err = services.NewImageSweeper(imageStore, laptopStore, 0).Sweep()
+	require.NoError(t, err)
+	require.Equal(t, 2, removed, "the orphan image and the fresh file")
+
+	info, err = imageStore.Find(orphan)
+	require.NoError(t, err)
+	require.Nil(t, info)
+
+	info, err = imageStore.Find(kept)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+	require.FileExists(t, info.Path)
+
+	upload, err = imageStore.FindUpload(inProgress.ID())
+	require.NoError(t, err)
+	require.NotNil(t, upload, "uploads in progress are never swept")
+}
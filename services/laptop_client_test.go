@@ -2,13 +2,26 @@ package services_test
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/arcbjorn/store-management-system/pb/laptop"
 	"github.com/arcbjorn/store-management-system/sample"
@@ -16,6 +29,9 @@ import (
 	"github.com/arcbjorn/store-management-system/services"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestClientCreateLaptop(t *testing.T) {
@@ -35,23 +51,242 @@ func TestClientCreateLaptop(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, res)
 	require.Equal(t, expectedID, res.Id)
+	require.Equal(t, uint64(1), res.Revision)
 
 	other, err := laptopStore.Find(res.Id)
 	require.NoError(t, err)
 	require.NotNil(t, res)
 
+	newLaptop.Revision = res.Revision
 	requireSameLaptop(t, newLaptop, other)
 }
 
+func TestClientGetUpdateDeleteLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	lp := sample.NewLaptop()
+	err := laptopStore.Save(lp)
+	require.NoError(t, err)
+
+	getRes, err := laptopClient.GetLaptop(context.Background(), &laptop.GetLaptopRequest{Id: lp.Id})
+	require.NoError(t, err)
+	requireSameLaptop(t, lp, getRes.GetLaptop())
+
+	lp.PriceUsd = 999
+	updateRes, err := laptopClient.UpdateLaptop(context.Background(), &laptop.UpdateLaptopRequest{Laptop: lp})
+	require.NoError(t, err)
+	require.Equal(t, lp.Id, updateRes.GetId())
+
+	other, err := laptopStore.Find(lp.Id)
+	require.NoError(t, err)
+	require.Equal(t, float64(999), other.GetPriceUsd())
+
+	_, err = laptopClient.DeleteLaptop(context.Background(), &laptop.DeleteLaptopRequest{Id: lp.Id})
+	require.NoError(t, err)
+
+	_, err = laptopClient.GetLaptop(context.Background(), &laptop.GetLaptopRequest{Id: lp.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = laptopClient.DeleteLaptop(context.Background(), &laptop.DeleteLaptopRequest{Id: lp.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = laptopClient.UpdateLaptop(context.Background(), &laptop.UpdateLaptopRequest{Laptop: lp})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestClientListLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	expectedIDs := make([]string, 0, 7)
+
+	for i := 0; i < 7; i++ {
+		lp := sample.NewLaptop()
+		err := laptopStore.Save(lp)
+		require.NoError(t, err)
+		expectedIDs = append(expectedIDs, lp.GetId())
+	}
+	sort.Strings(expectedIDs)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	listedIDs := []string{}
+	pageToken := ""
+	for page := 0; ; page++ {
+		req := &laptop.ListLaptopsRequest{PageSize: 3, PageToken: pageToken}
+		res, err := laptopClient.ListLaptops(context.Background(), req)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(res.GetLaptops()), 3)
+
+		for _, lp := range res.GetLaptops() {
+			listedIDs = append(listedIDs, lp.GetId())
+		}
+
+		if page == 0 {
+			// a laptop sorting before the current page must not shift later pages
+			lp := sample.NewLaptop()
+			lp.Id = "00000000-0000-0000-0000-000000000000"
+			require.NoError(t, laptopStore.Save(lp))
+		}
+
+		pageToken = res.GetNextPageToken()
+		if pageToken == "" {
+			break
+		}
+	}
+
+	require.Equal(t, expectedIDs, listedIDs)
+
+	_, err := laptopClient.ListLaptops(context.Background(), &laptop.ListLaptopsRequest{PageToken: "not a token"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestClientReviews(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	lp := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(lp))
+
+	// a review explains the score its author gave
+	ratingStore := services.NewInMemoryRatingStore(services.DefaultRatingRanking())
+	for i, username := range []string{"user1", "user2", "user3", "user4"} {
+		_, err := ratingStore.Add(lp.GetId(), username, float64(6+i))
+		require.NoError(t, err)
+	}
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	submit := func(username string, title string) *laptop.Review {
+		req := &laptop.SubmitReviewRequest{
+			LaptopId: lp.GetId(),
+			Title:    title,
+			Body:     "the battery lasts all day",
+			Pros:     []string{"battery"},
+			Cons:     []string{"weight"},
+		}
+
+		res, err := laptopClient.SubmitReview(testUserContext(t, username), req)
+		require.NoError(t, err)
+		require.Equal(t, username, res.GetReview().GetAuthor())
+		return res.GetReview()
+	}
+
+	first := submit("user1", "good")
+	require.Equal(t, 6.0, first.GetAuthorScore())
+	_, err := ratingStore.Add(lp.GetId(), "user1", 9)
+	require.NoError(t, err)
+	edited := submit("user1", "great")
+	require.Equal(t, 9.0, edited.GetAuthorScore(), "editing a review updates the score of the author")
+	require.Equal(t, first.GetId(), edited.GetId(), "a second review of the same user edits the first one")
+	require.Equal(t, "great", edited.GetTitle())
+	second := submit("user2", "fine")
+	third := submit("user3", "meh")
+
+	_, err = laptopClient.SubmitReview(testUserContext(t, "user4"), &laptop.SubmitReviewRequest{LaptopId: lp.GetId()})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = laptopClient.SubmitReview(testUserContext(t, "user5"), &laptop.SubmitReviewRequest{LaptopId: lp.GetId(), Title: "unrated"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), "a review needs a rating")
+
+	vote := func(username string, reviewID string) error {
+		_, err := laptopClient.VoteReviewHelpful(testUserContext(t, username), &laptop.VoteReviewHelpfulRequest{ReviewId: reviewID})
+		return err
+	}
+
+	require.NoError(t, vote("user2", first.GetId()))
+	require.NoError(t, vote("user3", first.GetId()))
+	require.NoError(t, vote("user1", second.GetId()))
+	require.Equal(t, codes.AlreadyExists, status.Code(vote("user2", first.GetId())))
+	require.Equal(t, codes.FailedPrecondition, status.Code(vote("user1", first.GetId())))
+
+	list := func(ctx context.Context, req *laptop.ListReviewsRequest) []string {
+		ids := []string{}
+		for {
+			res, err := laptopClient.ListReviews(ctx, req)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(res.GetReviews()), int(req.GetPageSize()))
+
+			for _, review := range res.GetReviews() {
+				ids = append(ids, review.GetId())
+			}
+
+			if res.GetNextPageToken() == "" {
+				return ids
+			}
+			req.PageToken = res.GetNextPageToken()
+		}
+	}
+
+	userContext := testUserContext(t, "user1")
+	adminContext := testContextWithRole(t, "admin1", "admin")
+
+	require.Equal(t,
+		[]string{first.GetId(), second.GetId(), third.GetId()},
+		list(userContext, &laptop.ListReviewsRequest{LaptopId: lp.GetId(), SortBy: laptop.ListReviewsRequest_MOST_HELPFUL, PageSize: 2}),
+	)
+	require.Equal(t,
+		[]string{third.GetId(), second.GetId(), first.GetId()},
+		list(userContext, &laptop.ListReviewsRequest{LaptopId: lp.GetId(), SortBy: laptop.ListReviewsRequest_NEWEST, PageSize: 1}),
+	)
+
+	_, err = laptopClient.HideReview(userContext, &laptop.HideReviewRequest{ReviewId: second.GetId()})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	res, err := laptopClient.HideReview(adminContext, &laptop.HideReviewRequest{ReviewId: second.GetId()})
+	require.NoError(t, err)
+	require.True(t, res.GetReview().GetHidden())
+
+	require.Equal(t,
+		[]string{third.GetId(), first.GetId()},
+		list(userContext, &laptop.ListReviewsRequest{LaptopId: lp.GetId(), PageSize: 10}),
+	)
+	require.Len(t, list(adminContext, &laptop.ListReviewsRequest{LaptopId: lp.GetId(), PageSize: 10, IncludeHidden: true}), 3)
+
+	_, err = laptopClient.ListReviews(userContext, &laptop.ListReviewsRequest{LaptopId: lp.GetId(), IncludeHidden: true})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = laptopClient.UnhideReview(adminContext, &laptop.UnhideReviewRequest{ReviewId: second.GetId()})
+	require.NoError(t, err)
+	require.Len(t, list(userContext, &laptop.ListReviewsRequest{LaptopId: lp.GetId(), PageSize: 10}), 3)
+
+	_, err = laptopClient.ListReviews(userContext, &laptop.ListReviewsRequest{LaptopId: sample.NewLaptop().GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
 func startTestLaptopServer(
 	t *testing.T,
 	laptopStore services.LaptopStore,
 	imageStore services.ImageStore,
 	ratingStore services.RatingStore,
 ) string {
-	laptopServer := services.NewLaptopServer(laptopStore, imageStore, ratingStore)
+	laptopServer := services.NewLaptopServer(laptopStore, imageStore, ratingStore, services.NewInMemoryReviewStore())
 
-	grpcServer := grpc.NewServer()
+	// only the RPCs that need to know the user are authorized
+	const laptopServicePath = "/store.management.system.LaptopService/"
+	authInterceptor := services.NewAuthInterceptor(testJWTManager, map[string][]string{
+		laptopServicePath + "RateLaptop":        {"admin", "user"},
+		laptopServicePath + "RetractRating":     {"admin", "user"},
+		laptopServicePath + "SubmitReview":      {"admin", "user"},
+		laptopServicePath + "ListReviews":       {"admin", "user"},
+		laptopServicePath + "VoteReviewHelpful": {"admin", "user"},
+		laptopServicePath + "HideReview":        {"admin"},
+		laptopServicePath + "UnhideReview":      {"admin"},
+		laptopServicePath + "DeleteImage":       {"admin"},
+		laptopServicePath + "ReorderImages":     {"admin"},
+		laptopServicePath + "SetPrimaryImage":   {"admin"},
+	})
+
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(authInterceptor.Unary()),
+		grpc.StreamInterceptor(authInterceptor.Stream()),
+	)
 	laptop.RegisterLaptopServiceServer(grpcServer, laptopServer)
 
 	listener, err := net.Listen("tcp", ":0")
@@ -62,6 +297,23 @@ func startTestLaptopServer(
 	return listener.Addr().String()
 }
 
+var testJWTManager = services.NewJWTManager("test secret", time.Minute)
+
+// testUserContext returns a context that authenticates requests as the user
+func testUserContext(t *testing.T, username string) context.Context {
+	return testContextWithRole(t, username, "user")
+}
+
+func testContextWithRole(t *testing.T, username string, role string) context.Context {
+	user, err := services.NewUser(username, "secret", role)
+	require.NoError(t, err)
+
+	accessToken, err := testJWTManager.Generate(user)
+	require.NoError(t, err)
+
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", accessToken)
+}
+
 func newTestLaptopClient(t *testing.T, serverAddress string) laptop.LaptopServiceClient {
 	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
 	require.NoError(t, err)
@@ -146,13 +398,253 @@ func TestClientSearchLaptop(t *testing.T) {
 	require.Equal(t, len(expectedIDs), found)
 }
 
+func TestClientSearchLaptopSorted(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	ratingStore := services.NewInMemoryRatingStore(services.DefaultRatingRanking())
+
+	prices := []float64{2500, 1500, 3000, 2000}
+	scores := []float64{6, 9, 7, 8}
+	ids := make([]string, len(prices))
+
+	for i := range prices {
+		lp := sample.NewLaptop()
+		lp.PriceUsd = prices[i]
+		ids[i] = lp.GetId()
+
+		err := laptopStore.Save(lp)
+		require.NoError(t, err)
+
+		_, err = ratingStore.Add(lp.GetId(), "user1", scores[i])
+		require.NoError(t, err)
+	}
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	searchIDs := func(req *laptop.SearchLaptopRequest) []string {
+		stream, err := laptopClient.SearchLaptop(context.Background(), req)
+		require.NoError(t, err)
+
+		found := []string{}
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				return found
+			}
+
+			require.NoError(t, err)
+			found = append(found, res.GetLaptop().GetId())
+		}
+	}
+
+	cheapest := searchIDs(&laptop.SearchLaptopRequest{
+		SortBy:     laptop.SearchLaptopRequest_PRICE,
+		MaxResults: 3,
+	})
+	require.Equal(t, []string{ids[1], ids[3], ids[0]}, cheapest)
+
+	bestRated := searchIDs(&laptop.SearchLaptopRequest{
+		SortBy:    laptop.SearchLaptopRequest_AVERAGE_RATING,
+		SortOrder: laptop.SearchLaptopRequest_DESCENDING,
+	})
+	require.Equal(t, []string{ids[1], ids[3], ids[2], ids[0]}, bestRated)
+
+	// many 7s outrank a single 9 once the scores are pulled towards the prior
+	for i := 2; i <= 8; i++ {
+		_, err := ratingStore.Add(ids[2], fmt.Sprintf("user%d", i), 7)
+		require.NoError(t, err)
+	}
+
+	bestRated = searchIDs(&laptop.SearchLaptopRequest{
+		SortBy:    laptop.SearchLaptopRequest_BAYESIAN_RATING,
+		SortOrder: laptop.SearchLaptopRequest_DESCENDING,
+	})
+	require.Equal(t, []string{ids[2], ids[1], ids[3], ids[0]}, bestRated)
+
+	// a laptop without ratings has the prior mean, above one rated with the lowest score
+	unrated := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(unrated))
+	worst := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(worst))
+	_, err := ratingStore.Add(worst.GetId(), "user1", 1)
+	require.NoError(t, err)
+
+	bestRated = searchIDs(&laptop.SearchLaptopRequest{
+		SortBy:    laptop.SearchLaptopRequest_BAYESIAN_RATING,
+		SortOrder: laptop.SearchLaptopRequest_DESCENDING,
+	})
+	require.Equal(t, []string{ids[2], ids[1], ids[3], ids[0], unrated.GetId(), worst.GetId()}, bestRated)
+}
+
+func TestClientSearchFacets(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+
+	brands := []string{"Dell", "Dell", "Lenovo", "Apple"}
+	prices := []float64{900, 1200, 1250, 3500}
+	for i := range brands {
+		lp := sample.NewLaptop()
+		lp.Brand = brands[i]
+		lp.PriceUsd = prices[i]
+		lp.Ram = &laptop.Memory{Value: 16, Unit: laptop.Memory_GIGABYTE}
+		lp.Storages = []*laptop.Storage{sample.NewSSD(), sample.NewSSD()}
+
+		err := laptopStore.Save(lp)
+		require.NoError(t, err)
+	}
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	req := &laptop.SearchFacetsRequest{Filter: &laptop.Filter{MaxPriceUsd: 3000}}
+	res, err := laptopClient.SearchFacets(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), res.GetTotalCount())
+
+	facets := make(map[string]map[string]uint32)
+	for _, facet := range res.GetFacets() {
+		buckets := make(map[string]uint32)
+		for _, bucket := range facet.GetBuckets() {
+			buckets[bucket.GetValue()] = bucket.GetCount()
+		}
+		facets[facet.GetName()] = buckets
+	}
+
+	require.Equal(t, map[string]uint32{"Dell": 2, "Lenovo": 1}, facets["brand"])
+	require.Equal(t, map[string]uint32{"SSD": 3}, facets["storage_driver"])
+	require.Equal(t, uint32(3), facets["ram"]["16 - 32 GB"])
+	require.Equal(t, uint32(1), facets["price_usd"]["under $1000"])
+	require.Equal(t, uint32(2), facets["price_usd"]["$1000 - $1500"])
+	require.Equal(t, uint32(0), facets["price_usd"]["$3000 and above"])
+}
+
+func TestClientWatchLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	filter := &laptop.Filter{MaxPriceUsd: 2000}
+	stream, err := laptopClient.WatchLaptops(ctx, &laptop.WatchLaptopsRequest{Filter: filter})
+	require.NoError(t, err)
+
+	received := make(chan *laptop.LaptopEvent, 16)
+	go func() {
+		defer close(received)
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			received <- res.GetEvent()
+		}
+	}()
+
+	// the watch starts asynchronously, so save probe laptops until one shows up
+	probes := make(map[string]bool)
+	for started := false; !started; {
+		probe := sample.NewLaptop()
+		probe.PriceUsd = 1000
+		probes[probe.Id] = true
+		require.NoError(t, laptopStore.Save(probe))
+
+		select {
+		case <-received:
+			started = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	nextEvent := func() *laptop.LaptopEvent {
+		for event := range received {
+			if !probes[event.GetLaptop().GetId()] {
+				return event
+			}
+		}
+		require.FailNow(t, "watch stream ended")
+		return nil
+	}
+
+	cheap := sample.NewLaptop()
+	cheap.PriceUsd = 1500
+	expensive := sample.NewLaptop()
+	expensive.PriceUsd = 2500
+
+	require.NoError(t, laptopStore.Save(cheap))
+	require.NoError(t, laptopStore.Save(expensive))
+	cheap.PriceUsd = 1600
+	require.NoError(t, laptopStore.Update(cheap))
+	require.NoError(t, laptopStore.Delete(cheap.Id))
+
+	// an update that leaves the filter is sent once, later changes are not
+	moved := sample.NewLaptop()
+	moved.PriceUsd = 1800
+	require.NoError(t, laptopStore.Save(moved))
+	moved.PriceUsd = 2200
+	require.NoError(t, laptopStore.Update(moved))
+	moved.PriceUsd = 2400
+	require.NoError(t, laptopStore.Update(moved))
+	require.NoError(t, laptopStore.Delete(moved.Id))
+
+	expected := []struct {
+		eventType laptop.LaptopEvent_Type
+		laptopID  string
+	}{
+		{laptop.LaptopEvent_CREATED, cheap.Id},
+		{laptop.LaptopEvent_UPDATED, cheap.Id},
+		{laptop.LaptopEvent_DELETED, cheap.Id},
+		{laptop.LaptopEvent_CREATED, moved.Id},
+		{laptop.LaptopEvent_LEFT_FILTER, moved.Id},
+	}
+
+	events := []*laptop.LaptopEvent{}
+	for _, e := range expected {
+		event := nextEvent()
+		require.Equal(t, e.laptopID, event.GetLaptop().GetId())
+		require.Equal(t, e.eventType, event.GetType())
+		events = append(events, event)
+	}
+	require.Equal(t, 1600.0, events[1].GetLaptop().GetPriceUsd())
+	require.Equal(t, 2200.0, events[4].GetLaptop().GetPriceUsd())
+
+	last := sample.NewLaptop()
+	last.PriceUsd = 1000
+	require.NoError(t, laptopStore.Save(last))
+	require.Equal(t, last.Id, nextEvent().GetLaptop().GetId())
+
+	// a reconnecting client continues right after the last event it has seen
+	req := &laptop.WatchLaptopsRequest{Filter: filter, ResumeToken: events[0].GetResumeToken()}
+	resumed, err := laptopClient.WatchLaptops(ctx, req)
+	require.NoError(t, err)
+
+	for _, expected := range events[1:] {
+		res, err := resumed.Recv()
+		require.NoError(t, err)
+		require.Equal(t, expected.GetResumeToken(), res.GetEvent().GetResumeToken())
+	}
+
+	req = &laptop.WatchLaptopsRequest{ResumeToken: "not a token"}
+	invalid, err := laptopClient.WatchLaptops(ctx, req)
+	require.NoError(t, err)
+	_, err = invalid.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
 func TestClientUploadImage(t *testing.T) {
 	t.Parallel()
 
 	testImageFolder := "../tmp"
+	imageFolder := t.TempDir()
 
 	laptopStore := services.NewInMemoryLaptopStore()
-	imageStore := services.NewDiskImageStore(testImageFolder)
+	imageStore := newTestImageStore(t, imageFolder)
 
 	lp := sample.NewLaptop()
 	err := laptopStore.Save(lp)
@@ -210,55 +702,656 @@ func TestClientUploadImage(t *testing.T) {
 	require.NoError(t, err)
 	require.NotZero(t, res.GetId())
 	require.EqualValues(t, size, res.GetSize())
+	require.Equal(t, "image/jpeg", res.GetImage().GetMimeType())
+	require.NotZero(t, res.GetImage().GetWidth())
+	require.NotZero(t, res.GetImage().GetHeight())
 
-	savedImagePath := fmt.Sprintf("%s/%s%s", testImageFolder, res.GetId(), imageType)
+	savedImagePath := fmt.Sprintf("%s/%s%s", imageFolder, res.GetChecksum(), imageType)
 	require.FileExists(t, savedImagePath)
-	require.NoError(t, os.Remove(savedImagePath))
+	// deleting the image also deletes its renditions
+	require.NoError(t, imageStore.Delete(res.GetId()))
+	require.NoFileExists(t, savedImagePath)
 }
 
-func TestClientRateLaptop(t *testing.T) {
+func TestClientUploadImageChecksContent(t *testing.T) {
 	t.Parallel()
 
 	laptopStore := services.NewInMemoryLaptopStore()
-	ratingStore := services.NewInMemoryRatingStore()
+	imageFolder := t.TempDir()
+	imageStore := newTestImageStore(t, imageFolder)
 
 	lp := sample.NewLaptop()
-	err := laptopStore.Save(lp)
+	require.NoError(t, laptopStore.Save(lp))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	var pngContent bytes.Buffer
+	require.NoError(t, png.Encode(&pngContent, image.NewRGBA(image.Rect(0, 0, 40, 30))))
+
+	// a lossless WebP header of a 300x200 image
+	webpContent := []byte("RIFF\x1a\x00\x00\x00WEBPVP8L\x0d\x00\x00\x00\x2f")
+	webpContent = append(webpContent, 0x2b, 0xc1, 0x31, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+
+	testCases := []struct {
+		name      string
+		imageType string
+		content   []byte
+		code      codes.Code
+		mimeType  string
+		width     uint32
+		height    uint32
+	}{
+		{name: "declared type", imageType: ".png", content: pngContent.Bytes(), code: codes.OK, mimeType: "image/png", width: 40, height: 30},
+		{name: "detected type", imageType: "", content: pngContent.Bytes(), code: codes.OK, mimeType: "image/png", width: 40, height: 30},
+		{name: "webp", imageType: "WEBP", content: webpContent, code: codes.OK, mimeType: "image/webp", width: 300, height: 200},
+		{name: "mismatch", imageType: ".jpg", content: pngContent.Bytes(), code: codes.InvalidArgument},
+		{name: "path", imageType: "/../../escape", content: pngContent.Bytes(), code: codes.InvalidArgument},
+		{name: "not an image", imageType: ".png", content: []byte("#!/bin/sh\necho hello\n"), code: codes.InvalidArgument},
+		{name: "truncated", imageType: ".png", content: pngContent.Bytes()[:20], code: codes.InvalidArgument},
+	}
+
+	for _, tc := range testCases {
+		res, err := uploadTestImage(t, laptopClient, lp.GetId(), tc.imageType, tc.content)
+		require.Equal(t, tc.code, status.Code(err), tc.name)
+		if tc.code != codes.OK {
+			continue
+		}
+
+		require.Equal(t, tc.mimeType, res.GetImage().GetMimeType(), tc.name)
+		require.Equal(t, tc.width, res.GetImage().GetWidth(), tc.name)
+		require.Equal(t, tc.height, res.GetImage().GetHeight(), tc.name)
+		require.FileExists(t, filepath.Join(imageFolder, res.GetChecksum()+res.GetImage().GetImageType()), tc.name)
+	}
+
+	images, err := imageStore.List(lp.GetId())
+	require.NoError(t, err)
+	require.Len(t, images, 3)
+}
+
+func TestClientDownloadListDeleteImage(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	imageStore := newTestImageStore(t, t.TempDir())
+
+	lp := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(lp))
+
+	// bigger than one chunk, so the download is split up
+	content, err := os.ReadFile("../tmp/laptop.jpg")
 	require.NoError(t, err)
+	content = bytes.Repeat(content, 3)
 
-	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	imageID := saveTestImage(t, imageStore, lp.GetId(), services.ImageFormat{MimeType: "image/jpeg", Type: ".jpg"}, content)
+	otherID := saveTestImage(t, imageStore, lp.GetId(), services.ImageFormat{MimeType: "image/png", Type: ".png"}, []byte("png"))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
 	laptopClient := newTestLaptopClient(t, serverAddress)
 
-	stream, err := laptopClient.RateLaptop(context.Background())
+	stream, err := laptopClient.DownloadImage(context.Background(), &laptop.DownloadImageRequest{ImageId: imageID})
 	require.NoError(t, err)
 
-	scores := []float64{8, 7.5, 10}
-	avarages := []float64{8, 7.75, 8.5}
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, imageID, res.GetImage().GetId())
+	require.Equal(t, ".jpg", res.GetImage().GetImageType())
+	require.EqualValues(t, len(content), res.GetImage().GetSize())
 
-	n := len(scores)
-	for i := 0; i < n; i++ {
-		req := &laptop.RateLaptopRequest{
-			LaptopId: lp.GetId(),
-			Score:    scores[i],
+	downloaded := []byte{}
+	chunks := 0
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
 		}
 
-		err := stream.Send(req)
 		require.NoError(t, err)
+		downloaded = append(downloaded, res.GetChunkData()...)
+		chunks++
 	}
+	require.Equal(t, content, downloaded)
+	require.Greater(t, chunks, 1)
 
-	err = stream.CloseSend()
+	listRes, err := laptopClient.ListImages(context.Background(), &laptop.ListImagesRequest{LaptopId: lp.GetId()})
 	require.NoError(t, err)
+	require.Len(t, listRes.GetImages(), 2)
+	require.Equal(t, imageID, listRes.GetImages()[0].GetId())
+	require.Equal(t, otherID, listRes.GetImages()[1].GetId())
 
-	for idx := 0; ; idx++ {
-		res, err := stream.Recv()
+	deleteReq := &laptop.DeleteImageRequest{ImageId: imageID}
+	_, err = laptopClient.DeleteImage(testUserContext(t, "user1"), deleteReq)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = laptopClient.DeleteImage(testContextWithRole(t, "admin1", "admin"), deleteReq)
+	require.NoError(t, err)
+
+	stream, err = laptopClient.DownloadImage(context.Background(), &laptop.DownloadImageRequest{ImageId: imageID})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = laptopClient.DeleteImage(testContextWithRole(t, "admin1", "admin"), deleteReq)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestClientImageRenditions(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	imageStore := newTestImageStore(t, t.TempDir())
+
+	lp := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(lp))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	var large bytes.Buffer
+	require.NoError(t, jpeg.Encode(&large, image.NewRGBA(image.Rect(0, 0, 1000, 500)), nil))
+
+	res, err := uploadTestImage(t, laptopClient, lp.GetId(), ".jpg", large.Bytes())
+	require.NoError(t, err)
+
+	renditions := res.GetImage().GetRenditions()
+	require.Len(t, renditions, 2)
+	require.EqualValues(t, 128, renditions[0].GetMaxSize())
+	require.EqualValues(t, 128, renditions[0].GetWidth())
+	require.EqualValues(t, 64, renditions[0].GetHeight())
+	require.EqualValues(t, 512, renditions[1].GetMaxSize())
+	require.EqualValues(t, 256, renditions[1].GetHeight())
+
+	rendition, content := downloadTestImage(t, laptopClient, res.GetId(), laptop.DownloadImageRequest_SMALL)
+	require.EqualValues(t, 128, rendition.GetMaxSize())
+	require.Equal(t, "image/jpeg", rendition.GetMimeType())
+	require.EqualValues(t, len(content), rendition.GetSize())
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, "jpeg", format)
+	require.Equal(t, 128, config.Width)
+	require.Equal(t, 64, config.Height)
+
+	rendition, content = downloadTestImage(t, laptopClient, res.GetId(), laptop.DownloadImageRequest_ORIGINAL)
+	require.Zero(t, rendition.GetMaxSize())
+	require.Equal(t, large.Bytes(), content)
+
+	// an image smaller than a rendition is sent as it is
+	var small bytes.Buffer
+	require.NoError(t, png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 100, 50))))
+
+	res, err = uploadTestImage(t, laptopClient, lp.GetId(), ".png", small.Bytes())
+	require.NoError(t, err)
+	require.Empty(t, res.GetImage().GetRenditions())
+
+	rendition, content = downloadTestImage(t, laptopClient, res.GetId(), laptop.DownloadImageRequest_MEDIUM)
+	require.Zero(t, rendition.GetMaxSize())
+	require.Equal(t, small.Bytes(), content)
+
+	// a small file can declare dimensions that take gigabytes once decoded, it is kept without renditions
+	huge := append([]byte(nil), small.Bytes()...)
+	binary.BigEndian.PutUint32(huge[16:20], 20000)
+	binary.BigEndian.PutUint32(huge[20:24], 20000)
+	binary.BigEndian.PutUint32(huge[29:33], crc32.ChecksumIEEE(huge[12:29]))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	res, err = uploadTestImage(t, laptopClient, lp.GetId(), ".png", huge)
+	runtime.ReadMemStats(&after)
+	require.NoError(t, err)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<30), "the image is not decoded")
+	require.EqualValues(t, 20000, res.GetImage().GetWidth())
+	require.Empty(t, res.GetImage().GetRenditions())
+}
+
+func TestClientUploadImageChecksum(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	imageStore := newTestImageStore(t, t.TempDir())
+
+	lp := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(lp))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	var content bytes.Buffer
+	require.NoError(t, png.Encode(&content, image.NewRGBA(image.Rect(0, 0, 10, 10))))
+	digest := sha256.Sum256(content.Bytes())
+	checksum := hex.EncodeToString(digest[:])
+
+	stream, err := laptopClient.UploadImage(context.Background())
+	require.NoError(t, err)
+
+	info := &laptop.ImageInfo{LaptopId: lp.GetId(), Checksum: checksum}
+	require.NoError(t, stream.Send(&laptop.UploadImageRequest{Data: &laptop.UploadImageRequest_Info{Info: info}}))
+	// one byte is lost on the way
+	corrupted := content.Bytes()[:content.Len()-1]
+	require.NoError(t, stream.Send(&laptop.UploadImageRequest{Data: &laptop.UploadImageRequest_ChunkData{ChunkData: corrupted}}))
+
+	_, err = stream.CloseAndRecv()
+	require.Equal(t, codes.DataLoss, status.Code(err))
+
+	res, err := uploadTestImage(t, laptopClient, lp.GetId(), "", content.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, checksum, res.GetChecksum())
+	require.Equal(t, checksum, res.GetImage().GetChecksum())
+}
+
+func TestClientResumeUploadImage(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	imageStore := newTestImageStore(t, t.TempDir())
+
+	lp := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(lp))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	var content bytes.Buffer
+	require.NoError(t, png.Encode(&content, image.NewRGBA(image.Rect(0, 0, 10, 10))))
+	digest := sha256.Sum256(content.Bytes())
+	info := &laptop.ImageInfo{LaptopId: lp.GetId(), ImageType: ".png", Checksum: hex.EncodeToString(digest[:])}
+
+	// the connection drops after the first half of the image
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := startTestUpload(laptopClient, ctx, info)
+	require.NoError(t, err)
+
+	header, err := stream.Header()
+	require.NoError(t, err)
+	require.Len(t, header.Get("upload-id"), 1)
+	info.UploadId = header.Get("upload-id")[0]
+
+	half := content.Len() / 2
+	require.NoError(t, stream.Send(&laptop.UploadImageRequest{Data: &laptop.UploadImageRequest_ChunkData{ChunkData: content.Bytes()[:half]}}))
+	cancel()
+
+	// the upload is resumable once the server noticed the interruption
+	require.Eventually(t, func() bool {
+		info.Offset = uint64(content.Len())
+		_, err := startTestUpload(laptopClient, context.Background(), info)
+		return status.Code(err) == codes.FailedPrecondition
+	}, 5*time.Second, 10*time.Millisecond)
+
+	query, err := laptopClient.QueryUpload(context.Background(), &laptop.QueryUploadRequest{UploadId: info.UploadId})
+	require.NoError(t, err)
+	require.Equal(t, lp.GetId(), query.GetLaptopId())
+	require.LessOrEqual(t, query.GetSize(), uint64(half))
+	require.Nil(t, query.GetImage())
+
+	info.Offset = query.GetSize()
+	stream, err = startTestUpload(laptopClient, context.Background(), info)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&laptop.UploadImageRequest{Data: &laptop.UploadImageRequest_ChunkData{ChunkData: content.Bytes()[info.Offset:]}}))
+
+	res, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	require.Equal(t, info.UploadId, res.GetId())
+	require.Equal(t, info.GetChecksum(), res.GetChecksum())
+	require.EqualValues(t, content.Len(), res.GetSize())
+
+	query, err = laptopClient.QueryUpload(context.Background(), &laptop.QueryUploadRequest{UploadId: info.UploadId})
+	require.NoError(t, err)
+	require.Equal(t, res.GetId(), query.GetImage().GetId())
+
+	_, err = startTestUpload(laptopClient, context.Background(), info)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestClientImageGallery(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	imageStore := newTestImageStore(t, t.TempDir())
+
+	lp := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(lp))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	format := services.ImageFormat{MimeType: "image/jpeg", Type: ".jpg"}
+	first := saveTestImage(t, imageStore, lp.GetId(), format, []byte("first"))
+	second := saveTestImage(t, imageStore, lp.GetId(), format, []byte("second"))
+
+	// the caption limit counts characters rather than bytes
+	_, err := startTestUpload(laptopClient, context.Background(), &laptop.ImageInfo{LaptopId: lp.GetId(), Caption: strings.Repeat("é", 501)})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	accepted, err := startTestUpload(laptopClient, context.Background(), &laptop.ImageInfo{LaptopId: lp.GetId(), Caption: strings.Repeat("é", 500)})
+	require.NoError(t, err)
+	require.NoError(t, accepted.CloseSend())
+
+	var content bytes.Buffer
+	require.NoError(t, png.Encode(&content, image.NewRGBA(image.Rect(0, 0, 10, 10))))
+	info := &laptop.ImageInfo{LaptopId: lp.GetId(), Caption: "Side view", AltText: "Laptop seen from the left"}
+	stream, err := startTestUpload(laptopClient, context.Background(), info)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&laptop.UploadImageRequest{Data: &laptop.UploadImageRequest_ChunkData{ChunkData: content.Bytes()}}))
+
+	res, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	third := res.GetId()
+	require.Equal(t, "Side view", res.GetImage().GetCaption())
+	require.Equal(t, "Laptop seen from the left", res.GetImage().GetAltText())
+	require.EqualValues(t, 2, res.GetImage().GetPosition())
+	require.False(t, res.GetImage().GetIsPrimary())
+
+	requirePrimaryImage := func(imageID string) {
+		getRes, err := laptopClient.GetLaptop(context.Background(), &laptop.GetLaptopRequest{Id: lp.GetId()})
+		require.NoError(t, err)
+		require.Equal(t, imageID, getRes.GetPrimaryImageId())
+
+		searchStream, err := laptopClient.SearchLaptop(context.Background(), &laptop.SearchLaptopRequest{})
+		require.NoError(t, err)
+		searchRes, err := searchStream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, imageID, searchRes.GetPrimaryImageId())
+	}
+
+	// the first image of a laptop is its primary image until another one is chosen
+	requirePrimaryImage(first)
+
+	adminContext := testContextWithRole(t, "admin1", "admin")
+	_, err = laptopClient.SetPrimaryImage(testUserContext(t, "user1"), &laptop.SetPrimaryImageRequest{ImageId: third})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	primaryRes, err := laptopClient.SetPrimaryImage(adminContext, &laptop.SetPrimaryImageRequest{ImageId: third})
+	require.NoError(t, err)
+	require.True(t, primaryRes.GetImage().GetIsPrimary())
+	requirePrimaryImage(third)
+
+	_, err = laptopClient.SetPrimaryImage(adminContext, &laptop.SetPrimaryImageRequest{ImageId: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	reorderReq := &laptop.ReorderImagesRequest{LaptopId: lp.GetId(), ImageIds: []string{third, second}}
+	_, err = laptopClient.ReorderImages(adminContext, reorderReq)
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "every image must be listed")
+
+	reorderReq.ImageIds = []string{third, first, second}
+	_, err = laptopClient.ReorderImages(testUserContext(t, "user1"), reorderReq)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	reorderRes, err := laptopClient.ReorderImages(adminContext, reorderReq)
+	require.NoError(t, err)
+	require.Len(t, reorderRes.GetImages(), 3)
+
+	listRes, err := laptopClient.ListImages(context.Background(), &laptop.ListImagesRequest{LaptopId: lp.GetId()})
+	require.NoError(t, err)
+	listed := []string{}
+	for _, image := range listRes.GetImages() {
+		listed = append(listed, image.GetId())
+	}
+	require.Equal(t, reorderReq.ImageIds, listed)
+
+	// deleting the primary image makes the first image left the primary one
+	_, err = laptopClient.DeleteImage(adminContext, &laptop.DeleteImageRequest{ImageId: third})
+	require.NoError(t, err)
+	requirePrimaryImage(first)
+}
+
+// startTestUpload sends the image info and waits for the server to accept it
+func startTestUpload(
+	laptopClient laptop.LaptopServiceClient,
+	ctx context.Context,
+	info *laptop.ImageInfo,
+) (laptop.LaptopService_UploadImageClient, error) {
+	stream, err := laptopClient.UploadImage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stream.Send(&laptop.UploadImageRequest{Data: &laptop.UploadImageRequest_Info{Info: info}})
+	if err != nil {
+		_, err = stream.CloseAndRecv()
+		return nil, err
+	}
+
+	// without the header the server ended the stream, and receiving returns its error
+	header, err := stream.Header()
+	if err == nil && len(header.Get("upload-id")) == 0 {
+		_, err = stream.CloseAndRecv()
+	}
+	return stream, err
+}
+
+func TestClientS3ImageStore(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	_, config := newFakeS3(t)
+	imageStore := newTestS3ImageStore(t, config)
+
+	lp := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(lp))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	content, err := os.ReadFile("../tmp/laptop.jpg")
+	require.NoError(t, err)
+
+	res, err := uploadTestImage(t, laptopClient, lp.GetId(), ".jpg", content)
+	require.NoError(t, err)
+	require.True(t, res.GetImage().GetIsPrimary())
+	require.Len(t, res.GetImage().GetRenditions(), 2)
+
+	rendition, downloaded := downloadTestImage(t, laptopClient, res.GetId(), laptop.DownloadImageRequest_MEDIUM)
+	require.EqualValues(t, 512, rendition.GetMaxSize())
+	require.EqualValues(t, len(downloaded), rendition.GetSize())
+
+	_, downloaded = downloadTestImage(t, laptopClient, res.GetId(), laptop.DownloadImageRequest_ORIGINAL)
+	require.Equal(t, content, downloaded)
+
+	getRes, err := laptopClient.GetLaptop(context.Background(), &laptop.GetLaptopRequest{Id: lp.GetId()})
+	require.NoError(t, err)
+	require.Equal(t, res.GetId(), getRes.GetPrimaryImageId())
+}
+
+// uploadTestImage sends the content in a single chunk
+func uploadTestImage(
+	t *testing.T,
+	laptopClient laptop.LaptopServiceClient,
+	laptopID string,
+	imageType string,
+	content []byte,
+) (*laptop.UploadImageResponse, error) {
+	stream, err := laptopClient.UploadImage(context.Background())
+	require.NoError(t, err)
+
+	info := &laptop.ImageInfo{LaptopId: laptopID, ImageType: imageType}
+	require.NoError(t, stream.Send(&laptop.UploadImageRequest{Data: &laptop.UploadImageRequest_Info{Info: info}}))
+	// the stream fails on the first send after the server rejected the upload
+	_ = stream.Send(&laptop.UploadImageRequest{Data: &laptop.UploadImageRequest_ChunkData{ChunkData: content}})
+
+	return stream.CloseAndRecv()
+}
+
+func downloadTestImage(
+	t *testing.T,
+	laptopClient laptop.LaptopServiceClient,
+	imageID string,
+	rendition laptop.DownloadImageRequest_Rendition,
+) (*laptop.ImageRendition, []byte) {
+	req := &laptop.DownloadImageRequest{ImageId: imageID, Rendition: rendition}
+	stream, err := laptopClient.DownloadImage(context.Background(), req)
+	require.NoError(t, err)
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, imageID, res.GetImage().GetId())
+
+	content := []byte{}
+	for {
+		chunk, err := stream.Recv()
 		if err == io.EOF {
-			require.Equal(t, n, idx)
-			return
+			break
 		}
 
 		require.NoError(t, err)
-		require.Equal(t, lp.GetId(), res.GetLaptopId())
-		require.Equal(t, uint32(idx+1), res.GetRatedCount())
-		require.Equal(t, avarages[idx], res.GetAverageScore())
+		content = append(content, chunk.GetChunkData()...)
 	}
+
+	return res.GetRendition(), content
+}
+
+func saveTestImage(
+	t *testing.T,
+	imageStore services.ImageStore,
+	laptopID string,
+	format services.ImageFormat,
+	content []byte,
+) string {
+	writer, err := imageStore.Create(laptopID)
+	require.NoError(t, err)
+
+	_, err = writer.Write(content)
+	require.NoError(t, err)
+
+	info, err := writer.Commit(format, services.ImageDetails{})
+	require.NoError(t, err)
+	return info.ID
+}
+
+func TestClientRateLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	ratingStore := services.NewInMemoryRatingStore(services.DefaultRatingRanking())
+
+	lp := sample.NewLaptop()
+	err := laptopStore.Save(lp)
+	require.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	rate := func(username string, scores []float64, averages []float64) {
+		stream, err := laptopClient.RateLaptop(testUserContext(t, username))
+		require.NoError(t, err)
+
+		n := len(scores)
+		for i := 0; i < n; i++ {
+			req := &laptop.RateLaptopRequest{
+				LaptopId: lp.GetId(),
+				Score:    scores[i],
+			}
+
+			err := stream.Send(req)
+			require.NoError(t, err)
+		}
+
+		err = stream.CloseSend()
+		require.NoError(t, err)
+
+		for idx := 0; ; idx++ {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				require.Equal(t, n, idx)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, lp.GetId(), res.GetLaptopId())
+			require.Equal(t, averages[idx], res.GetAverageScore())
+		}
+	}
+
+	// repeated ratings of a user replace each other instead of adding up
+	rate("user1", []float64{8, 7.5, 10}, []float64{8, 7.5, 10})
+	rate("user2", []float64{7}, []float64{8.5})
+
+	res, err := laptopClient.RetractRating(testUserContext(t, "user1"), &laptop.RetractRatingRequest{LaptopId: lp.GetId()})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), res.GetRating().GetRatedCount())
+	require.Equal(t, 7.0, res.GetRating().GetAverageScore())
+
+	_, err = laptopClient.RetractRating(testUserContext(t, "user1"), &laptop.RetractRatingRequest{LaptopId: lp.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	stream, err := laptopClient.RateLaptop(context.Background())
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	for _, score := range []float64{0, 10.5, math.NaN()} {
+		stream, err := laptopClient.RateLaptop(testUserContext(t, "user1"))
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&laptop.RateLaptopRequest{LaptopId: lp.GetId(), Score: score}))
+		_, err = stream.Recv()
+		require.Equal(t, codes.InvalidArgument, status.Code(err), "score %v", score)
+	}
+}
+
+func TestClientGetRatingSummary(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	ratingStore := services.NewInMemoryRatingStore(services.DefaultRatingRanking())
+
+	lp := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(lp))
+
+	for i, score := range []float64{2, 4, 3.6, 9} {
+		_, err := ratingStore.Add(lp.GetId(), fmt.Sprintf("user%d", i), score)
+		require.NoError(t, err)
+	}
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	res, err := laptopClient.GetRatingSummary(context.Background(), &laptop.GetRatingSummaryRequest{LaptopId: lp.GetId()})
+	require.NoError(t, err)
+
+	summary := res.GetSummary()
+	require.Equal(t, uint32(4), summary.GetRatedCount())
+	require.InDelta(t, 4.65, summary.GetAverageScore(), 1e-9)
+	require.InDelta(t, 3.8, summary.GetMedianScore(), 1e-9)
+	require.InDelta(t, 2.6206, summary.GetStandardDeviation(), 1e-4)
+
+	// a bucket for every whole score from 1 to 10, 3.6 is counted as a 4
+	require.Len(t, summary.GetHistogram(), 10)
+	counts := map[int32]uint32{}
+	for _, bucket := range summary.GetHistogram() {
+		counts[bucket.GetScore()] = bucket.GetCount()
+	}
+	require.Equal(t, uint32(1), counts[2])
+	require.Equal(t, uint32(2), counts[4])
+	require.Equal(t, uint32(1), counts[9])
+	require.Zero(t, counts[1])
+}
+
+func TestClientGetRating(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := services.NewInMemoryLaptopStore()
+	ratingStore := services.NewInMemoryRatingStore(services.DefaultRatingRanking())
+
+	lp := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(lp))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	req := &laptop.GetRatingRequest{LaptopId: lp.GetId()}
+	res, err := laptopClient.GetRating(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, lp.GetId(), res.GetRating().GetLaptopId())
+	require.Zero(t, res.GetRating().GetRatedCount())
+
+	_, err = ratingStore.Add(lp.GetId(), "user1", 8)
+	require.NoError(t, err)
+	_, err = ratingStore.Add(lp.GetId(), "user2", 9)
+	require.NoError(t, err)
+
+	res, err = laptopClient.GetRating(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), res.GetRating().GetRatedCount())
+	require.Equal(t, 8.5, res.GetRating().GetAverageScore())
+
+	_, err = laptopClient.GetRating(context.Background(), &laptop.GetRatingRequest{LaptopId: sample.NewLaptop().GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
 }
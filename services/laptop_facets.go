@@ -0,0 +1,124 @@
+package services
+
+import (
+	"sort"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+)
+
+// FacetCounts holds the number of laptops matching a search and how they
+// spread over the buckets of every facet
+type FacetCounts struct {
+	Total  uint32
+	Facets []*laptop.Facet
+}
+
+type facetRange struct {
+	label string
+	min   float64
+	max   float64
+}
+
+var priceRanges = []facetRange{
+	{"under $1000", 0, 1000},
+	{"$1000 - $1500", 1000, 1500},
+	{"$1500 - $2000", 1500, 2000},
+	{"$2000 - $2500", 2000, 2500},
+	{"$2500 - $3000", 2500, 3000},
+	{"$3000 and above", 3000, 0},
+}
+
+// RAM tiers are in gigabytes
+var ramRanges = []facetRange{
+	{"under 8 GB", 0, 8},
+	{"8 - 16 GB", 8, 16},
+	{"16 - 32 GB", 16, 32},
+	{"32 - 64 GB", 32, 64},
+	{"64 GB and above", 64, 0},
+}
+
+const bitsPerGigabyte = 1 << 33
+
+// countFacets buckets the laptops by brand, CPU brand, RAM tier, storage
+// driver, screen panel and price range
+func countFacets(laptops []*laptop.Laptop) *FacetCounts {
+	brands := make(map[string]uint32)
+	cpuBrands := make(map[string]uint32)
+	drivers := make(map[string]uint32)
+	panels := make(map[string]uint32)
+	ram := make([]uint32, len(ramRanges))
+	prices := make([]uint32, len(priceRanges))
+
+	for _, lp := range laptops {
+		brands[lp.GetBrand()]++
+		cpuBrands[lp.GetCpu().GetBrand()]++
+		panels[lp.GetScreen().GetPanel().String()]++
+
+		// a laptop with both an SSD and an HDD counts once for each driver
+		seen := make(map[laptop.Storage_Driver]bool)
+		for _, storage := range lp.GetStorages() {
+			if !seen[storage.GetDriver()] {
+				seen[storage.GetDriver()] = true
+				drivers[storage.GetDriver().String()]++
+			}
+		}
+
+		ram[rangeIndex(ramRanges, float64(toBit(lp.GetRam()))/bitsPerGigabyte)]++
+		prices[rangeIndex(priceRanges, lp.GetPriceUsd())]++
+	}
+
+	return &FacetCounts{
+		Total: uint32(len(laptops)),
+		Facets: []*laptop.Facet{
+			valueFacet("brand", brands),
+			valueFacet("cpu_brand", cpuBrands),
+			rangeFacet("ram", ramRanges, ram),
+			valueFacet("storage_driver", drivers),
+			valueFacet("screen_panel", panels),
+			rangeFacet("price_usd", priceRanges, prices),
+		},
+	}
+}
+
+// valueFacet returns a bucket per distinct value, the most common values first
+func valueFacet(name string, counts map[string]uint32) *laptop.Facet {
+	facet := &laptop.Facet{Name: name}
+	for value, count := range counts {
+		facet.Buckets = append(facet.Buckets, &laptop.Facet_Bucket{Value: value, Count: count})
+	}
+
+	sort.Slice(facet.Buckets, func(i, j int) bool {
+		bi, bj := facet.Buckets[i], facet.Buckets[j]
+		if bi.Count != bj.Count {
+			return bi.Count > bj.Count
+		}
+		return bi.Value < bj.Value
+	})
+
+	return facet
+}
+
+// rangeFacet returns every range in order, including the empty ones
+func rangeFacet(name string, ranges []facetRange, counts []uint32) *laptop.Facet {
+	facet := &laptop.Facet{Name: name}
+	for i, r := range ranges {
+		facet.Buckets = append(facet.Buckets, &laptop.Facet_Bucket{
+			Value: r.label,
+			Count: counts[i],
+			Min:   r.min,
+			Max:   r.max,
+		})
+	}
+
+	return facet
+}
+
+func rangeIndex(ranges []facetRange, value float64) int {
+	for i, r := range ranges {
+		if r.max == 0 || value < r.max {
+			return i
+		}
+	}
+
+	return len(ranges) - 1
+}
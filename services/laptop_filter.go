@@ -0,0 +1,205 @@
+package services
+
+import (
+	"math"
+	"strings"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+)
+
+const kilogramsPerPound = 0.45359237
+
+// isQualified reports whether the laptop matches every criterion of the filter.
+// Zero values in the filter mean that the criterion is not set.
+func isQualified(filter *laptop.Filter, laptop *laptop.Laptop) bool {
+	if filter.GetMaxPriceUsd() > 0 && laptop.GetPriceUsd() > filter.GetMaxPriceUsd() {
+		return false
+	}
+
+	if laptop.GetCpu().GetCoreNumber() < filter.GetMinCpuCores() {
+		return false
+	}
+
+	if laptop.GetCpu().GetMinGhz() < filter.GetMinCpuGhz() {
+		return false
+	}
+
+	if toBit(laptop.GetRam()) < toBit(filter.GetMinRam()) {
+		return false
+	}
+
+	if !matchesBrandAndName(filter, laptop) {
+		return false
+	}
+
+	if !matchesReleaseYear(filter, laptop) {
+		return false
+	}
+
+	if !matchesGPU(filter, laptop) {
+		return false
+	}
+
+	if !matchesStorage(filter, laptop) {
+		return false
+	}
+
+	if !matchesScreen(filter, laptop) {
+		return false
+	}
+
+	if !matchesWeight(filter, laptop) {
+		return false
+	}
+
+	return matchesKeyboard(filter, laptop)
+}
+
+func matchesBrandAndName(filter *laptop.Filter, lp *laptop.Laptop) bool {
+	if len(filter.GetBrands()) > 0 {
+		found := false
+		for _, brand := range filter.GetBrands() {
+			if strings.EqualFold(brand, lp.GetBrand()) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	name := strings.ToLower(filter.GetName())
+	return strings.Contains(strings.ToLower(lp.GetName()), name)
+}
+
+func matchesReleaseYear(filter *laptop.Filter, lp *laptop.Laptop) bool {
+	if lp.GetReleaseYear() < filter.GetMinReleaseYear() {
+		return false
+	}
+
+	if filter.GetMaxReleaseYear() > 0 && lp.GetReleaseYear() > filter.GetMaxReleaseYear() {
+		return false
+	}
+
+	return true
+}
+
+func matchesGPU(filter *laptop.Filter, lp *laptop.Laptop) bool {
+	minMemory := toBit(filter.GetMinGpuMemory())
+	if minMemory == 0 {
+		return true
+	}
+
+	for _, gpu := range lp.GetGpus() {
+		if toBit(gpu.GetMemory()) >= minMemory {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesStorage requires a single storage that has both the wanted driver and capacity
+func matchesStorage(filter *laptop.Filter, lp *laptop.Laptop) bool {
+	driver := filter.GetStorageDriver()
+	minCapacity := toBit(filter.GetMinStorage())
+	if driver == laptop.Storage_UNKNOWN && minCapacity == 0 {
+		return true
+	}
+
+	for _, storage := range lp.GetStorages() {
+		if driver != laptop.Storage_UNKNOWN && storage.GetDriver() != driver {
+			continue
+		}
+
+		if toBit(storage.GetMemory()) >= minCapacity {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesScreen(filter *laptop.Filter, lp *laptop.Laptop) bool {
+	screen := lp.GetScreen()
+
+	if screen.GetSizeInch() < filter.GetMinScreenSizeInch() {
+		return false
+	}
+
+	if filter.GetMaxScreenSizeInch() > 0 && screen.GetSizeInch() > filter.GetMaxScreenSizeInch() {
+		return false
+	}
+
+	minResolution := filter.GetMinScreenResolution()
+	if screen.GetResolution().GetWidth() < minResolution.GetWidth() ||
+		screen.GetResolution().GetHeight() < minResolution.GetHeight() {
+		return false
+	}
+
+	panel := filter.GetScreenPanel()
+	return panel == laptop.Screen_UNKNOWN || screen.GetPanel() == panel
+}
+
+func matchesWeight(filter *laptop.Filter, lp *laptop.Laptop) bool {
+	maxWeight := filter.GetMaxWeightKg()
+	if maxWeight == 0 {
+		return true
+	}
+
+	weight, ok := weightInKg(lp)
+	return ok && weight <= maxWeight
+}
+
+func matchesKeyboard(filter *laptop.Filter, lp *laptop.Laptop) bool {
+	keyboard := lp.GetKeyboard()
+
+	layout := filter.GetKeyboardLayout()
+	if layout != laptop.Keyboard_UNKNOWN && keyboard.GetLayout() != layout {
+		return false
+	}
+
+	return !filter.GetBacklitKeyboard() || keyboard.GetBacklit()
+}
+
+// weightInKg returns the laptop weight in kilograms whichever unit it was given in
+func weightInKg(lp *laptop.Laptop) (float64, bool) {
+	switch weight := lp.GetWeight().(type) {
+	case *laptop.Laptop_WeightKg:
+		return weight.WeightKg, true
+	case *laptop.Laptop_WeightLb:
+		return weight.WeightLb * kilogramsPerPound, true
+	default:
+		return 0, false
+	}
+}
+
+// toBit converts the memory to bits, sizes beyond the range of uint64 saturate at its maximum
+func toBit(memory *laptop.Memory) uint64 {
+	var shift uint
+
+	switch memory.GetUnit() {
+	case laptop.Memory_BIT:
+		shift = 0
+	case laptop.Memory_BYTE:
+		shift = 3
+	case laptop.Memory_KILOBYTE:
+		shift = 13
+	case laptop.Memory_MEGABYTE:
+		shift = 23
+	case laptop.Memory_GIGABYTE:
+		shift = 33
+	case laptop.Memory_TERABYTE:
+		shift = 43
+	default:
+		return 0
+	}
+
+	value := memory.GetValue()
+	if value > math.MaxUint64>>shift {
+		return math.MaxUint64
+	}
+	return value << shift
+}
@@ -0,0 +1,554 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Uploads are streamed to disk, so the limit does not depend on the memory of the server
+const maxImageSize = 32 << 20
+
+// Header UploadImage sends the ID of the upload in, which a client resumes an interrupted upload with
+const uploadIDHeader = "upload-id"
+
+const maxImageCaptionLength = 500
+
+// Size of the chunks DownloadImage sends an image in
+const imageChunkSize = 64 << 10
+
+// Max sizes of the renditions a download can request
+var downloadRenditionSizes = map[laptop.DownloadImageRequest_Rendition]int{
+	laptop.DownloadImageRequest_ORIGINAL: 0,
+	laptop.DownloadImageRequest_SMALL:    128,
+	laptop.DownloadImageRequest_MEDIUM:   512,
+}
+
+func (server *LaptopServer) UploadImage(stream laptop.LaptopService_UploadImageServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return logError(status.Errorf(codes.Unknown, "cannot receive image info: %v", err))
+	}
+
+	laptopID := req.GetInfo().GetLaptopId()
+	imageType := req.GetInfo().GetImageType()
+	log.Printf("receive an upload-image request for laptop %s with image type %s", laptopID, imageType)
+
+	// the declared type is only checked against the content, which decides the stored type
+	declaredType, ok := normalizeImageType(imageType)
+	if !ok {
+		return logError(status.Errorf(codes.InvalidArgument, "image type %q is not supported", imageType))
+	}
+
+	caption := req.GetInfo().GetCaption()
+	altText := req.GetInfo().GetAltText()
+	if utf8.RuneCountInString(caption) > maxImageCaptionLength || utf8.RuneCountInString(altText) > maxImageCaptionLength {
+		return logError(status.Errorf(codes.InvalidArgument, "caption and alt text must be at most %d characters", maxImageCaptionLength))
+	}
+
+	writer, err := server.openUpload(req.GetInfo())
+	if err != nil {
+		return logError(err)
+	}
+	// keeps the received content for a resumed upload, does nothing once it is committed or aborted
+	defer writer.Suspend()
+
+	err = stream.SendHeader(metadata.Pairs(uploadIDHeader, writer.ID()))
+	if err != nil {
+		return logError(status.Errorf(codes.Unknown, "cannot send upload id: %v", err))
+	}
+
+	inspector := newImageInspector()
+	defer inspector.Close()
+
+	// the type of a resumed image is detected from its whole content
+	err = writer.Replay(inspector)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot read received data: %v", err))
+	}
+
+	imageSize := writer.Offset()
+
+	for {
+		if err := getContextError(stream.Context()); err != nil {
+			return err
+		}
+
+		req, err := stream.Recv()
+		if err == io.EOF {
+			log.Print("no more data")
+			break
+		}
+
+		if err != nil {
+			return logError(status.Errorf(codes.Unknown, "cannot receive data: %v", err))
+		}
+
+		chunk := req.GetChunkData()
+		size := len(chunk)
+
+		imageSize += int64(size)
+		if imageSize > maxImageSize {
+			writer.Abort()
+			return logError(status.Errorf(codes.InvalidArgument, "image is too large: %d > %d", imageSize, maxImageSize))
+		}
+
+		_, err = writer.Write(chunk)
+		if errors.Is(err, ErrImageQuotaExceeded) {
+			writer.Abort()
+			return logError(status.Errorf(codes.ResourceExhausted, "cannot save image: %v", err))
+		} else if err != nil {
+			return logError(status.Errorf(codes.Internal, "cannot write data: %v", err))
+		}
+
+		inspector.Write(chunk)
+	}
+
+	// a complete upload is not resumed, it is accepted or discarded
+	checksum := writer.Checksum()
+	if expected := req.GetInfo().GetChecksum(); expected != "" && !strings.EqualFold(expected, checksum) {
+		writer.Abort()
+		return logError(status.Errorf(codes.DataLoss, "image checksum %s does not match the expected %s", checksum, expected))
+	}
+
+	format, err := inspector.Detect()
+	if err != nil {
+		writer.Abort()
+		return logError(status.Errorf(codes.InvalidArgument, "cannot accept image: %v", err))
+	} else if declaredType != "" && declaredType != format.Type {
+		writer.Abort()
+		return logError(status.Errorf(codes.InvalidArgument, "image type %q does not match the %s content", imageType, format.MimeType))
+	}
+
+	details := ImageDetails{
+		Caption: req.GetInfo().GetCaption(),
+		AltText: req.GetInfo().GetAltText(),
+	}
+
+	info, err := writer.Commit(*format, details)
+	if errors.Is(err, ErrImageQuotaExceeded) {
+		return logError(status.Errorf(codes.ResourceExhausted, "cannot save image: %v", err))
+	} else if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot save image to the store: %v", err))
+	}
+
+	// images with the same content share their renditions
+	if len(info.Renditions) == 0 {
+		info = server.addRenditions(info)
+	}
+
+	res := &laptop.UploadImageResponse{
+		Id:       info.ID,
+		Size:     uint32(imageSize),
+		Image:    toImageMessage(info),
+		Checksum: info.Checksum,
+	}
+
+	err = stream.SendAndClose(res)
+	if err != nil {
+		return logError(status.Errorf(codes.Unknown, "cannot send response: %v", err))
+	}
+
+	log.Printf("saved image with id: %s, size: %d", info.ID, imageSize)
+	return nil
+}
+
+// openUpload creates the upload of a new image, or resumes the upload the image info refers to
+func (server *LaptopServer) openUpload(info *laptop.ImageInfo) (ImageWriter, error) {
+	laptopID := info.GetLaptopId()
+	uploadID := info.GetUploadId()
+
+	if uploadID != "" {
+		upload, err := server.imageStore.FindUpload(uploadID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot find upload: %v", err)
+		} else if upload == nil {
+			return nil, status.Errorf(codes.NotFound, "upload %s is not found", uploadID)
+		} else if upload.LaptopID != laptopID {
+			return nil, status.Errorf(codes.InvalidArgument, "upload %s is not for laptop %s", uploadID, laptopID)
+		}
+	}
+
+	lp, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	} else if lp == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptop %s does not exist", laptopID)
+	}
+
+	if uploadID == "" {
+		writer, err := server.imageStore.Create(laptopID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot create image in the store: %v", err)
+		}
+		return writer, nil
+	}
+
+	writer, err := server.imageStore.Resume(uploadID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "upload %s is not found", uploadID)
+	} else if errors.Is(err, ErrUploadInProgress) {
+		return nil, status.Errorf(codes.Aborted, "upload %s is still in progress", uploadID)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot resume upload: %v", err)
+	}
+
+	if offset := uint64(writer.Offset()); info.GetOffset() != offset {
+		writer.Suspend()
+		return nil, status.Errorf(codes.FailedPrecondition, "upload %s continues at offset %d, not %d", uploadID, offset, info.GetOffset())
+	}
+
+	log.Printf("resume upload %s at offset %d", uploadID, writer.Offset())
+	return writer, nil
+}
+
+func (server *LaptopServer) ReorderImages(
+	ctx context.Context,
+	req *laptop.ReorderImagesRequest,
+) (*laptop.ReorderImagesResponse, error) {
+	laptopID := req.GetLaptopId()
+	log.Printf("receive a reorder-images request with laptop id: %s", laptopID)
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	images, err := server.imageStore.Reorder(laptopID, req.GetImageIds())
+	if errors.Is(err, ErrInvalidImageOrder) {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot reorder images: %v", err)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot reorder images: %v", err)
+	}
+
+	res := &laptop.ReorderImagesResponse{}
+	for _, info := range images {
+		res.Images = append(res.Images, toImageMessage(info))
+	}
+	return res, nil
+}
+
+func (server *LaptopServer) SetPrimaryImage(
+	ctx context.Context,
+	req *laptop.SetPrimaryImageRequest,
+) (*laptop.SetPrimaryImageResponse, error) {
+	imageID := req.GetImageId()
+	log.Printf("receive a set-primary-image request with id: %s", imageID)
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	info, err := server.imageStore.SetPrimary(imageID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "image %s is not found", imageID)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot set primary image: %v", err)
+	}
+
+	res := &laptop.SetPrimaryImageResponse{
+		Image: toImageMessage(info),
+	}
+	return res, nil
+}
+
+// primaryImageID returns "" if the laptop has no images
+func (server *LaptopServer) primaryImageID(laptopID string) (string, error) {
+	if server.imageStore == nil {
+		return "", nil
+	}
+
+	info, err := server.imageStore.FindPrimary(laptopID)
+	if err != nil || info == nil {
+		return "", err
+	}
+	return info.ID, nil
+}
+
+func (server *LaptopServer) QueryUpload(
+	ctx context.Context,
+	req *laptop.QueryUploadRequest,
+) (*laptop.QueryUploadResponse, error) {
+	uploadID := req.GetUploadId()
+	log.Printf("receive a query-upload request with id: %s", uploadID)
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	upload, err := server.imageStore.FindUpload(uploadID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find upload: %v", err)
+	} else if upload != nil {
+		res := &laptop.QueryUploadResponse{
+			UploadId: upload.ID,
+			LaptopId: upload.LaptopID,
+			Size:     uint64(upload.Size),
+		}
+		return res, nil
+	}
+
+	// the upload may have completed without the client receiving the response
+	info, err := server.imageStore.Find(uploadID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find image: %v", err)
+	} else if info == nil {
+		return nil, status.Errorf(codes.NotFound, "upload %s is not found", uploadID)
+	}
+
+	res := &laptop.QueryUploadResponse{
+		UploadId: info.ID,
+		LaptopId: info.LaptopID,
+		Size:     uint64(info.Size),
+		Image:    toImageMessage(info),
+	}
+	return res, nil
+}
+
+func (server *LaptopServer) DownloadImage(
+	req *laptop.DownloadImageRequest,
+	stream laptop.LaptopService_DownloadImageServer,
+) error {
+	imageID := req.GetImageId()
+	log.Printf("receive a download-image request with id: %s, rendition: %s", imageID, req.GetRendition())
+
+	maxSize, ok := downloadRenditionSizes[req.GetRendition()]
+	if !ok {
+		return logError(status.Errorf(codes.InvalidArgument, "unknown rendition %s", req.GetRendition()))
+	}
+
+	info, err := server.imageStore.Find(imageID)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot find image: %v", err))
+	} else if info == nil {
+		return logError(status.Errorf(codes.NotFound, "image %s is not found", imageID))
+	}
+
+	// images without the rendition are already small enough, or cannot be resized
+	rendition := info.Rendition(maxSize)
+	if rendition == nil {
+		rendition = originalRendition(info)
+	}
+
+	content, err := server.imageStore.Open(imageID, rendition.MaxSize)
+	if errors.Is(err, ErrNotFound) {
+		return logError(status.Errorf(codes.NotFound, "image %s is not found", imageID))
+	} else if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot open image: %v", err))
+	}
+	defer content.Close()
+
+	res := &laptop.DownloadImageResponse{
+		Data: &laptop.DownloadImageResponse_Image{
+			Image: toImageMessage(info),
+		},
+		Rendition: toImageRenditionMessage(rendition),
+	}
+
+	err = stream.Send(res)
+	if err != nil {
+		return logError(status.Errorf(codes.Unknown, "cannot send image metadata: %v", err))
+	}
+
+	buffer := make([]byte, imageChunkSize)
+	for {
+		if err := getContextError(stream.Context()); err != nil {
+			return err
+		}
+
+		n, err := io.ReadFull(content, buffer)
+		if n > 0 {
+			res := &laptop.DownloadImageResponse{
+				Data: &laptop.DownloadImageResponse_ChunkData{
+					ChunkData: buffer[:n],
+				},
+			}
+
+			err := stream.Send(res)
+			if err != nil {
+				return logError(status.Errorf(codes.Unknown, "cannot send chunk: %v", err))
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return logError(status.Errorf(codes.Internal, "cannot read image: %v", err))
+		}
+	}
+
+	log.Printf("sent image with id: %s, size: %d", imageID, rendition.Size)
+	return nil
+}
+
+func (server *LaptopServer) ListImages(
+	ctx context.Context,
+	req *laptop.ListImagesRequest,
+) (*laptop.ListImagesResponse, error) {
+	laptopID := req.GetLaptopId()
+	log.Printf("receive a list-images request with laptop id: %s", laptopID)
+
+	if _, err := uuid.Parse(laptopID); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptop ID is not a valid UUID: %v", err)
+	}
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	images, err := server.imageStore.List(laptopID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list images: %v", err)
+	}
+
+	res := &laptop.ListImagesResponse{}
+	for _, info := range images {
+		res.Images = append(res.Images, toImageMessage(info))
+	}
+	return res, nil
+}
+
+func (server *LaptopServer) DeleteImage(
+	ctx context.Context,
+	req *laptop.DeleteImageRequest,
+) (*laptop.DeleteImageResponse, error) {
+	imageID := req.GetImageId()
+	log.Printf("receive a delete-image request with id: %s", imageID)
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	err := server.imageStore.Delete(imageID)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotFound) {
+			code = codes.NotFound
+		}
+
+		return nil, status.Errorf(code, "cannot delete image: %v", err)
+	}
+
+	log.Printf("deleted image with id: %s", imageID)
+
+	res := &laptop.DeleteImageResponse{
+		Id: imageID,
+	}
+	return res, nil
+}
+
+// addRenditions generates the renditions of a new image, the image is kept without them on failure
+func (server *LaptopServer) addRenditions(info *ImageInfo) *ImageInfo {
+	content, err := server.imageStore.Open(info.ID, 0)
+	if err != nil {
+		log.Printf("cannot open image %s to resize it: %v", info.ID, err)
+		return info
+	}
+	defer content.Close()
+
+	renditions, err := generateRenditions(content, info.ImageFormat())
+	if err != nil {
+		log.Printf("cannot generate renditions of image %s: %v", info.ID, err)
+		return info
+	}
+
+	for _, rendition := range renditions {
+		added, err := server.imageStore.AddRendition(info.ID, rendition.maxSize, rendition.format, rendition.data)
+		if err != nil {
+			log.Printf("cannot save %dpx rendition of image %s: %v", rendition.maxSize, info.ID, err)
+			return info
+		}
+
+		info.Renditions = append(info.Renditions, added)
+	}
+
+	return info
+}
+
+func originalRendition(info *ImageInfo) *ImageRendition {
+	return &ImageRendition{
+		ImageFormat: info.ImageFormat(),
+		Path:        info.Path,
+		Size:        info.Size,
+	}
+}
+
+func toImageMessage(info *ImageInfo) *laptop.Image {
+	renditions := []*laptop.ImageRendition{}
+	for _, rendition := range info.Renditions {
+		renditions = append(renditions, toImageRenditionMessage(rendition))
+	}
+
+	return &laptop.Image{
+		Id:         info.ID,
+		LaptopId:   info.LaptopID,
+		ImageType:  info.Type,
+		Size:       uint64(info.Size),
+		CreatedAt:  timestamppb.New(info.CreatedAt),
+		MimeType:   info.MimeType,
+		Width:      uint32(info.Width),
+		Height:     uint32(info.Height),
+		Renditions: renditions,
+		Checksum:   info.Checksum,
+		Caption:    info.Caption,
+		AltText:    info.AltText,
+		Position:   uint32(info.Position),
+		IsPrimary:  info.Primary,
+	}
+}
+
+func toImageRenditionMessage(rendition *ImageRendition) *laptop.ImageRendition {
+	return &laptop.ImageRendition{
+		MaxSize:   uint32(rendition.MaxSize),
+		ImageType: rendition.Type,
+		MimeType:  rendition.MimeType,
+		Width:     uint32(rendition.Width),
+		Height:    uint32(rendition.Height),
+		Size:      uint64(rendition.Size),
+	}
+}
+
+// toImageInfo converts an image message back, without the paths of the image and its renditions
+func toImageInfo(image *laptop.Image) *ImageInfo {
+	info := &ImageInfo{
+		ID:        image.GetId(),
+		LaptopID:  image.GetLaptopId(),
+		Type:      image.GetImageType(),
+		MimeType:  image.GetMimeType(),
+		Width:     int(image.GetWidth()),
+		Height:    int(image.GetHeight()),
+		Size:      int64(image.GetSize()),
+		Checksum:  image.GetChecksum(),
+		CreatedAt: image.GetCreatedAt().AsTime(),
+		ImageDetails: ImageDetails{
+			Caption: image.GetCaption(),
+			AltText: image.GetAltText(),
+		},
+		Position: int(image.GetPosition()),
+		Primary:  image.GetIsPrimary(),
+	}
+
+	for _, rendition := range image.GetRenditions() {
+		info.Renditions = append(info.Renditions, &ImageRendition{
+			ImageFormat: ImageFormat{
+				MimeType: rendition.GetMimeType(),
+				Type:     rendition.GetImageType(),
+				Width:    int(rendition.GetWidth()),
+				Height:   int(rendition.GetHeight()),
+			},
+			MaxSize: int(rendition.GetMaxSize()),
+			Size:    int64(rendition.GetSize()),
+		})
+	}
+
+	return info
+}
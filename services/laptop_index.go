@@ -0,0 +1,106 @@
+package services
+
+import (
+	"math"
+	"sort"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+)
+
+// laptopIndex keeps laptop IDs sorted by a numeric key, so that range queries
+// only visit the laptops inside the range instead of the whole store.
+type laptopIndex struct {
+	key     func(lp *laptop.Laptop) float64
+	entries []indexEntry
+}
+
+type indexEntry struct {
+	value float64
+	id    string
+}
+
+func newLaptopIndex(key func(lp *laptop.Laptop) float64) *laptopIndex {
+	return &laptopIndex{key: key}
+}
+
+func (index *laptopIndex) insert(lp *laptop.Laptop) {
+	entry := indexEntry{index.key(lp), lp.GetId()}
+	i := index.position(entry)
+
+	index.entries = append(index.entries, indexEntry{})
+	copy(index.entries[i+1:], index.entries[i:])
+	index.entries[i] = entry
+}
+
+func (index *laptopIndex) remove(lp *laptop.Laptop) {
+	entry := indexEntry{index.key(lp), lp.GetId()}
+	i := index.position(entry)
+
+	if i < len(index.entries) && compareValues(index.entries[i].value, entry.value) == 0 && index.entries[i].id == entry.id {
+		index.entries = append(index.entries[:i], index.entries[i+1:]...)
+	}
+}
+
+// position returns where the entry is, or should be inserted, ordered by value then ID
+func (index *laptopIndex) position(entry indexEntry) int {
+	return sort.Search(len(index.entries), func(i int) bool {
+		other := index.entries[i]
+		if c := compareValues(other.value, entry.value); c != 0 {
+			return c > 0
+		}
+		return other.id >= entry.id
+	})
+}
+
+// compareValues orders NaN before every number, so laptops saved before NaN was
+// rejected can still be found and removed
+func compareValues(a float64, b float64) int {
+	switch {
+	case math.IsNaN(a) && math.IsNaN(b):
+		return 0
+	case math.IsNaN(a) || a < b:
+		return -1
+	case math.IsNaN(b) || a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// atLeast returns the entries whose value is greater than or equal to min
+func (index *laptopIndex) atLeast(min float64) []indexEntry {
+	i := sort.Search(len(index.entries), func(i int) bool {
+		return index.entries[i].value >= min
+	})
+	return index.entries[i:]
+}
+
+// atMost returns the entries whose value is less than or equal to max, NaN is not
+func (index *laptopIndex) atMost(max float64) []indexEntry {
+	start := sort.Search(len(index.entries), func(i int) bool {
+		return !math.IsNaN(index.entries[i].value)
+	})
+	i := sort.Search(len(index.entries), func(i int) bool {
+		return index.entries[i].value > max
+	})
+	if i < start {
+		i = start
+	}
+	return index.entries[start:i]
+}
+
+func laptopPrice(lp *laptop.Laptop) float64 {
+	return lp.GetPriceUsd()
+}
+
+func laptopCpuCores(lp *laptop.Laptop) float64 {
+	return float64(lp.GetCpu().GetCoreNumber())
+}
+
+func laptopCpuGhz(lp *laptop.Laptop) float64 {
+	return lp.GetCpu().GetMinGhz()
+}
+
+func laptopRamBits(lp *laptop.Laptop) float64 {
+	return float64(toBit(lp.GetRam()))
+}
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"math"
+	"testing"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLaptopIndexNaN(t *testing.T) {
+	t.Parallel()
+
+	index := newLaptopIndex(laptopPrice)
+	laptops := []*laptop.Laptop{
+		{Id: "a", PriceUsd: 900},
+		{Id: "b", PriceUsd: math.NaN()},
+		{Id: "c", PriceUsd: 100},
+		{Id: "d", PriceUsd: math.NaN()},
+	}
+	for _, lp := range laptops {
+		index.insert(lp)
+	}
+
+	ids := []string{}
+	for _, entry := range index.entries {
+		ids = append(ids, entry.id)
+	}
+	require.Equal(t, []string{"b", "d", "c", "a"}, ids, "NaN sorts first")
+	require.Len(t, index.atMost(1000), 2, "NaN is not at most any price")
+	require.Len(t, index.atLeast(0), 2, "NaN is not at least any price")
+
+	index.remove(laptops[1])
+	index.remove(laptops[3])
+	require.Len(t, index.entries, 2)
+	require.Equal(t, "c", index.entries[0].id)
+	require.Equal(t, "a", index.entries[1].id)
+}
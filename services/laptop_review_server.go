@@ -0,0 +1,315 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	maxReviewTitleLength = 200
+	maxReviewBodyLength  = 10000
+	maxReviewPoints      = 10
+	maxReviewPointLength = 200
+)
+
+func (server *LaptopServer) SubmitReview(
+	ctx context.Context,
+	req *laptop.SubmitReviewRequest,
+) (*laptop.SubmitReviewResponse, error) {
+	laptopID := req.GetLaptopId()
+	log.Printf("receive a submit-review request with laptop id: %s", laptopID)
+
+	claims, ok := UserClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "writing a review requires a signed in user")
+	}
+
+	if _, err := uuid.Parse(laptopID); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptop ID is not a valid UUID: %v", err)
+	}
+
+	err := validateReview(req)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "review is invalid: %v", err)
+	}
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	found, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	} else if found == nil {
+		return nil, status.Errorf(codes.NotFound, "laptop %s is not found", laptopID)
+	}
+
+	if server.ratingStore == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "ratings are not available")
+	}
+
+	// a review explains a rating, so it shows the score the author gave
+	score, err := server.ratingStore.Score(laptopID, claims.Username)
+	if errors.Is(err, ErrNotFound) {
+		return nil, status.Errorf(codes.FailedPrecondition, "laptop %s must be rated before it is reviewed", laptopID)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find rating: %v", err)
+	}
+
+	// a user has one review per laptop, submitting another one edits it
+	review, err := server.reviewStore.Save(&laptop.Review{
+		LaptopId:    laptopID,
+		Author:      claims.Username,
+		Title:       req.GetTitle(),
+		Body:        req.GetBody(),
+		Pros:        req.GetPros(),
+		Cons:        req.GetCons(),
+		AuthorScore: score,
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot save review: %v", err)
+	}
+
+	log.Printf("saved review with id: %s", review.GetId())
+
+	res := &laptop.SubmitReviewResponse{
+		Review: review,
+	}
+	return res, nil
+}
+
+func (server *LaptopServer) ListReviews(
+	ctx context.Context,
+	req *laptop.ListReviewsRequest,
+) (*laptop.ListReviewsResponse, error) {
+	laptopID := req.GetLaptopId()
+	log.Printf("receive a list-reviews request with laptop id: %s, sort by: %v", laptopID, req.GetSortBy())
+
+	if _, err := uuid.Parse(laptopID); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptop ID is not a valid UUID: %v", err)
+	}
+
+	if req.GetIncludeHidden() {
+		claims, ok := UserClaimsFromContext(ctx)
+		if !ok || claims.Role != "admin" {
+			return nil, status.Error(codes.PermissionDenied, "only admins can see hidden reviews")
+		}
+	}
+
+	pageSize := int(req.GetPageSize())
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	} else if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	after, err := decodeReviewPageToken(req.GetPageToken())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "page token is invalid: %v", err)
+	}
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	found, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	} else if found == nil {
+		return nil, status.Errorf(codes.NotFound, "laptop %s is not found", laptopID)
+	}
+
+	// ask for one extra review to find out whether there is a next page
+	reviews, err := server.reviewStore.List(laptopID, req.GetSortBy(), req.GetIncludeHidden(), after, pageSize+1)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list reviews: %v", err)
+	}
+
+	res := &laptop.ListReviewsResponse{}
+	if len(reviews) > pageSize {
+		reviews = reviews[:pageSize]
+		res.NextPageToken = encodeReviewPageToken(reviews[pageSize-1])
+	}
+	res.Reviews = reviews
+
+	return res, nil
+}
+
+func (server *LaptopServer) VoteReviewHelpful(
+	ctx context.Context,
+	req *laptop.VoteReviewHelpfulRequest,
+) (*laptop.VoteReviewHelpfulResponse, error) {
+	reviewID := req.GetReviewId()
+	log.Printf("receive a vote-review-helpful request with review id: %s", reviewID)
+
+	claims, ok := UserClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "voting for a review requires a signed in user")
+	}
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	found, err := server.reviewStore.Find(reviewID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find review: %v", err)
+	} else if found == nil || found.GetHidden() {
+		return nil, status.Errorf(codes.NotFound, "review %s is not found", reviewID)
+	} else if found.GetAuthor() == claims.Username {
+		return nil, status.Error(codes.FailedPrecondition, "authors cannot vote for their own reviews")
+	}
+
+	review, err := server.reviewStore.Vote(reviewID, claims.Username)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrAlreadyExists) {
+			code = codes.AlreadyExists
+		} else if errors.Is(err, ErrNotFound) {
+			code = codes.NotFound
+		}
+
+		return nil, status.Errorf(code, "cannot vote for review: %v", err)
+	}
+
+	res := &laptop.VoteReviewHelpfulResponse{
+		Review: review,
+	}
+	return res, nil
+}
+
+func (server *LaptopServer) HideReview(
+	ctx context.Context,
+	req *laptop.HideReviewRequest,
+) (*laptop.HideReviewResponse, error) {
+	log.Printf("receive a hide-review request with review id: %s", req.GetReviewId())
+
+	review, err := server.setReviewHidden(ctx, req.GetReviewId(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &laptop.HideReviewResponse{
+		Review: review,
+	}
+	return res, nil
+}
+
+func (server *LaptopServer) UnhideReview(
+	ctx context.Context,
+	req *laptop.UnhideReviewRequest,
+) (*laptop.UnhideReviewResponse, error) {
+	log.Printf("receive an unhide-review request with review id: %s", req.GetReviewId())
+
+	review, err := server.setReviewHidden(ctx, req.GetReviewId(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &laptop.UnhideReviewResponse{
+		Review: review,
+	}
+	return res, nil
+}
+
+func (server *LaptopServer) setReviewHidden(ctx context.Context, reviewID string, hidden bool) (*laptop.Review, error) {
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	review, err := server.reviewStore.SetHidden(reviewID, hidden)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotFound) {
+			code = codes.NotFound
+		}
+
+		return nil, status.Errorf(code, "cannot moderate review: %v", err)
+	}
+
+	log.Printf("review %s hidden: %v", reviewID, hidden)
+	return review, nil
+}
+
+func validateReview(req *laptop.SubmitReviewRequest) error {
+	if strings.TrimSpace(req.GetTitle()) == "" {
+		return fmt.Errorf("title is empty")
+	}
+	if utf8.RuneCountInString(req.GetTitle()) > maxReviewTitleLength {
+		return fmt.Errorf("title is longer than %d characters", maxReviewTitleLength)
+	}
+	if utf8.RuneCountInString(req.GetBody()) > maxReviewBodyLength {
+		return fmt.Errorf("body is longer than %d characters", maxReviewBodyLength)
+	}
+
+	for name, points := range map[string][]string{"pros": req.GetPros(), "cons": req.GetCons()} {
+		if len(points) > maxReviewPoints {
+			return fmt.Errorf("there are more than %d %s", maxReviewPoints, name)
+		}
+
+		for _, point := range points {
+			if utf8.RuneCountInString(point) > maxReviewPointLength {
+				return fmt.Errorf("%s are longer than %d characters", name, maxReviewPointLength)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Review page tokens hold the sort keys of the last review on a page, so the
+// next page starts at the right place even if reviews were added in the meantime
+func encodeReviewPageToken(last *laptop.Review) string {
+	token := fmt.Sprintf("%d/%d/%s", last.GetHelpfulVotes(), last.GetCreatedAt().AsTime().UnixNano(), last.GetId())
+	return base64.RawURLEncoding.EncodeToString([]byte(token))
+}
+
+func decodeReviewPageToken(token string) (*laptop.Review, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(string(data), "/")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token has %d parts", len(parts))
+	}
+
+	votes, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := uuid.Parse(parts[2]); err != nil {
+		return nil, err
+	}
+
+	last := &laptop.Review{
+		Id:           parts[2],
+		HelpfulVotes: uint32(votes),
+		CreatedAt:    timestamppb.New(time.Unix(0, createdAt)),
+	}
+	return last, nil
+}
@@ -1,11 +1,14 @@
 package services
 
 import (
-	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math"
+	"time"
 
 	"github.com/arcbjorn/store-management-system/pb/laptop"
 	"github.com/google/uuid"
@@ -13,17 +16,59 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-const maxImageSize = 1 << 20
+// errSearchLimitReached stops a store search once enough laptops were sent
+var errSearchLimitReached = errors.New("search result limit reached")
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+const (
+	defaultMinScore = 1
+	defaultMaxScore = 10
+	// the most whole scores a range can have, each is a bucket of the rating summary histogram
+	maxScoreBuckets = 1000
+)
 
 // Server that provides services for laptop functionality
 type LaptopServer struct {
 	laptopStore LaptopStore
 	imageStore  ImageStore
 	ratingStore RatingStore
+	reviewStore ReviewStore
+	minScore    float64
+	maxScore    float64
 }
 
-func NewLaptopServer(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore) *LaptopServer {
-	return &LaptopServer{laptopStore, imageStore, ratingStore}
+func NewLaptopServer(
+	laptopStore LaptopStore,
+	imageStore ImageStore,
+	ratingStore RatingStore,
+	reviewStore ReviewStore,
+) *LaptopServer {
+	return &LaptopServer{
+		laptopStore: laptopStore,
+		imageStore:  imageStore,
+		ratingStore: ratingStore,
+		reviewStore: reviewStore,
+		minScore:    defaultMinScore,
+		maxScore:    defaultMaxScore,
+	}
+}
+
+// SetScoreRange changes the lowest and highest score RateLaptop accepts,
+// the range can have at most maxScoreBuckets whole scores
+func (server *LaptopServer) SetScoreRange(minScore float64, maxScore float64) error {
+	if math.IsNaN(minScore) || math.IsNaN(maxScore) || minScore >= maxScore {
+		return fmt.Errorf("score range [%v, %v] is empty", minScore, maxScore)
+	} else if math.Round(maxScore)-math.Round(minScore) >= maxScoreBuckets {
+		return fmt.Errorf("score range [%v, %v] has more than %d whole scores", minScore, maxScore, maxScoreBuckets)
+	}
+
+	server.minScore = minScore
+	server.maxScore = maxScore
+	return nil
 }
 
 func (server *LaptopServer) CreateLaptop(
@@ -46,6 +91,10 @@ func (server *LaptopServer) CreateLaptop(
 		laptopDto.Id = id.String()
 	}
 
+	if err := validateNumbers(laptopDto); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptop is invalid: %v", err)
+	}
+
 	if err := getContextError(ctx); err != nil {
 		return nil, err
 	}
@@ -64,8 +113,162 @@ func (server *LaptopServer) CreateLaptop(
 	log.Printf("save laptop with id: %s", laptopDto.Id)
 
 	res := &laptop.CreateLaptopResponse{
-		Id: laptopDto.Id,
+		Id:       laptopDto.Id,
+		Revision: laptopDto.Revision,
+	}
+	return res, nil
+}
+
+func (server *LaptopServer) GetLaptop(
+	ctx context.Context,
+	req *laptop.GetLaptopRequest,
+) (*laptop.GetLaptopResponse, error) {
+	laptopID := req.GetId()
+	log.Printf("receive a get-laptop request with id: %s", laptopID)
+
+	if _, err := uuid.Parse(laptopID); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptop ID is not a valid UUID: %v", err)
+	}
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	found, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	} else if found == nil {
+		return nil, status.Errorf(codes.NotFound, "laptop %s is not found", laptopID)
+	}
+
+	primaryImageID, err := server.primaryImageID(laptopID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find primary image: %v", err)
+	}
+
+	res := &laptop.GetLaptopResponse{
+		Laptop:         found,
+		PrimaryImageId: primaryImageID,
+	}
+	return res, nil
+}
+
+func (server *LaptopServer) UpdateLaptop(
+	ctx context.Context,
+	req *laptop.UpdateLaptopRequest,
+) (*laptop.UpdateLaptopResponse, error) {
+	laptopDto := req.GetLaptop()
+	log.Printf("receive an update-laptop request with id: %s", laptopDto.GetId())
+
+	if laptopDto == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptop is not provided")
+	}
+
+	if _, err := uuid.Parse(laptopDto.Id); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptop ID is not a valid UUID: %v", err)
+	}
+
+	if err := validateNumbers(laptopDto); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptop is invalid: %v", err)
+	}
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	err := server.laptopStore.Update(laptopDto)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotFound) {
+			code = codes.NotFound
+		} else if errors.Is(err, ErrStaleRevision) {
+			code = codes.Aborted
+		}
+
+		return nil, status.Errorf(code, "cannot update laptop in the store: %v", err)
+	}
+
+	log.Printf("updated laptop with id: %s to revision %d", laptopDto.Id, laptopDto.Revision)
+
+	res := &laptop.UpdateLaptopResponse{
+		Id:       laptopDto.Id,
+		Revision: laptopDto.Revision,
+	}
+	return res, nil
+}
+
+func (server *LaptopServer) DeleteLaptop(
+	ctx context.Context,
+	req *laptop.DeleteLaptopRequest,
+) (*laptop.DeleteLaptopResponse, error) {
+	laptopID := req.GetId()
+	log.Printf("receive a delete-laptop request with id: %s", laptopID)
+
+	if _, err := uuid.Parse(laptopID); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptop ID is not a valid UUID: %v", err)
+	}
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
 	}
+
+	err := server.laptopStore.Delete(laptopID)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotFound) {
+			code = codes.NotFound
+		}
+
+		return nil, status.Errorf(code, "cannot delete laptop from the store: %v", err)
+	}
+
+	log.Printf("deleted laptop with id: %s", laptopID)
+
+	res := &laptop.DeleteLaptopResponse{
+		Id: laptopID,
+	}
+	return res, nil
+}
+
+func (server *LaptopServer) ListLaptops(
+	ctx context.Context,
+	req *laptop.ListLaptopsRequest,
+) (*laptop.ListLaptopsResponse, error) {
+	log.Printf("receive a list-laptops request with page size %d", req.GetPageSize())
+
+	pageSize := int(req.GetPageSize())
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	} else if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	afterID, err := decodePageToken(req.GetPageToken())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "page token is invalid: %v", err)
+	}
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	// ask for one extra laptop to find out whether there is a next page
+	laptops, err := server.laptopStore.List(ctx, afterID, pageSize+1)
+	if err != nil {
+		// the SQL store fails with the context error when the client gives up mid-query
+		if err := getContextError(ctx); err != nil {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "cannot list laptops: %v", err)
+	}
+
+	res := &laptop.ListLaptopsResponse{}
+	if len(laptops) > pageSize {
+		laptops = laptops[:pageSize]
+		res.NextPageToken = encodePageToken(laptops[pageSize-1].GetId())
+	}
+	res.Laptops = laptops
+
 	return res, nil
 }
 
@@ -74,103 +277,215 @@ func (server *LaptopServer) SearchLaptop(
 	stream laptop.LaptopService_SearchLaptopServer,
 ) error {
 	filter := req.GetFilter()
-	log.Printf("receive a search-laptop request with filter: %v", filter)
+	query := req.GetQuery()
+	log.Printf("receive a search-laptop request with query %q and filter: %v", query, filter)
 
-	err := server.laptopStore.Search(
-		stream.Context(),
-		filter,
-		func(lp *laptop.Laptop) error {
-			res := &laptop.SearchLaptopResponse{Laptop: lp}
+	maxResults := int(req.GetMaxResults())
+	sent := 0
 
-			err := stream.Send(res)
-			if err != nil {
+	send := func(lp *laptop.Laptop) error {
+		primaryImageID, err := server.primaryImageID(lp.GetId())
+		if err != nil {
+			return fmt.Errorf("cannot find primary image: %w", err)
+		}
+
+		res := &laptop.SearchLaptopResponse{
+			Laptop:         lp,
+			PrimaryImageId: primaryImageID,
+		}
+
+		err = stream.Send(res)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("sent laptop with id: %s", lp.GetId())
+		sent++
+		return nil
+	}
+
+	if req.GetSortBy() == laptop.SearchLaptopRequest_UNSORTED {
+		err := server.laptopStore.Search(
+			stream.Context(),
+			query,
+			filter,
+			func(lp *laptop.Laptop) error {
+				err := send(lp)
+				if err != nil {
+					return err
+				}
+
+				if sent == maxResults {
+					return errSearchLimitReached
+				}
+				return nil
+			},
+		)
+		if err != nil && !errors.Is(err, errSearchLimitReached) {
+			if err := getContextError(stream.Context()); err != nil {
 				return err
 			}
+			return status.Errorf(codes.Internal, "unexpected error: %v", err)
+		}
+
+		return nil
+	}
 
-			log.Printf("sent laptop with id: %s", lp.GetId())
+	// sorting needs every match, so collect them before sending the first one
+	found := []*laptop.Laptop{}
+	err := server.laptopStore.Search(
+		stream.Context(),
+		query,
+		filter,
+		func(lp *laptop.Laptop) error {
+			found = append(found, lp)
 			return nil
 		},
 	)
 	if err != nil {
+		if err := getContextError(stream.Context()); err != nil {
+			return err
+		}
 		return status.Errorf(codes.Internal, "unexpected error: %v", err)
 	}
 
-	return nil
-}
-
-func (server *LaptopServer) UploadImage(stream laptop.LaptopService_UploadImageServer) error {
-	req, err := stream.Recv()
+	ratingScores, err := server.ratingScores(req.GetSortBy(), found)
 	if err != nil {
-		logError(status.Errorf(codes.Unknown, "cannot receive image info"))
+		return err
 	}
 
-	laptopID := req.GetInfo().GetLaptopId()
-	imageType := req.GetInfo().GetImageType()
-	log.Printf("receive an upload-image request for laptop %s with image type %s", laptopID, imageType)
+	sortLaptops(found, req.GetSortBy(), req.GetSortOrder(), ratingScores)
 
-	lp, err := server.laptopStore.Find(laptopID)
-	if err != nil {
-		return logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
-	} else if lp == nil {
-		return logError(status.Errorf(codes.InvalidArgument, "laptop %s does not exist", laptopID))
+	if maxResults > 0 && len(found) > maxResults {
+		found = found[:maxResults]
 	}
 
-	imageData := bytes.Buffer{}
-	imageSize := 0
-
-	for {
-		if err := getContextError(stream.Context()); err != nil {
-			return nil
+	for _, lp := range found {
+		err := send(lp)
+		if err != nil {
+			return status.Errorf(codes.Unknown, "cannot send stream response: %v", err)
 		}
+	}
 
-		log.Printf("waiting for more data")
+	return nil
+}
 
-		req, err := stream.Recv()
-		if err == io.EOF {
-			log.Print("no more data")
-			break
-		}
+// ratingScores looks up the rating score of every laptop when results are sorted by one.
+// Unrated laptops get the Bayesian and decayed score of the prior alone. They have no
+// AVERAGE_RATING score, so they sort as if their average was zero.
+func (server *LaptopServer) ratingScores(
+	sortBy laptop.SearchLaptopRequest_SortBy,
+	laptops []*laptop.Laptop,
+) (map[string]float64, error) {
+	var score func(rating *Rating) float64
+	switch sortBy {
+	case laptop.SearchLaptopRequest_AVERAGE_RATING:
+		score = func(rating *Rating) float64 { return rating.Sum / float64(rating.Count) }
+	case laptop.SearchLaptopRequest_BAYESIAN_RATING:
+		score = func(rating *Rating) float64 { return rating.BayesianAverage }
+	case laptop.SearchLaptopRequest_DECAYED_RATING:
+		score = func(rating *Rating) float64 { return rating.DecayedScore }
+	default:
+		return nil, nil
+	}
 
-		if err != nil {
-			return logError(status.Errorf(codes.Unknown, "cannot receive data: %v", err))
-		}
+	if server.ratingStore == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "ratings are not available")
+	}
+
+	unrated := &Rating{}
+	server.ratingStore.Ranking().rank(unrated, nil, time.Now())
 
-		chunk := req.GetChunkData()
-		size := len(chunk)
+	laptopIDs := make([]string, len(laptops))
+	for i, lp := range laptops {
+		laptopIDs[i] = lp.GetId()
+	}
 
-		log.Printf("received a chunk with size: %d", size)
+	ratings, err := server.ratingStore.GetAll(laptopIDs)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot get ratings: %v", err)
+	}
 
-		imageSize += size
-		if imageSize > maxImageSize {
-			return logError(status.Errorf(codes.InvalidArgument, "image is too large: %d > %d", imageSize, maxImageSize))
+	scores := make(map[string]float64, len(laptops))
+	for _, lp := range laptops {
+		rating := ratings[lp.GetId()]
+		if rating != nil && rating.Count > 0 {
+			scores[lp.GetId()] = score(rating)
+		} else if sortBy != laptop.SearchLaptopRequest_AVERAGE_RATING {
+			scores[lp.GetId()] = score(unrated)
 		}
+	}
 
-		_, err = imageData.Write(chunk)
-		if err != nil {
-			return logError(status.Errorf(codes.Internal, "cannot write data: %v", err))
-		}
+	return scores, nil
+}
+
+func (server *LaptopServer) SearchFacets(
+	ctx context.Context,
+	req *laptop.SearchFacetsRequest,
+) (*laptop.SearchFacetsResponse, error) {
+	filter := req.GetFilter()
+	query := req.GetQuery()
+	log.Printf("receive a search-facets request with query %q and filter: %v", query, filter)
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
 	}
 
-	imageID, err := server.imageStore.Save(laptopID, imageType, imageData)
+	counts, err := server.laptopStore.Facets(ctx, query, filter)
 	if err != nil {
-		return logError(status.Errorf(codes.Internal, "cannot save image to the store: %v", err))
+		return nil, status.Errorf(codes.Internal, "cannot count facets: %v", err)
 	}
 
-	res := &laptop.UploadImageResponse{
-		Id:   imageID,
-		Size: uint32(imageSize),
+	res := &laptop.SearchFacetsResponse{
+		TotalCount: counts.Total,
+		Facets:     counts.Facets,
 	}
+	return res, nil
+}
 
-	err = stream.SendAndClose(res)
-	if err != nil {
-		return logError(status.Errorf(codes.Unknown, "cannot send response: %v", err))
+func (server *LaptopServer) WatchLaptops(
+	req *laptop.WatchLaptopsRequest,
+	stream laptop.LaptopService_WatchLaptopsServer,
+) error {
+	filter := req.GetFilter()
+	log.Printf("receive a watch-laptops request with filter: %v", filter)
+
+	err := server.laptopStore.Watch(
+		stream.Context(),
+		req.GetResumeToken(),
+		filter,
+		func(event *laptop.LaptopEvent) error {
+			res := &laptop.WatchLaptopsResponse{Event: event}
+
+			err := stream.Send(res)
+			if err != nil {
+				return err
+			}
+
+			log.Printf("sent %s event for laptop with id: %s", event.GetType(), event.GetLaptop().GetId())
+			return nil
+		},
+	)
+	switch {
+	case errors.Is(err, ErrInvalidResumeToken):
+		return status.Errorf(codes.InvalidArgument, "cannot watch laptops: %v", err)
+	case errors.Is(err, ErrResumeTokenExpired):
+		return status.Errorf(codes.OutOfRange, "cannot watch laptops: %v", err)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return getContextError(stream.Context())
+	case err != nil:
+		return status.Errorf(codes.Internal, "unexpected error: %v", err)
 	}
 
-	log.Printf("saved image with id: %s, size: %d", imageID, imageSize)
 	return nil
 }
 
 func (server *LaptopServer) RateLaptop(stream laptop.LaptopService_RateLaptopServer) error {
+	claims, ok := UserClaimsFromContext(stream.Context())
+	if !ok {
+		return logError(status.Error(codes.Unauthenticated, "rating a laptop requires a signed in user"))
+	}
+
 	for {
 		err := getContextError((stream.Context()))
 		if err != nil {
@@ -188,7 +503,15 @@ func (server *LaptopServer) RateLaptop(stream laptop.LaptopService_RateLaptopSer
 		laptopID := req.GetLaptopId()
 		score := req.GetScore()
 
-		log.Printf("received a rate-laptop request: id = %s, score = %.2f", laptopID, score)
+		log.Printf("received a rate-laptop request: id = %s, user = %s, score = %.2f", laptopID, claims.Username, score)
+
+		// NaN fails every comparison, so it has to be checked on its own
+		if math.IsNaN(score) || score < server.minScore || score > server.maxScore {
+			return logError(status.Errorf(
+				codes.InvalidArgument,
+				"score %v is outside of the range [%v, %v]", score, server.minScore, server.maxScore,
+			))
+		}
 
 		found, err := server.laptopStore.Find(laptopID)
 		if err != nil {
@@ -197,25 +520,202 @@ func (server *LaptopServer) RateLaptop(stream laptop.LaptopService_RateLaptopSer
 			return logError(status.Errorf(codes.NotFound, "laptopID %s is not found", laptopID))
 		}
 
-		rating, err := server.ratingStore.Add(laptopID, score)
+		// a repeated rating by the same user replaces the previous one
+		rating, err := server.ratingStore.Add(laptopID, claims.Username, score)
 		if err != nil {
 			return logError(status.Errorf(codes.Internal, "cannot add rating to the store: %v", err))
 		}
 
 		res := &laptop.RateLaptopResponse{
-			LaptopId:     laptopID,
-			RatedCount:   rating.Count,
-			AverageScore: rating.Sum / float64(rating.Count),
+			LaptopId:        laptopID,
+			RatedCount:      rating.Count,
+			AverageScore:    rating.Sum / float64(rating.Count),
+			BayesianAverage: rating.BayesianAverage,
+			DecayedScore:    rating.DecayedScore,
 		}
 
-		error := stream.Send(res)
+		err = stream.Send(res)
 		if err != nil {
-			return logError(status.Errorf(codes.Unknown, "cannot send stream response: %v", error))
+			return logError(status.Errorf(codes.Unknown, "cannot send stream response: %v", err))
+		}
+	}
+	return nil
+}
+
+func (server *LaptopServer) GetRating(
+	ctx context.Context,
+	req *laptop.GetRatingRequest,
+) (*laptop.GetRatingResponse, error) {
+	laptopID := req.GetLaptopId()
+	log.Printf("receive a get-rating request with laptop id: %s", laptopID)
+
+	if _, err := uuid.Parse(laptopID); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptop ID is not a valid UUID: %v", err)
+	}
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	found, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	} else if found == nil {
+		return nil, status.Errorf(codes.NotFound, "laptop %s is not found", laptopID)
+	}
+
+	rating, err := server.ratingStore.Get(laptopID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot get rating: %v", err)
+	}
+
+	res := &laptop.GetRatingResponse{
+		Rating: toRatingMessage(laptopID, rating),
+	}
+	return res, nil
+}
+
+func (server *LaptopServer) GetRatingSummary(
+	ctx context.Context,
+	req *laptop.GetRatingSummaryRequest,
+) (*laptop.GetRatingSummaryResponse, error) {
+	laptopID := req.GetLaptopId()
+	log.Printf("receive a get-rating-summary request with laptop id: %s", laptopID)
+
+	if _, err := uuid.Parse(laptopID); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptop ID is not a valid UUID: %v", err)
+	}
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	found, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	} else if found == nil {
+		return nil, status.Errorf(codes.NotFound, "laptop %s is not found", laptopID)
+	}
+
+	summary, err := server.ratingStore.Summary(laptopID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot get rating summary: %v", err)
+	}
+
+	res := &laptop.GetRatingSummaryResponse{
+		Summary: server.toRatingSummaryMessage(laptopID, summary),
+	}
+	return res, nil
+}
+
+// toRatingSummaryMessage has a histogram bucket for every whole score in the
+// allowed range, so clients can show empty ones as well
+func (server *LaptopServer) toRatingSummaryMessage(laptopID string, summary *RatingSummary) *laptop.RatingSummary {
+	message := &laptop.RatingSummary{LaptopId: laptopID}
+
+	var histogram map[int]uint32
+	if summary != nil {
+		message.RatedCount = summary.Count
+		message.AverageScore = summary.Sum / float64(summary.Count)
+		message.MedianScore = summary.Median
+		message.StandardDeviation = summary.StandardDeviation
+		histogram = summary.Histogram
+	}
+
+	lowest := int(math.Round(server.minScore))
+	highest := int(math.Round(server.maxScore))
+	for score := lowest; score <= highest; score++ {
+		message.Histogram = append(message.Histogram, &laptop.RatingSummary_Bucket{
+			Score: int32(score),
+			Count: histogram[score],
+		})
+	}
+
+	return message
+}
+
+func (server *LaptopServer) RetractRating(
+	ctx context.Context,
+	req *laptop.RetractRatingRequest,
+) (*laptop.RetractRatingResponse, error) {
+	laptopID := req.GetLaptopId()
+	log.Printf("receive a retract-rating request with laptop id: %s", laptopID)
+
+	claims, ok := UserClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "retracting a rating requires a signed in user")
+	}
+
+	if err := getContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	rating, err := server.ratingStore.Retract(laptopID, claims.Username)
+	if errors.Is(err, ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "user %s has not rated laptop %s", claims.Username, laptopID)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot retract rating: %v", err)
+	}
+
+	res := &laptop.RetractRatingResponse{
+		Rating: toRatingMessage(laptopID, rating),
+	}
+	return res, nil
+}
+
+// validateNumbers rejects NaN and infinite numbers, which the store indexes cannot order
+func validateNumbers(lp *laptop.Laptop) error {
+	type number struct {
+		name  string
+		value float64
+	}
+
+	numbers := []number{
+		{"price", lp.GetPriceUsd()},
+		{"CPU min GHz", lp.GetCpu().GetMinGhz()},
+		{"CPU max GHz", lp.GetCpu().GetMaxGhz()},
+		{"screen size", float64(lp.GetScreen().GetSizeInch())},
+		{"weight in kg", lp.GetWeightKg()},
+		{"weight in lb", lp.GetWeightLb()},
+	}
+	for i, gpu := range lp.GetGpus() {
+		numbers = append(numbers,
+			number{fmt.Sprintf("GPU %d min GHz", i), gpu.GetMinGhz()},
+			number{fmt.Sprintf("GPU %d max GHz", i), gpu.GetMaxGhz()},
+		)
+	}
+
+	for _, n := range numbers {
+		if math.IsNaN(n.value) || math.IsInf(n.value, 0) {
+			return fmt.Errorf("%s must be a finite number: %v", n.name, n.value)
 		}
 	}
+
 	return nil
 }
 
+// Page tokens are opaque to clients, they only wrap the ID of the last laptop on a page
+func encodePageToken(lastID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lastID))
+}
+
+func decodePageToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+
+	lastID, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := uuid.Parse(string(lastID)); err != nil {
+		return "", err
+	}
+
+	return string(lastID), nil
+}
+
 func logError(err error) error {
 	if err != nil {
 		log.Print(err)
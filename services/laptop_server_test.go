@@ -2,6 +2,7 @@ package services_test
 
 import (
 	"context"
+	"math"
 	"testing"
 
 	"github.com/arcbjorn/store-management-system/pb/laptop"
@@ -67,7 +68,7 @@ func TestServerCreateLaptop(t *testing.T) {
 				Laptop: tc.laptop,
 			}
 
-			server := services.NewLaptopServer(tc.store, nil, nil)
+			server := services.NewLaptopServer(tc.store, nil, nil, nil)
 			res, err := server.CreateLaptop(context.Background(), req)
 
 			if tc.code == codes.OK {
@@ -88,3 +89,74 @@ func TestServerCreateLaptop(t *testing.T) {
 		})
 	}
 }
+
+func TestServerUpdateLaptopRevision(t *testing.T) {
+	t.Parallel()
+
+	store := services.NewInMemoryLaptopStore()
+	server := services.NewLaptopServer(store, nil, nil, nil)
+
+	createRes, err := server.CreateLaptop(context.Background(), &laptop.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), createRes.GetRevision())
+
+	first, err := store.Find(createRes.GetId())
+	require.NoError(t, err)
+	second, err := store.Find(createRes.GetId())
+	require.NoError(t, err)
+
+	first.PriceUsd = 1000
+	updateRes, err := server.UpdateLaptop(context.Background(), &laptop.UpdateLaptopRequest{Laptop: first})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), updateRes.GetRevision())
+
+	second.PriceUsd = 2000
+	_, err = server.UpdateLaptop(context.Background(), &laptop.UpdateLaptopRequest{Laptop: second})
+	require.Equal(t, codes.Aborted, status.Code(err))
+
+	stored, err := store.Find(createRes.GetId())
+	require.NoError(t, err)
+	require.Equal(t, float64(1000), stored.GetPriceUsd())
+	require.Equal(t, uint64(2), stored.GetRevision())
+
+	second.Revision = stored.GetRevision()
+	updateRes, err = server.UpdateLaptop(context.Background(), &laptop.UpdateLaptopRequest{Laptop: second})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), updateRes.GetRevision())
+}
+
+func TestServerSetScoreRange(t *testing.T) {
+	t.Parallel()
+
+	server := services.NewLaptopServer(services.NewInMemoryLaptopStore(), nil, nil, nil)
+	require.NoError(t, server.SetScoreRange(0, 100))
+	require.Error(t, server.SetScoreRange(5, 5))
+	require.Error(t, server.SetScoreRange(0, 1e9), "every whole score is a histogram bucket")
+	require.Error(t, server.SetScoreRange(0, math.Inf(1)))
+}
+
+func TestServerRejectsNonFiniteNumbers(t *testing.T) {
+	t.Parallel()
+
+	store := services.NewInMemoryLaptopStore()
+	server := services.NewLaptopServer(store, nil, nil, nil)
+
+	lp := sample.NewLaptop()
+	lp.PriceUsd = math.NaN()
+	_, err := server.CreateLaptop(context.Background(), &laptop.CreateLaptopRequest{Laptop: lp})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	lp.PriceUsd = 900
+	lp.Gpus[0].MaxGhz = math.Inf(1)
+	_, err = server.CreateLaptop(context.Background(), &laptop.CreateLaptopRequest{Laptop: lp})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	lp.Gpus[0].MaxGhz = lp.Gpus[0].MinGhz
+	res, err := server.CreateLaptop(context.Background(), &laptop.CreateLaptopRequest{Laptop: lp})
+	require.NoError(t, err)
+
+	lp.Revision = res.GetRevision()
+	lp.Cpu.MinGhz = math.Inf(-1)
+	_, err = server.UpdateLaptop(context.Background(), &laptop.UpdateLaptopRequest{Laptop: lp})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
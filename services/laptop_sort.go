@@ -0,0 +1,47 @@
+package services
+
+import (
+	"sort"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+)
+
+// sortLaptops orders laptops by the given key, ratingScores holds the rating
+// score of each laptop when sorting by one. Laptops with equal keys are ordered
+// by ID so that the same search always returns the same sequence.
+func sortLaptops(
+	laptops []*laptop.Laptop,
+	sortBy laptop.SearchLaptopRequest_SortBy,
+	order laptop.SearchLaptopRequest_SortOrder,
+	ratingScores map[string]float64,
+) {
+	key := func(lp *laptop.Laptop) float64 {
+		switch sortBy {
+		case laptop.SearchLaptopRequest_PRICE:
+			return lp.GetPriceUsd()
+		case laptop.SearchLaptopRequest_CPU_GHZ:
+			return lp.GetCpu().GetMinGhz()
+		case laptop.SearchLaptopRequest_RAM:
+			return float64(toBit(lp.GetRam()))
+		case laptop.SearchLaptopRequest_RELEASE_YEAR:
+			return float64(lp.GetReleaseYear())
+		case laptop.SearchLaptopRequest_AVERAGE_RATING,
+			laptop.SearchLaptopRequest_BAYESIAN_RATING,
+			laptop.SearchLaptopRequest_DECAYED_RATING:
+			return ratingScores[lp.GetId()]
+		default:
+			return 0
+		}
+	}
+
+	descending := order == laptop.SearchLaptopRequest_DESCENDING
+
+	sort.Slice(laptops, func(i, j int) bool {
+		ki, kj := key(laptops[i]), key(laptops[j])
+		if ki != kj {
+			return (ki < kj) != descending
+		}
+
+		return laptops[i].GetId() < laptops[j].GetId()
+	})
+}
@@ -4,30 +4,62 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"sort"
 	"sync"
-	"time"
 
 	"github.com/arcbjorn/store-management-system/pb/laptop"
 	"github.com/jinzhu/copier"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var ErrAlreadyExists = errors.New("record already exists")
+var ErrNotFound = errors.New("record not found")
+var ErrStaleRevision = errors.New("record revision is stale")
 
+// LaptopStore keeps a revision number for every laptop: Save starts it at 1
+// and each successful Update bumps it. Update only succeeds when the given
+// laptop carries the revision currently stored, otherwise it fails with
+// ErrStaleRevision. Both methods write the new revision back to the argument.
 type LaptopStore interface {
 	Save(laptop *laptop.Laptop) error
 	Find(id string) (*laptop.Laptop, error)
-	Search(ctx context.Context, filter *laptop.Filter, found func(laptop *laptop.Laptop) error) error
+	Update(laptop *laptop.Laptop) error
+	Delete(id string) error
+	List(ctx context.Context, afterID string, limit int) ([]*laptop.Laptop, error)
+	Search(ctx context.Context, query string, filter *laptop.Filter, found func(laptop *laptop.Laptop) error) error
+	Facets(ctx context.Context, query string, filter *laptop.Filter) (*FacetCounts, error)
+	Watch(ctx context.Context, resumeToken string, filter *laptop.Filter, found func(event *laptop.LaptopEvent) error) error
 }
 
 type InMemoryLaptopStore struct {
-	mutex sync.RWMutex
-	data  map[string]*laptop.Laptop
+	mutex   sync.RWMutex
+	data    map[string]*laptop.Laptop
+	ids     []string
+	byPrice *laptopIndex
+	byCores *laptopIndex
+	byGhz   *laptopIndex
+	byRam   *laptopIndex
+	text    *textIndex
+	feed    *laptopFeed
+	journal laptopJournal
+}
+
+// laptopJournal is told about every change before it is applied to the store,
+// a change is rejected when it cannot be recorded
+type laptopJournal interface {
+	record(eventType laptop.LaptopEvent_Type, lp *laptop.Laptop) error
+	committed()
 }
 
 func NewInMemoryLaptopStore() *InMemoryLaptopStore {
 	return &InMemoryLaptopStore{
-		data: make(map[string]*laptop.Laptop),
+		data:    make(map[string]*laptop.Laptop),
+		byPrice: newLaptopIndex(laptopPrice),
+		byCores: newLaptopIndex(laptopCpuCores),
+		byGhz:   newLaptopIndex(laptopCpuGhz),
+		byRam:   newLaptopIndex(laptopRamBits),
+		text:    newTextIndex(),
+		feed:    newLaptopFeed(),
 	}
 }
 
@@ -44,13 +76,19 @@ func (store *InMemoryLaptopStore) Save(laptopDto *laptop.Laptop) error {
 		return err
 	}
 
-	store.data[other.Id] = other
+	other.Revision = 1
+	err = store.commit(laptop.LaptopEvent_CREATED, other)
+	if err != nil {
+		return err
+	}
+
+	laptopDto.Revision = other.Revision
 	return nil
 }
 
 func (store *InMemoryLaptopStore) Find(id string) (*laptop.Laptop, error) {
 	store.mutex.RLock()
-	defer store.mutex.RLock()
+	defer store.mutex.RUnlock()
 
 	foundLaptop := store.data[id]
 	if foundLaptop == nil {
@@ -60,74 +98,268 @@ func (store *InMemoryLaptopStore) Find(id string) (*laptop.Laptop, error) {
 	return deepCopy(foundLaptop)
 }
 
-func (store *InMemoryLaptopStore) Search(ctx context.Context, filter *laptop.Filter, found func(laptop *laptop.Laptop) error) error {
+func (store *InMemoryLaptopStore) Update(laptopDto *laptop.Laptop) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	current := store.data[laptopDto.Id]
+	if current == nil {
+		return ErrNotFound
+	}
+
+	if current.Revision != laptopDto.Revision {
+		return ErrStaleRevision
+	}
+
+	other, err := deepCopy(laptopDto)
+	if err != nil {
+		return err
+	}
+
+	other.Revision = current.Revision + 1
+	other.UpdatedAt = timestamppb.Now()
+	err = store.commit(laptop.LaptopEvent_UPDATED, other)
+	if err != nil {
+		return err
+	}
+
+	laptopDto.Revision = other.Revision
+	laptopDto.UpdatedAt = other.UpdatedAt
+	return nil
+}
+
+func (store *InMemoryLaptopStore) Delete(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	current := store.data[id]
+	if current == nil {
+		return ErrNotFound
+	}
+
+	return store.commit(laptop.LaptopEvent_DELETED, current)
+}
+
+// commit records a change in the journal, applies it and notifies the watchers.
+// It must be called with the write lock held.
+func (store *InMemoryLaptopStore) commit(eventType laptop.LaptopEvent_Type, lp *laptop.Laptop) error {
+	if store.journal != nil {
+		err := store.journal.record(eventType, lp)
+		if err != nil {
+			return fmt.Errorf("cannot record laptop change: %w", err)
+		}
+	}
+
+	previous := store.data[lp.GetId()]
+	store.apply(eventType, lp)
+	store.feed.publish(eventType, lp, previous)
+
+	if store.journal != nil {
+		store.journal.committed()
+	}
+	return nil
+}
+
+// apply sets the stored state of a laptop to the one carried by the change.
+// Applying the same change twice gives the same result, which lets a journal
+// replay changes that a snapshot already contains.
+func (store *InMemoryLaptopStore) apply(eventType laptop.LaptopEvent_Type, lp *laptop.Laptop) {
+	current := store.data[lp.GetId()]
+	if current != nil {
+		store.unindexLaptop(current)
+	}
+
+	if eventType == laptop.LaptopEvent_DELETED {
+		delete(store.data, lp.GetId())
+		store.ids = removeSorted(store.ids, lp.GetId())
+		return
+	}
+
+	if current == nil {
+		store.ids = insertSorted(store.ids, lp.GetId())
+	}
+
+	store.data[lp.GetId()] = lp
+	store.indexLaptop(lp)
+}
+
+// List returns up to limit laptops ordered by ID, starting right after afterID.
+// Paging by ID keeps pages consistent while other laptops are added or removed.
+func (store *InMemoryLaptopStore) List(ctx context.Context, afterID string, limit int) ([]*laptop.Laptop, error) {
 	store.mutex.RLock()
 	defer store.mutex.RUnlock()
 
-	for _, lp := range store.data {
-		time.Sleep(time.Second)
-		log.Print("checking laptop id: ", lp.GetId())
+	start := sort.SearchStrings(store.ids, afterID)
+	if start < len(store.ids) && store.ids[start] == afterID {
+		start++
+	}
 
-		if ctx.Err() == context.Canceled || ctx.Err() == context.DeadlineExceeded {
-			log.Printf("context is cancelled")
-			return errors.New("context is cancelled")
+	result := make([]*laptop.Laptop, 0, limit)
+	for _, id := range store.ids[start:] {
+		if len(result) == limit {
+			break
 		}
 
-		if isQualified(filter, lp) {
-			other, err := deepCopy(lp)
-			if err != nil {
-				return err
-			}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 
-			err = found(other)
-			if err != nil {
-				return err
-			}
+		other, err := deepCopy(store.data[id])
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, other)
+	}
+
+	return result, nil
+}
+
+// Search streams the laptops that match the filter, and the text query when it is
+// not empty, in which case the most relevant laptops come first. Matches are
+// collected under the read lock, so a slow receiver never blocks writers.
+func (store *InMemoryLaptopStore) Search(
+	ctx context.Context,
+	query string,
+	filter *laptop.Filter,
+	found func(laptop *laptop.Laptop) error,
+) error {
+	matches, err := store.findQualified(ctx, query, filter)
+	if err != nil {
+		return err
+	}
+
+	for _, lp := range matches {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err := found(lp)
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func isQualified(filter *laptop.Filter, laptop *laptop.Laptop) bool {
-	if laptop.GetPriceUsd() > filter.GetMaxPriceUsd() {
-		return false
+// Facets counts the laptops that Search would return for the same query and filter
+func (store *InMemoryLaptopStore) Facets(ctx context.Context, query string, filter *laptop.Filter) (*FacetCounts, error) {
+	matches, err := store.findQualified(ctx, query, filter)
+	if err != nil {
+		return nil, err
 	}
 
-	if laptop.GetCpu().GetCoreNumber() < filter.MinCpuCores {
-		return false
+	return countFacets(matches), nil
+}
+
+// Watch follows the laptops created, updated and deleted after the resume token.
+// Events are filtered on the latest state of the laptop, which for deletions is
+// the state it had when it was removed.
+func (store *InMemoryLaptopStore) Watch(
+	ctx context.Context,
+	resumeToken string,
+	filter *laptop.Filter,
+	found func(event *laptop.LaptopEvent) error,
+) error {
+	return store.feed.watch(ctx, resumeToken, filter, found)
+}
+
+func (store *InMemoryLaptopStore) findQualified(
+	ctx context.Context,
+	query string,
+	filter *laptop.Filter,
+) ([]*laptop.Laptop, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	// a query without letters or digits has no terms to match, so it does not filter
+	var ids []string
+	if len(tokenize(query)) > 0 {
+		for _, match := range store.text.search(query) {
+			ids = append(ids, match.id)
+		}
+	} else {
+		for _, entry := range store.candidates(filter) {
+			ids = append(ids, entry.id)
+		}
+	}
+
+	matches := []*laptop.Laptop{}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		lp := store.data[id]
+		if !isQualified(filter, lp) {
+			continue
+		}
+
+		other, err := deepCopy(lp)
+		if err != nil {
+			return nil, err
+		}
+
+		matches = append(matches, other)
+	}
+
+	return matches, nil
+}
+
+// candidates picks the narrowest index range that the filter allows, every
+// laptop outside of it is known not to match
+func (store *InMemoryLaptopStore) candidates(filter *laptop.Filter) []indexEntry {
+	ranges := [][]indexEntry{
+		store.byCores.atLeast(float64(filter.GetMinCpuCores())),
+		store.byGhz.atLeast(filter.GetMinCpuGhz()),
+		store.byRam.atLeast(float64(toBit(filter.GetMinRam()))),
 	}
 
-	if laptop.GetCpu().GetMinGhz() < filter.GetMinCpuGhz() {
-		return false
+	if filter.GetMaxPriceUsd() > 0 {
+		ranges = append(ranges, store.byPrice.atMost(filter.GetMaxPriceUsd()))
 	}
 
-	if toBit(laptop.GetRam()) < toBit(filter.GetMinRam()) {
-		return false
+	narrowest := ranges[0]
+	for _, entries := range ranges[1:] {
+		if len(entries) < len(narrowest) {
+			narrowest = entries
+		}
 	}
 
-	return true
+	return narrowest
 }
 
-func toBit(memory *laptop.Memory) uint64 {
-	value := memory.GetValue()
+func (store *InMemoryLaptopStore) indexLaptop(lp *laptop.Laptop) {
+	store.byPrice.insert(lp)
+	store.byCores.insert(lp)
+	store.byGhz.insert(lp)
+	store.byRam.insert(lp)
+	store.text.insert(lp)
+}
+
+func (store *InMemoryLaptopStore) unindexLaptop(lp *laptop.Laptop) {
+	store.byPrice.remove(lp)
+	store.byCores.remove(lp)
+	store.byGhz.remove(lp)
+	store.byRam.remove(lp)
+	store.text.remove(lp.GetId())
+}
+
+func insertSorted(ids []string, id string) []string {
+	i := sort.SearchStrings(ids, id)
+	ids = append(ids, "")
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
 
-	switch memory.GetUnit() {
-	case laptop.Memory_BIT:
-		return value
-	case laptop.Memory_BYTE:
-		return value << 3
-	case laptop.Memory_KILOBYTE:
-		return value << 13
-	case laptop.Memory_MEGABYTE:
-		return value << 23
-	case laptop.Memory_GIGABYTE:
-		return value << 33
-	case laptop.Memory_TERABYTE:
-		return value << 43
-	default:
-		return 0
+func removeSorted(ids []string, id string) []string {
+	i := sort.SearchStrings(ids, id)
+	if i < len(ids) && ids[i] == id {
+		ids = append(ids[:i], ids[i+1:]...)
 	}
+	return ids
 }
 
 func deepCopy(lt *laptop.Laptop) (*laptop.Laptop, error) {
@@ -0,0 +1,194 @@
+package services_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/arcbjorn/store-management-system/sample"
+	"github.com/arcbjorn/store-management-system/services"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryLaptopStoreSearchExtendedFilter(t *testing.T) {
+	t.Parallel()
+
+	// Dell or Lenovo, 2018+, SSD >= 512 GB, OLED, under 2 kg, backlit keyboard
+	filter := &laptop.Filter{
+		Brands:          []string{"dell", "Lenovo"},
+		MinReleaseYear:  2018,
+		StorageDriver:   laptop.Storage_SSD,
+		MinStorage:      &laptop.Memory{Value: 512, Unit: laptop.Memory_GIGABYTE},
+		ScreenPanel:     laptop.Screen_OLED,
+		MaxWeightKg:     2,
+		BacklitKeyboard: true,
+	}
+
+	store := services.NewInMemoryLaptopStore()
+	expectedIDs := make(map[string]bool)
+
+	for i := 0; i < 5; i++ {
+		lp := sample.NewLaptop()
+		lp.Brand = "Dell"
+		lp.ReleaseYear = 2019
+		lp.Storages = []*laptop.Storage{
+			{Driver: laptop.Storage_HDD, Memory: &laptop.Memory{Value: 2, Unit: laptop.Memory_TERABYTE}},
+			{Driver: laptop.Storage_SSD, Memory: &laptop.Memory{Value: 1, Unit: laptop.Memory_TERABYTE}},
+		}
+		lp.Screen.Panel = laptop.Screen_OLED
+		lp.Weight = &laptop.Laptop_WeightKg{WeightKg: 1.5}
+		lp.Keyboard.Backlit = true
+
+		switch i {
+		case 0:
+			lp.Brand = "Apple"
+		case 1:
+			lp.ReleaseYear = 2017
+		case 2:
+			// the big drive is an HDD, so the SSD criterion must not be met by it
+			lp.Storages[1].Memory = &laptop.Memory{Value: 256, Unit: laptop.Memory_GIGABYTE}
+		case 3:
+			lp.Weight = &laptop.Laptop_WeightLb{WeightLb: 4.5}
+		case 4:
+			lp.Brand = "LENOVO"
+			lp.Weight = &laptop.Laptop_WeightLb{WeightLb: 4.3}
+			expectedIDs[lp.Id] = true
+		}
+
+		err := store.Save(lp)
+		require.NoError(t, err)
+	}
+
+	found := make(map[string]bool)
+	err := store.Search(context.Background(), "", filter, func(lp *laptop.Laptop) error {
+		found[lp.GetId()] = true
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, expectedIDs, found)
+}
+
+func TestInMemoryLaptopStoreSearchIndexes(t *testing.T) {
+	t.Parallel()
+
+	filter := &laptop.Filter{
+		MaxPriceUsd: 2500,
+		MinCpuCores: 4,
+		MinCpuGhz:   2.5,
+		MinRam:      &laptop.Memory{Value: 16, Unit: laptop.Memory_GIGABYTE},
+	}
+
+	qualifies := func(lp *laptop.Laptop) bool {
+		return lp.GetPriceUsd() <= 2500 &&
+			lp.GetCpu().GetCoreNumber() >= 4 &&
+			lp.GetCpu().GetMinGhz() >= 2.5 &&
+			lp.GetRam().GetValue() >= 16
+	}
+
+	store := services.NewInMemoryLaptopStore()
+	laptops := make([]*laptop.Laptop, 300)
+
+	for i := range laptops {
+		laptops[i] = sample.NewLaptop()
+		err := store.Save(laptops[i])
+		require.NoError(t, err)
+	}
+
+	// indexes must follow updated keys and forget deleted laptops
+	for i := 0; i < 100; i++ {
+		laptops[i].PriceUsd = 1000 + float64(i)*20
+		laptops[i].Ram = sample.NewRam()
+		err := store.Update(laptops[i])
+		require.NoError(t, err)
+	}
+
+	for i := 100; i < 150; i++ {
+		err := store.Delete(laptops[i].GetId())
+		require.NoError(t, err)
+	}
+
+	expectedIDs := make(map[string]bool)
+	for i, lp := range laptops {
+		if (i < 100 || i >= 150) && qualifies(lp) {
+			expectedIDs[lp.GetId()] = true
+		}
+	}
+
+	found := make(map[string]bool)
+	err := store.Search(context.Background(), "", filter, func(lp *laptop.Laptop) error {
+		found[lp.GetId()] = true
+
+		// writers must not be blocked while results are being streamed
+		return store.Save(sample.NewLaptop())
+	})
+	require.NoError(t, err)
+	require.Equal(t, expectedIDs, found)
+}
+
+func TestInMemoryLaptopStoreSearchText(t *testing.T) {
+	t.Parallel()
+
+	store := services.NewInMemoryLaptopStore()
+
+	newLaptop := func(brand, name, gpu string, price float64) *laptop.Laptop {
+		lp := sample.NewLaptop()
+		lp.Brand = brand
+		lp.Name = name
+		lp.Cpu.Name = "Core i7-9750H"
+		lp.Gpus[0].Name = gpu
+		lp.PriceUsd = price
+
+		err := store.Save(lp)
+		require.NoError(t, err)
+		return lp
+	}
+
+	thinkpad := newLaptop("Lenovo", "ThinkPad X1", "RTX 2060", 2000)
+	thinkpadRx := newLaptop("Lenovo", "Thinkpad P53", "RX 580", 2500)
+	xps := newLaptop("Dell", "XPS 15", "RTX 2070", 2200)
+	expensiveXps := newLaptop("Dell", "XPS 17", "RTX 2080", 3000)
+	// "think" only prefixes the name of the other laptops
+	newLaptop("Think", "Vostro", "RX 590", 1800)
+
+	search := func(query string, filter *laptop.Filter) []string {
+		ids := []string{}
+		err := store.Search(context.Background(), query, filter, func(lp *laptop.Laptop) error {
+			ids = append(ids, lp.GetId())
+			return nil
+		})
+		require.NoError(t, err)
+		return ids
+	}
+
+	require.ElementsMatch(t, []string{thinkpad.Id, thinkpadRx.Id}, search("thinkpad", nil))
+	require.ElementsMatch(t, []string{thinkpad.Id, xps.Id, expensiveXps.Id}, search("RTX", nil))
+	require.Equal(t, []string{thinkpad.Id}, search("thinkpad rtx", nil))
+	require.Equal(t, []string{xps.Id}, search("xps rtx", &laptop.Filter{MaxPriceUsd: 2500}))
+	require.Empty(t, search("macbook", nil))
+	require.Len(t, search("?!", nil), 5, "a query without terms matches every laptop")
+
+	// a whole-token match in the brand ranks above prefix matches in names
+	ranked := search("think", nil)
+	require.Len(t, ranked, 3)
+	require.NotContains(t, ranked[:1], thinkpad.Id)
+	require.NotContains(t, ranked[:1], thinkpadRx.Id)
+
+	// deleted laptops leave the index
+	require.NoError(t, store.Delete(thinkpad.Id))
+	require.Equal(t, []string{thinkpadRx.Id}, search("thinkpad", nil))
+}
+
+func TestInMemoryLaptopStoreSearchCancelled(t *testing.T) {
+	t.Parallel()
+
+	store := services.NewInMemoryLaptopStore()
+	require.NoError(t, store.Save(sample.NewLaptop()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := store.Search(ctx, "", &laptop.Filter{}, func(lp *laptop.Laptop) error {
+		return nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+}
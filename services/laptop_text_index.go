@@ -0,0 +1,169 @@
+package services
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+)
+
+// Weights of the laptop fields in the relevance score, a match in the
+// laptop name counts more than a match in one of its components
+const (
+	nameWeight  = 4.0
+	brandWeight = 3.0
+	cpuWeight   = 2.0
+	gpuWeight   = 2.0
+
+	// a term that only matches the beginning of a token scores less than a whole token
+	prefixMatchFactor = 0.5
+)
+
+// textIndex is an inverted index from lowercase tokens to the laptops containing them
+type textIndex struct {
+	postings map[string]map[string]float64
+	tokens   []string
+	docs     map[string]map[string]float64
+}
+
+type textMatch struct {
+	id    string
+	score float64
+}
+
+func newTextIndex() *textIndex {
+	return &textIndex{
+		postings: make(map[string]map[string]float64),
+		docs:     make(map[string]map[string]float64),
+	}
+}
+
+func (index *textIndex) insert(lp *laptop.Laptop) {
+	doc := laptopTokens(lp)
+	index.docs[lp.GetId()] = doc
+
+	for token, weight := range doc {
+		posting := index.postings[token]
+		if posting == nil {
+			posting = make(map[string]float64)
+			index.postings[token] = posting
+			index.tokens = insertSorted(index.tokens, token)
+		}
+
+		posting[lp.GetId()] = weight
+	}
+}
+
+func (index *textIndex) remove(id string) {
+	for token := range index.docs[id] {
+		posting := index.postings[token]
+		delete(posting, id)
+
+		if len(posting) == 0 {
+			delete(index.postings, token)
+			index.tokens = removeSorted(index.tokens, token)
+		}
+	}
+
+	delete(index.docs, id)
+}
+
+// search returns the laptops in which every query term matches a token, either
+// whole or as a prefix, ordered by descending relevance
+func (index *textIndex) search(query string) []textMatch {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	var scores map[string]float64
+	for _, term := range terms {
+		termScores := index.match(term)
+
+		if scores == nil {
+			scores = termScores
+			continue
+		}
+
+		for id, score := range scores {
+			termScore, ok := termScores[id]
+			if !ok {
+				delete(scores, id)
+				continue
+			}
+			scores[id] = score + termScore
+		}
+	}
+
+	matches := make([]textMatch, 0, len(scores))
+	for id, score := range scores {
+		matches = append(matches, textMatch{id, score})
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].id < matches[j].id
+	})
+
+	return matches
+}
+
+// match scores every laptop having a token that starts with the term
+func (index *textIndex) match(term string) map[string]float64 {
+	scores := make(map[string]float64)
+
+	start := sort.SearchStrings(index.tokens, term)
+	for _, token := range index.tokens[start:] {
+		if !strings.HasPrefix(token, term) {
+			break
+		}
+
+		factor := 1.0
+		if token != term {
+			factor = prefixMatchFactor
+		}
+
+		for id, weight := range index.postings[token] {
+			if score := weight * factor; score > scores[id] {
+				scores[id] = score
+			}
+		}
+	}
+
+	return scores
+}
+
+// laptopTokens returns the searchable tokens of a laptop with the weight of
+// the most important field they appear in
+func laptopTokens(lp *laptop.Laptop) map[string]float64 {
+	doc := make(map[string]float64)
+
+	add := func(text string, weight float64) {
+		for _, token := range tokenize(text) {
+			if weight > doc[token] {
+				doc[token] = weight
+			}
+		}
+	}
+
+	add(lp.GetName(), nameWeight)
+	add(lp.GetBrand(), brandWeight)
+	add(lp.GetCpu().GetName(), cpuWeight)
+	add(lp.GetCpu().GetBrand(), cpuWeight)
+	for _, gpu := range lp.GetGpus() {
+		add(gpu.GetName(), gpuWeight)
+		add(gpu.GetBrand(), gpuWeight)
+	}
+
+	return doc
+}
+
+// tokenize splits text into lowercase runs of letters and digits
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/google/uuid"
+)
+
+var ErrInvalidResumeToken = errors.New("resume token is invalid")
+var ErrResumeTokenExpired = errors.New("resume token has expired")
+
+// number of past events a feed keeps for watchers that reconnect
+const laptopFeedCapacity = 4096
+
+// laptopFeed records the changes made to a laptop store, so that watchers can
+// follow them live and resume from the last event they have seen.
+type laptopFeed struct {
+	mutex   sync.Mutex
+	epoch   string
+	first   uint64
+	events  []*feedEvent
+	changed chan struct{}
+}
+
+// feedEvent is a published event with the state of the laptop before an update
+type feedEvent struct {
+	*laptop.LaptopEvent
+	previous *laptop.Laptop
+}
+
+func newLaptopFeed() *laptopFeed {
+	return &laptopFeed{
+		epoch:   uuid.New().String(),
+		first:   1,
+		changed: make(chan struct{}),
+	}
+}
+
+// publish appends an event for the laptop, with its state before the change for updates,
+// neither of which must be modified afterwards
+func (feed *laptopFeed) publish(eventType laptop.LaptopEvent_Type, lp *laptop.Laptop, previous *laptop.Laptop) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	sequence := feed.first + uint64(len(feed.events))
+	event := &feedEvent{
+		LaptopEvent: &laptop.LaptopEvent{
+			Type:        eventType,
+			Laptop:      lp,
+			ResumeToken: feed.token(sequence),
+		},
+	}
+	if eventType == laptop.LaptopEvent_UPDATED {
+		event.previous = previous
+	}
+	feed.events = append(feed.events, event)
+
+	if len(feed.events) > laptopFeedCapacity {
+		feed.events = feed.events[1:]
+		feed.first++
+	}
+
+	close(feed.changed)
+	feed.changed = make(chan struct{})
+}
+
+// watch calls found for every event matching the filter that comes after the
+// resume token, or after now when the token is empty, until the context is done.
+// An update of a laptop that matched the filter before but not anymore is a LEFT_FILTER event.
+func (feed *laptopFeed) watch(
+	ctx context.Context,
+	resumeToken string,
+	filter *laptop.Filter,
+	found func(event *laptop.LaptopEvent) error,
+) error {
+	feed.mutex.Lock()
+	next := feed.first + uint64(len(feed.events))
+	feed.mutex.Unlock()
+
+	if resumeToken != "" {
+		sequence, err := feed.parseToken(resumeToken)
+		if err != nil {
+			return err
+		}
+		next = sequence + 1
+	}
+
+	for {
+		feed.mutex.Lock()
+		if next < feed.first {
+			feed.mutex.Unlock()
+			return ErrResumeTokenExpired
+		}
+
+		end := feed.first + uint64(len(feed.events))
+		if next > end {
+			feed.mutex.Unlock()
+			return ErrInvalidResumeToken
+		}
+
+		events := feed.events[next-feed.first:]
+		changed := feed.changed
+		feed.mutex.Unlock()
+
+		for _, event := range events {
+			sent := event.LaptopEvent
+			if !isQualified(filter, event.GetLaptop()) {
+				if event.previous == nil || !isQualified(filter, event.previous) {
+					continue
+				}
+
+				sent = &laptop.LaptopEvent{
+					Type:        laptop.LaptopEvent_LEFT_FILTER,
+					Laptop:      event.GetLaptop(),
+					ResumeToken: event.GetResumeToken(),
+				}
+			}
+
+			err := found(sent)
+			if err != nil {
+				return err
+			}
+		}
+		next = end
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Tokens carry the epoch of the feed, because sequence numbers start over
+// when the server restarts
+func (feed *laptopFeed) token(sequence uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s/%d", feed.epoch, sequence)))
+}
+
+func (feed *laptopFeed) parseToken(token string) (uint64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, ErrInvalidResumeToken
+	}
+
+	parts := strings.SplitN(string(data), "/", 2)
+	if len(parts) != 2 {
+		return 0, ErrInvalidResumeToken
+	}
+
+	sequence, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, ErrInvalidResumeToken
+	}
+
+	if parts[0] != feed.epoch {
+		return 0, ErrResumeTokenExpired
+	}
+
+	return sequence, nil
+}
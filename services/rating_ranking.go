@@ -0,0 +1,78 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// RatingRanking configures the scores laptops are ranked by, which hold up
+// better than the plain average when a laptop has only a few ratings
+type RatingRanking struct {
+	// the score a laptop is assumed to have before it is rated
+	PriorMean float64
+	// the number of scores the prior counts as
+	PriorWeight float64
+	// the age at which a score counts half in the decayed score, zero disables it
+	HalfLife time.Duration
+}
+
+func DefaultRatingRanking() RatingRanking {
+	return RatingRanking{
+		PriorMean:   (defaultMinScore + defaultMaxScore) / 2,
+		PriorWeight: 5,
+	}
+}
+
+func (ranking RatingRanking) Validate() error {
+	if math.IsNaN(ranking.PriorMean) || math.IsInf(ranking.PriorMean, 0) {
+		return fmt.Errorf("prior mean %v is not a number", ranking.PriorMean)
+	}
+	if math.IsNaN(ranking.PriorWeight) || ranking.PriorWeight < 0 {
+		return fmt.Errorf("prior weight %v is negative", ranking.PriorWeight)
+	}
+	if ranking.HalfLife < 0 {
+		return fmt.Errorf("half-life %v is negative", ranking.HalfLife)
+	}
+	return nil
+}
+
+// timedScore is a score of a user together with the time it was given
+type timedScore struct {
+	score   float64
+	ratedAt time.Time
+}
+
+// rank fills in the Bayesian average and the decayed score of a rating from its scores,
+// a laptop without scores has the prior mean
+func (ranking RatingRanking) rank(rating *Rating, scores []timedScore, now time.Time) {
+	prior := ranking.PriorWeight * ranking.PriorMean
+
+	rating.BayesianAverage = ranking.PriorMean
+	if weight := ranking.PriorWeight + float64(rating.Count); weight > 0 {
+		rating.BayesianAverage = (prior + rating.Sum) / weight
+	}
+
+	rating.DecayedScore = 0
+	if ranking.HalfLife <= 0 {
+		return
+	}
+
+	// the same Bayesian average, with each score weighing half as much every half-life
+	sum, weight := prior, ranking.PriorWeight
+	for _, score := range scores {
+		age := now.Sub(score.ratedAt)
+		if age < 0 {
+			age = 0
+		}
+
+		decay := math.Exp2(-float64(age) / float64(ranking.HalfLife))
+		sum += decay * score.score
+		weight += decay
+	}
+
+	rating.DecayedScore = ranking.PriorMean
+	if weight > 0 {
+		rating.DecayedScore = sum / weight
+	}
+}
@@ -1,42 +1,234 @@
 package services
 
-import "sync"
+import (
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+)
+
+// RatingStore keeps one score per user and laptop, together with the totals of every laptop
 type RatingStore interface {
-	Add(laptopID string, score float64) (*Rating, error)
+	// Add records the score of a user for a laptop, replacing the previous score of the user
+	Add(laptopID string, username string, score float64) (*Rating, error)
+	// Retract removes the score of a user for a laptop, it returns ErrNotFound if there is none
+	Retract(laptopID string, username string) (*Rating, error)
+	// Score returns the score of a user for a laptop, it returns ErrNotFound if there is none
+	Score(laptopID string, username string) (float64, error)
+	// Get returns nil if the laptop has not been rated yet
+	Get(laptopID string) (*Rating, error)
+	// GetAll returns the ratings of the laptops that have been rated, by laptop ID
+	GetAll(laptopIDs []string) (map[string]*Rating, error)
+	// List returns up to limit ratings ordered by laptop ID, starting after afterLaptopID
+	List(afterLaptopID string, limit int) ([]*Rating, error)
+	// Summary returns the distribution of the scores of a laptop, or nil if it has not been rated yet
+	Summary(laptopID string) (*RatingSummary, error)
+	// Ranking returns the configuration the ratings are ranked with
+	Ranking() RatingRanking
 }
 
+// legacyRatingUser followed by a number names the users of the scores that were only
+// kept as totals, before scores were recorded per user. Each of them gave the average
+// score of the laptop. No user can log in with such a name, so no one replaces or
+// retracts these scores.
+const legacyRatingUser = "#legacy-"
+
 type Rating struct {
-	Count uint32
-	Sum   float64
+	LaptopID string
+	Count    uint32
+	Sum      float64
+	// computed with the RatingRanking of the store
+	BayesianAverage float64
+	DecayedScore    float64
 }
 
 type InMemoryRatingStore struct {
-	mutex  sync.RWMutex
-	rating map[string]*Rating
+	mutex   sync.RWMutex
+	ranking RatingRanking
+	rating  map[string]*Rating
+	// IDs of the rated laptops in order, so List pages without sorting
+	laptopIDs []string
+	// laptop ID -> username -> score
+	scores map[string]map[string]timedScore
 }
 
-func NewInMemoryRatingStore() *InMemoryRatingStore {
+func NewInMemoryRatingStore(ranking RatingRanking) *InMemoryRatingStore {
 	return &InMemoryRatingStore{
-		rating: make(map[string]*Rating),
+		ranking: ranking,
+		rating:  make(map[string]*Rating),
+		scores:  make(map[string]map[string]timedScore),
 	}
 }
 
-func (store *InMemoryRatingStore) Add(laptopID string, score float64) (*Rating, error) {
+func (store *InMemoryRatingStore) Add(laptopID string, username string, score float64) (*Rating, error) {
+	return store.add(laptopID, username, score, time.Now())
+}
+
+func (store *InMemoryRatingStore) add(laptopID string, username string, score float64, ratedAt time.Time) (*Rating, error) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
 	rating := store.rating[laptopID]
 	if rating == nil {
-		rating = &Rating{
-			Count: 1,
-			Sum:   score,
-		}
+		rating = &Rating{LaptopID: laptopID}
+		store.rating[laptopID] = rating
+		store.laptopIDs = insertSorted(store.laptopIDs, laptopID)
+		store.scores[laptopID] = make(map[string]timedScore)
+	}
+
+	previous, ok := store.scores[laptopID][username]
+	if ok {
+		rating.Sum += score - previous.score
 	} else {
 		rating.Count++
 		rating.Sum += score
 	}
+	store.scores[laptopID][username] = timedScore{score, ratedAt}
+
+	return store.ranked(rating), nil
+}
 
-	store.rating[laptopID] = rating
-	return rating, nil
+func (store *InMemoryRatingStore) Retract(laptopID string, username string) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	previous, ok := store.scores[laptopID][username]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	rating := store.rating[laptopID]
+	rating.Count--
+	rating.Sum -= previous.score
+	delete(store.scores[laptopID], username)
+
+	other := store.ranked(rating)
+	if rating.Count == 0 {
+		// an unrated laptop has no rating, so Get and List skip it
+		delete(store.rating, laptopID)
+		store.laptopIDs = removeSorted(store.laptopIDs, laptopID)
+		delete(store.scores, laptopID)
+		other = &Rating{LaptopID: laptopID}
+	}
+
+	return other, nil
+}
+
+func (store *InMemoryRatingStore) Score(laptopID string, username string) (float64, error) {
+	score, ok := store.score(laptopID, username)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return score.score, nil
+}
+
+func (store *InMemoryRatingStore) Get(laptopID string) (*Rating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	rating := store.rating[laptopID]
+	if rating == nil {
+		return nil, nil
+	}
+
+	return store.ranked(rating), nil
+}
+
+func (store *InMemoryRatingStore) GetAll(laptopIDs []string) (map[string]*Rating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	ratings := make(map[string]*Rating)
+	for _, laptopID := range laptopIDs {
+		if rating := store.rating[laptopID]; rating != nil {
+			ratings[laptopID] = store.ranked(rating)
+		}
+	}
+
+	return ratings, nil
+}
+
+func (store *InMemoryRatingStore) List(afterLaptopID string, limit int) ([]*Rating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	start := sort.SearchStrings(store.laptopIDs, afterLaptopID)
+	if start < len(store.laptopIDs) && store.laptopIDs[start] == afterLaptopID {
+		start++
+	}
+
+	laptopIDs := store.laptopIDs[start:]
+	if limit > 0 && len(laptopIDs) > limit {
+		laptopIDs = laptopIDs[:limit]
+	}
+
+	ratings := make([]*Rating, 0, len(laptopIDs))
+	for _, laptopID := range laptopIDs {
+		ratings = append(ratings, store.ranked(store.rating[laptopID]))
+	}
+
+	return ratings, nil
+}
+
+func (store *InMemoryRatingStore) Ranking() RatingRanking {
+	return store.ranking
+}
+
+func (store *InMemoryRatingStore) Summary(laptopID string) (*RatingSummary, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	scores := make([]float64, 0, len(store.scores[laptopID]))
+	for _, score := range store.scores[laptopID] {
+		scores = append(scores, score.score)
+	}
+
+	return summarizeScores(laptopID, scores), nil
+}
+
+// ranked returns a copy of the rating with its ranking scores, the mutex must be held
+func (store *InMemoryRatingStore) ranked(rating *Rating) *Rating {
+	scores := make([]timedScore, 0, len(store.scores[rating.LaptopID]))
+	for _, score := range store.scores[rating.LaptopID] {
+		scores = append(scores, score)
+	}
+
+	other := *rating
+	store.ranking.rank(&other, scores, time.Now())
+	return &other
+}
+
+// score returns the score a user gave a laptop
+func (store *InMemoryRatingStore) score(laptopID string, username string) (timedScore, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	score, ok := store.scores[laptopID][username]
+	return score, ok
+}
+
+// eachScore calls found for the score of every user and laptop
+func (store *InMemoryRatingStore) eachScore(found func(laptopID string, username string, score timedScore)) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	for laptopID, scores := range store.scores {
+		for username, score := range scores {
+			found(laptopID, username, score)
+		}
+	}
+}
+
+// toRatingMessage converts a rating for the API, a nil rating means no scores yet
+func toRatingMessage(laptopID string, rating *Rating) *laptop.Rating {
+	message := &laptop.Rating{LaptopId: laptopID}
+	if rating != nil && rating.Count > 0 {
+		message.RatedCount = rating.Count
+		message.ScoreSum = rating.Sum
+		message.AverageScore = rating.Sum / float64(rating.Count)
+		message.BayesianAverage = rating.BayesianAverage
+		message.DecayedScore = rating.DecayedScore
+	}
+	return message
 }
@@ -0,0 +1,74 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arcbjorn/store-management-system/sample"
+	"github.com/arcbjorn/store-management-system/services"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryRatingStoreRanking(t *testing.T) {
+	t.Parallel()
+
+	ranking := services.RatingRanking{
+		PriorMean:   5,
+		PriorWeight: 2,
+		HalfLife:    50 * time.Millisecond,
+	}
+	store := services.NewInMemoryRatingStore(ranking)
+	laptopID := sample.NewLaptop().Id
+
+	rating, err := store.Add(laptopID, "user1", 10)
+	require.NoError(t, err)
+	require.InDelta(t, (2*5+10)/3.0, rating.BayesianAverage, 1e-9)
+	require.InDelta(t, rating.BayesianAverage, rating.DecayedScore, 1e-2, "a new score has not decayed yet")
+
+	// the first score is several half-lives old when the second one comes in
+	time.Sleep(4 * ranking.HalfLife)
+
+	rating, err = store.Add(laptopID, "user2", 2)
+	require.NoError(t, err)
+	require.InDelta(t, (2*5+12)/4.0, rating.BayesianAverage, 1e-9)
+	require.Less(t, rating.DecayedScore, rating.BayesianAverage)
+	require.Greater(t, rating.DecayedScore, (2*5+2)/3.0, "the old score still counts a little")
+
+	ranking.HalfLife = 0
+	require.NoError(t, ranking.Validate())
+	rating, err = services.NewInMemoryRatingStore(ranking).Add(laptopID, "user1", 10)
+	require.NoError(t, err)
+	require.Zero(t, rating.DecayedScore)
+
+	ranking.PriorWeight = -1
+	require.Error(t, ranking.Validate())
+}
+
+func TestInMemoryRatingStoreList(t *testing.T) {
+	t.Parallel()
+
+	store := services.NewInMemoryRatingStore(services.DefaultRatingRanking())
+	for _, laptopID := range []string{"c", "a", "d", "b"} {
+		_, err := store.Add(laptopID, "user1", 5)
+		require.NoError(t, err)
+	}
+
+	_, err := store.Retract("c", "user1")
+	require.NoError(t, err)
+
+	ratings, err := store.List("", 2)
+	require.NoError(t, err)
+	require.Len(t, ratings, 2)
+	require.Equal(t, "a", ratings[0].LaptopID)
+	require.Equal(t, "b", ratings[1].LaptopID)
+
+	ratings, err = store.List("b", 2)
+	require.NoError(t, err)
+	require.Len(t, ratings, 1, "the retracted laptop is not listed")
+	require.Equal(t, "d", ratings[0].LaptopID)
+
+	ratings, err = store.List("bb", 0)
+	require.NoError(t, err)
+	require.Len(t, ratings, 1)
+	require.Equal(t, "d", ratings[0].LaptopID)
+}
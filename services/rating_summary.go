@@ -0,0 +1,54 @@
+package services
+
+import (
+	"math"
+	"sort"
+)
+
+// RatingSummary describes how the scores of a laptop are distributed
+type RatingSummary struct {
+	Rating
+	Median            float64
+	StandardDeviation float64
+	// the number of scores per score rounded to the nearest whole number
+	Histogram map[int]uint32
+}
+
+// summarizeScores returns nil if there are no scores
+func summarizeScores(laptopID string, scores []float64) *RatingSummary {
+	if len(scores) == 0 {
+		return nil
+	}
+
+	sorted := append([]float64(nil), scores...)
+	sort.Float64s(sorted)
+
+	summary := &RatingSummary{
+		Rating: Rating{
+			LaptopID: laptopID,
+			Count:    uint32(len(sorted)),
+		},
+		Histogram: make(map[int]uint32),
+	}
+
+	for _, score := range sorted {
+		summary.Sum += score
+		summary.Histogram[int(math.Round(score))]++
+	}
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 1 {
+		summary.Median = sorted[middle]
+	} else {
+		summary.Median = (sorted[middle-1] + sorted[middle]) / 2
+	}
+
+	mean := summary.Sum / float64(len(sorted))
+	variance := 0.0
+	for _, score := range sorted {
+		variance += (score - mean) * (score - mean)
+	}
+	summary.StandardDeviation = math.Sqrt(variance / float64(len(sorted)))
+
+	return summary
+}
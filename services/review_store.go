@@ -0,0 +1,239 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ReviewStore keeps the written reviews of laptops, one per author and laptop
+type ReviewStore interface {
+	// Save adds the review of its author for its laptop, or replaces the title,
+	// body, pros and cons of the one the author wrote before. It returns the stored review.
+	Save(review *laptop.Review) (*laptop.Review, error)
+	// Find returns nil if there is no review with the ID
+	Find(id string) (*laptop.Review, error)
+	// List returns up to limit reviews of a laptop in the given order, starting
+	// after the review with the ID, votes and creation time of after, if given
+	List(
+		laptopID string,
+		sortBy laptop.ListReviewsRequest_SortBy,
+		includeHidden bool,
+		after *laptop.Review,
+		limit int,
+	) ([]*laptop.Review, error)
+	// Vote counts a user as finding a review helpful, it returns ErrAlreadyExists if the user voted for it before
+	Vote(reviewID string, username string) (*laptop.Review, error)
+	// SetHidden hides a review from readers or shows it again
+	SetHidden(reviewID string, hidden bool) (*laptop.Review, error)
+}
+
+type InMemoryReviewStore struct {
+	mutex   sync.RWMutex
+	reviews map[string]*laptop.Review
+	// laptop ID -> author -> review ID
+	byAuthor map[string]map[string]string
+	// review ID -> usernames of the voters
+	voters  map[string]map[string]bool
+	journal reviewJournal
+}
+
+// reviewJournal is told about every change before it is applied to the store,
+// a change is rejected when it cannot be recorded
+type reviewJournal interface {
+	record(change *laptop.ReviewRecord) error
+	committed()
+}
+
+func NewInMemoryReviewStore() *InMemoryReviewStore {
+	return &InMemoryReviewStore{
+		reviews:  make(map[string]*laptop.Review),
+		byAuthor: make(map[string]map[string]string),
+		voters:   make(map[string]map[string]bool),
+	}
+}
+
+func (store *InMemoryReviewStore) Save(review *laptop.Review) (*laptop.Review, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := timestamppb.Now()
+
+	if id, ok := store.byAuthor[review.GetLaptopId()][review.GetAuthor()]; ok {
+		existing := proto.Clone(store.reviews[id]).(*laptop.Review)
+		existing.Title = review.GetTitle()
+		existing.Body = review.GetBody()
+		existing.Pros = review.GetPros()
+		existing.Cons = review.GetCons()
+		existing.AuthorScore = review.GetAuthorScore()
+		existing.UpdatedAt = now
+		return store.commit(existing)
+	}
+
+	other := &laptop.Review{
+		Id:          uuid.New().String(),
+		LaptopId:    review.GetLaptopId(),
+		Author:      review.GetAuthor(),
+		Title:       review.GetTitle(),
+		Body:        review.GetBody(),
+		Pros:        review.GetPros(),
+		Cons:        review.GetCons(),
+		AuthorScore: review.GetAuthorScore(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	return store.commit(other)
+}
+
+// commit records a change in the journal and applies it, it returns a copy of the review.
+// It must be called with the write lock held.
+func (store *InMemoryReviewStore) commit(review *laptop.Review, voters ...string) (*laptop.Review, error) {
+	change := &laptop.ReviewRecord{
+		Review: review,
+		Voters: voters,
+	}
+
+	if store.journal != nil {
+		err := store.journal.record(change)
+		if err != nil {
+			return nil, fmt.Errorf("cannot record review change: %w", err)
+		}
+	}
+
+	store.apply(change)
+
+	if store.journal != nil {
+		store.journal.committed()
+	}
+	return proto.Clone(review).(*laptop.Review), nil
+}
+
+// apply sets the stored state of a review to the one carried by the change and adds its voters.
+// Applying the same change twice gives the same result.
+func (store *InMemoryReviewStore) apply(change *laptop.ReviewRecord) {
+	review := proto.Clone(change.GetReview()).(*laptop.Review)
+	store.reviews[review.GetId()] = review
+
+	authors := store.byAuthor[review.GetLaptopId()]
+	if authors == nil {
+		authors = make(map[string]string)
+		store.byAuthor[review.GetLaptopId()] = authors
+	}
+	authors[review.GetAuthor()] = review.GetId()
+
+	if len(change.GetVoters()) == 0 {
+		return
+	}
+
+	voters := store.voters[review.GetId()]
+	if voters == nil {
+		voters = make(map[string]bool)
+		store.voters[review.GetId()] = voters
+	}
+	for _, username := range change.GetVoters() {
+		voters[username] = true
+	}
+}
+
+func (store *InMemoryReviewStore) Find(id string) (*laptop.Review, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	review := store.reviews[id]
+	if review == nil {
+		return nil, nil
+	}
+
+	return proto.Clone(review).(*laptop.Review), nil
+}
+
+func (store *InMemoryReviewStore) List(
+	laptopID string,
+	sortBy laptop.ListReviewsRequest_SortBy,
+	includeHidden bool,
+	after *laptop.Review,
+	limit int,
+) ([]*laptop.Review, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	reviews := []*laptop.Review{}
+	for _, id := range store.byAuthor[laptopID] {
+		review := store.reviews[id]
+		if review.GetHidden() && !includeHidden {
+			continue
+		}
+		if after != nil && !reviewBefore(sortBy, after, review) {
+			continue
+		}
+
+		reviews = append(reviews, review)
+	}
+
+	sort.Slice(reviews, func(i, j int) bool {
+		return reviewBefore(sortBy, reviews[i], reviews[j])
+	})
+
+	if limit > 0 && len(reviews) > limit {
+		reviews = reviews[:limit]
+	}
+
+	for i, review := range reviews {
+		reviews[i] = proto.Clone(review).(*laptop.Review)
+	}
+
+	return reviews, nil
+}
+
+func (store *InMemoryReviewStore) Vote(reviewID string, username string) (*laptop.Review, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	review := store.reviews[reviewID]
+	if review == nil {
+		return nil, ErrNotFound
+	}
+
+	if store.voters[reviewID][username] {
+		return nil, ErrAlreadyExists
+	}
+
+	voted := proto.Clone(review).(*laptop.Review)
+	voted.HelpfulVotes++
+	return store.commit(voted, username)
+}
+
+func (store *InMemoryReviewStore) SetHidden(reviewID string, hidden bool) (*laptop.Review, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	review := store.reviews[reviewID]
+	if review == nil {
+		return nil, ErrNotFound
+	}
+
+	other := proto.Clone(review).(*laptop.Review)
+	other.Hidden = hidden
+	return store.commit(other)
+}
+
+// reviewBefore tells whether review1 comes before review2 in the order.
+// Ties are broken by the creation time and then the ID, so the order is total.
+func reviewBefore(sortBy laptop.ListReviewsRequest_SortBy, review1 *laptop.Review, review2 *laptop.Review) bool {
+	if sortBy == laptop.ListReviewsRequest_MOST_HELPFUL && review1.GetHelpfulVotes() != review2.GetHelpfulVotes() {
+		return review1.GetHelpfulVotes() > review2.GetHelpfulVotes()
+	}
+
+	created1 := review1.GetCreatedAt().AsTime()
+	created2 := review2.GetCreatedAt().AsTime()
+	if !created1.Equal(created2) {
+		return created1.After(created2)
+	}
+
+	return review1.GetId() < review2.GetId()
+}
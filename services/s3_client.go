@@ -0,0 +1,387 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 rejects the parts of a multipart upload smaller than this, except the last one
+const minS3PartSize = 5 << 20
+
+// S3Config locates a bucket of an S3 compatible object storage
+type S3Config struct {
+	// Endpoint is the URL of the S3 API, such as https://s3.eu-west-1.amazonaws.com,
+	// the bucket is addressed in the path, so that other implementations work too
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PartSize is the size of the parts of multipart uploads, images up to it are stored with
+	// a single request. It defaults to and cannot be less than the minimum part size of S3, 5 MiB.
+	PartSize int64
+}
+
+// s3Error is an error response of the S3 API
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (err *s3Error) Error() string {
+	return fmt.Sprintf("s3 error %d %s: %s", err.StatusCode, err.Code, err.Message)
+}
+
+// isS3NotFound tells whether the object or upload of a request does not exist
+func isS3NotFound(err error) bool {
+	var s3Err *s3Error
+	return errors.As(err, &s3Err) && s3Err.StatusCode == http.StatusNotFound
+}
+
+// isS3Conflict tells whether a conditional request failed because the object was changed
+func isS3Conflict(err error) bool {
+	var s3Err *s3Error
+	return errors.As(err, &s3Err) &&
+		(s3Err.StatusCode == http.StatusPreconditionFailed || s3Err.StatusCode == http.StatusConflict)
+}
+
+// s3Part is a stored part of a multipart upload
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// s3Client makes the requests of the S3 API the image store needs, signed with AWS Signature Version 4,
+// see https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+type s3Client struct {
+	config     S3Config
+	httpClient *http.Client
+}
+
+func newS3Client(config S3Config) (*s3Client, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid s3 endpoint: %q", config.Endpoint)
+	} else if config.Region == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("s3 region and bucket are required")
+	} else if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, fmt.Errorf("s3 credentials are required")
+	}
+
+	config.Endpoint = strings.TrimSuffix(endpoint.String(), "/")
+
+	// an overall timeout would also cover reading the body, which cuts off streamed
+	// downloads of large images, so only connecting and waiting for a response are limited
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   16,
+	}
+
+	client := &s3Client{
+		config:     config,
+		httpClient: &http.Client{Transport: transport},
+	}
+	return client, nil
+}
+
+// putObject stores the content at the key and returns its ETag
+func (client *s3Client) putObject(key string, content []byte, header http.Header) (string, error) {
+	res, err := client.do(http.MethodPut, key, nil, header, content)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+
+	return res.Header.Get("ETag"), nil
+}
+
+// getObject returns the content at the key and its ETag, the caller must close it
+func (client *s3Client) getObject(key string) (io.ReadCloser, string, error) {
+	res, err := client.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return res.Body, res.Header.Get("ETag"), nil
+}
+
+// readObject returns the whole content at the key, which is expected to be small
+func (client *s3Client) readObject(key string) ([]byte, string, error) {
+	body, etag, err := client.getObject(key)
+	if err != nil {
+		return nil, "", err
+	}
+	defer body.Close()
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot read s3 object %s: %w", key, err)
+	}
+	return content, etag, nil
+}
+
+// deleteObject succeeds when there is no object at the key
+func (client *s3Client) deleteObject(key string) error {
+	res, err := client.do(http.MethodDelete, key, nil, nil, nil)
+	if isS3NotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+func (client *s3Client) createMultipartUpload(key string, header http.Header) (string, error) {
+	result := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+
+	err := client.doXML(http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, &result)
+	if err != nil {
+		return "", err
+	} else if result.UploadID == "" {
+		return "", fmt.Errorf("s3 returned no upload id for %s", key)
+	}
+
+	return result.UploadID, nil
+}
+
+func (client *s3Client) uploadPart(key string, uploadID string, partNumber int, content []byte) (*s3Part, error) {
+	query := url.Values{
+		"partNumber": {fmt.Sprint(partNumber)},
+		"uploadId":   {uploadID},
+	}
+
+	res, err := client.do(http.MethodPut, key, query, nil, content)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	return &s3Part{PartNumber: partNumber, ETag: res.Header.Get("ETag")}, nil
+}
+
+func (client *s3Client) completeMultipartUpload(key string, uploadID string, parts []*s3Part) error {
+	request := struct {
+		XMLName xml.Name  `xml:"CompleteMultipartUpload"`
+		Parts   []*s3Part `xml:"Part"`
+	}{Parts: parts}
+
+	content, err := xml.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("cannot encode s3 parts: %w", err)
+	}
+
+	result := struct {
+		XMLName xml.Name
+	}{}
+	return client.doXML(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, content, &result)
+}
+
+func (client *s3Client) abortMultipartUpload(key string, uploadID string) error {
+	res, err := client.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if isS3NotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// doXML decodes the XML response of a request into the result
+func (client *s3Client) doXML(
+	method string,
+	key string,
+	query url.Values,
+	header http.Header,
+	content []byte,
+	result interface{},
+) error {
+	res, err := client.do(method, key, query, header, content)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("cannot read s3 response: %w", err)
+	}
+
+	// completing a multipart upload can fail after the response status is sent
+	s3Err := &s3Error{StatusCode: res.StatusCode}
+	if xml.Unmarshal(body, s3Err) == nil && s3Err.Code != "" {
+		return s3Err
+	}
+
+	err = xml.Unmarshal(body, result)
+	if err != nil {
+		return fmt.Errorf("cannot decode s3 response: %w", err)
+	}
+	return nil
+}
+
+// do sends a signed request for the object at the key,
+// it returns an *s3Error for error responses, the caller must close the body otherwise
+func (client *s3Client) do(
+	method string,
+	key string,
+	query url.Values,
+	header http.Header,
+	content []byte,
+) (*http.Response, error) {
+	target := client.config.Endpoint + "/" + s3Escape(client.config.Bucket, false) + "/" + s3Escape(key, true)
+	if len(query) > 0 {
+		target += "?" + s3CanonicalQuery(query)
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create s3 request: %w", err)
+	}
+
+	for name, values := range header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	client.sign(req, content, time.Now())
+
+	res, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot send s3 request: %w", err)
+	}
+
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+
+		s3Err := &s3Error{StatusCode: res.StatusCode}
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+		if xml.Unmarshal(body, s3Err) != nil || s3Err.Code == "" {
+			s3Err.Code = http.StatusText(res.StatusCode)
+		}
+		return nil, s3Err
+	}
+
+	return res, nil
+}
+
+// sign adds the headers of Signature Version 4 to the request, with every header of the request signed
+func (client *s3Client) sign(req *http.Request, content []byte, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(content)
+
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + client.config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + client.config.SecretAccessKey)
+	for _, part := range []string{date, client.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		client.config.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+// s3CanonicalQuery encodes the query sorted by name, the way it is signed
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := []string{}
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes everything but the unreserved characters of RFC 3986, and slashes if kept
+func s3Escape(s string, keepSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && keepSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,870 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Conditional updates of an object are retried this many times when other replicas change it meanwhile
+	s3UpdateAttempts = 10
+	// the most metadata objects read at once when listing the images of a laptop
+	s3ListConcurrency = 8
+)
+
+// S3ImageStore keeps the images in a bucket of an S3 compatible object storage, so that all replicas
+// of the server share them. Nothing is cached: every image has a metadata object next to its content
+// and renditions, and the gallery of every laptop is an object which is only replaced if no other
+// replica changed it since it was read. Contents are not deduplicated and quotas are not enforced.
+// Finding an image reads its metadata and its gallery, and listing a gallery reads the metadata of
+// every image in parallel, which is fine for the few images a laptop has.
+//
+// Uploads are stored as segments, which are joined into the image on commit, with a multipart upload
+// if it is larger than a part. The state of an upload is an object too, so it can be resumed through
+// any replica, but only the replica writing it knows that it is in progress. Nothing deletes the
+// objects of uploads that are never resumed, the bucket needs a lifecycle rule to expire them,
+// as shown in the README.
+//
+// ImageSweeper only works with the disk image store, so the images of deleted laptops stay in
+// the bucket. Delete removes the image from the gallery first, so the objects left by a failed
+// deletion are not found anymore, and stay too.
+type S3ImageStore struct {
+	mutex     sync.Mutex
+	client    *s3Client
+	partSize  int64
+	uploading map[string]bool
+}
+
+// s3UploadState is the content of the state object of an upload
+type s3UploadState struct {
+	LaptopID string       `json:"laptop_id"`
+	Segments []*s3Segment `json:"segments"`
+	// Hash is the encoded state of the SHA-256 digest of the segments
+	Hash []byte `json:"hash"`
+}
+
+type s3Segment struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// s3Gallery is the content of the gallery object of a laptop
+type s3Gallery struct {
+	// ImageIDs are in gallery order
+	ImageIDs []string `json:"image_ids"`
+	Primary  string   `json:"primary"`
+}
+
+func (gallery *s3Gallery) position(imageID string) int {
+	for position, id := range gallery.ImageIDs {
+		if id == imageID {
+			return position
+		}
+	}
+	return -1
+}
+
+// NewS3ImageStore checks the configuration, the bucket must exist already
+func NewS3ImageStore(config S3Config) (*S3ImageStore, error) {
+	if config.PartSize == 0 {
+		config.PartSize = minS3PartSize
+	} else if config.PartSize < minS3PartSize {
+		return nil, fmt.Errorf("s3 part size cannot be less than %d bytes", minS3PartSize)
+	}
+
+	client, err := newS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &S3ImageStore{
+		client:    client,
+		partSize:  config.PartSize,
+		uploading: make(map[string]bool),
+	}
+	return store, nil
+}
+
+func s3InfoKey(imageID string) string {
+	return "images/" + imageID + "/info"
+}
+
+func s3OriginalKey(imageID string, imageType string) string {
+	return "images/" + imageID + "/original" + imageType
+}
+
+func s3RenditionKey(imageID string, maxSize int, imageType string) string {
+	return fmt.Sprintf("images/%s/%d%s", imageID, maxSize, imageType)
+}
+
+func s3GalleryKey(laptopID string) string {
+	return "laptops/" + laptopID + "/gallery"
+}
+
+func s3UploadKey(imageID string) string {
+	return "uploads/" + imageID + "/state"
+}
+
+func s3SegmentKey(imageID string, n int) string {
+	return fmt.Sprintf("uploads/%s/%d", imageID, n)
+}
+
+// isValidS3ID tells whether an ID can be part of a key, all IDs are UUIDs
+func isValidS3ID(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
+func (store *S3ImageStore) Create(laptopID string) (ImageWriter, error) {
+	if !isValidS3ID(laptopID) {
+		return nil, fmt.Errorf("invalid laptop id: %s", laptopID)
+	}
+
+	imageID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate image id: %w", err)
+	}
+
+	writer := &s3ImageWriter{
+		store: store,
+		hash:  sha256.New(),
+		info: &ImageInfo{
+			ID:       imageID.String(),
+			LaptopID: laptopID,
+		},
+	}
+
+	err = writer.persist()
+	if err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.uploading[writer.info.ID] = true
+	return writer, nil
+}
+
+// Resume drops whatever was written after the last stored segment of the upload
+func (store *S3ImageStore) Resume(imageID string) (ImageWriter, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.uploading[imageID] {
+		return nil, ErrUploadInProgress
+	}
+
+	state, err := store.readUploadState(imageID)
+	if err != nil {
+		return nil, err
+	} else if state == nil {
+		return nil, ErrNotFound
+	}
+
+	writer := &s3ImageWriter{
+		store:    store,
+		hash:     sha256.New(),
+		segments: state.Segments,
+		info: &ImageInfo{
+			ID:       imageID,
+			LaptopID: state.LaptopID,
+		},
+	}
+
+	err = writer.hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("cannot restore upload checksum: %w", err)
+	}
+
+	for _, segment := range state.Segments {
+		writer.info.Size += segment.Size
+	}
+
+	store.uploading[imageID] = true
+	return writer, nil
+}
+
+func (store *S3ImageStore) FindUpload(imageID string) (*ImageUpload, error) {
+	state, err := store.readUploadState(imageID)
+	if err != nil || state == nil {
+		return nil, err
+	}
+
+	upload := &ImageUpload{
+		ID:       imageID,
+		LaptopID: state.LaptopID,
+	}
+	for _, segment := range state.Segments {
+		upload.Size += segment.Size
+	}
+	return upload, nil
+}
+
+// readUploadState returns nil if there is no upload with the ID
+func (store *S3ImageStore) readUploadState(imageID string) (*s3UploadState, error) {
+	if !isValidS3ID(imageID) {
+		return nil, nil
+	}
+
+	data, _, err := store.client.readObject(s3UploadKey(imageID))
+	if isS3NotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read upload state: %w", err)
+	}
+
+	state := &s3UploadState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse upload state: %w", err)
+	}
+
+	return state, nil
+}
+
+func (store *S3ImageStore) Find(imageID string) (*ImageInfo, error) {
+	info, err := store.readInfo(imageID)
+	if err != nil || info == nil {
+		return nil, err
+	}
+
+	gallery, _, err := store.readGallery(info.LaptopID)
+	if err != nil {
+		return nil, err
+	}
+
+	// an image is only visible while it is in the gallery of its laptop
+	info.Position = gallery.position(imageID)
+	if info.Position < 0 {
+		return nil, nil
+	}
+
+	info.Primary = gallery.Primary == imageID
+	return info, nil
+}
+
+// readInfo returns the metadata of an image without its gallery position, or nil if there is none
+func (store *S3ImageStore) readInfo(imageID string) (*ImageInfo, error) {
+	if !isValidS3ID(imageID) {
+		return nil, nil
+	}
+
+	data, _, err := store.client.readObject(s3InfoKey(imageID))
+	if isS3NotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read image metadata: %w", err)
+	}
+
+	image := &laptop.Image{}
+	err = proto.Unmarshal(data, image)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse image metadata: %w", err)
+	}
+
+	info := toImageInfo(image)
+	info.Path = s3OriginalKey(info.ID, info.Type)
+	for _, rendition := range info.Renditions {
+		rendition.Path = s3RenditionKey(info.ID, rendition.MaxSize, rendition.Type)
+	}
+	return info, nil
+}
+
+func (store *S3ImageStore) writeInfo(info *ImageInfo, header http.Header) (string, error) {
+	data, err := proto.Marshal(toImageMessage(info))
+	if err != nil {
+		return "", fmt.Errorf("cannot encode image metadata: %w", err)
+	}
+
+	etag, err := store.client.putObject(s3InfoKey(info.ID), data, header)
+	if err != nil {
+		return "", fmt.Errorf("cannot write image metadata: %w", err)
+	}
+	return etag, nil
+}
+
+// readGallery returns an empty gallery without an ETag if the laptop has none
+func (store *S3ImageStore) readGallery(laptopID string) (*s3Gallery, string, error) {
+	gallery := &s3Gallery{}
+	if !isValidS3ID(laptopID) {
+		return gallery, "", nil
+	}
+
+	data, etag, err := store.client.readObject(s3GalleryKey(laptopID))
+	if isS3NotFound(err) {
+		return gallery, "", nil
+	} else if err != nil {
+		return nil, "", fmt.Errorf("cannot read image gallery: %w", err)
+	}
+
+	err = json.Unmarshal(data, gallery)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot parse image gallery: %w", err)
+	}
+
+	return gallery, etag, nil
+}
+
+// updateGallery applies the change to the gallery of a laptop and replaces it, unless another
+// replica replaced it first, in which case the change is applied again to the new gallery
+func (store *S3ImageStore) updateGallery(laptopID string, change func(gallery *s3Gallery) error) (*s3Gallery, error) {
+	for attempt := 0; attempt < s3UpdateAttempts; attempt++ {
+		gallery, etag, err := store.readGallery(laptopID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = change(gallery)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := json.Marshal(gallery)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode image gallery: %w", err)
+		}
+
+		_, err = store.client.putObject(s3GalleryKey(laptopID), data, conditionalHeader(etag))
+		if isS3Conflict(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot write image gallery: %w", err)
+		}
+
+		return gallery, nil
+	}
+
+	return nil, fmt.Errorf("cannot write image gallery: too many concurrent changes")
+}
+
+// conditionalHeader makes a write fail unless the object still has the ETag, or still does not exist without one
+func conditionalHeader(etag string) http.Header {
+	if etag == "" {
+		return http.Header{"If-None-Match": {"*"}}
+	}
+	return http.Header{"If-Match": {etag}}
+}
+
+func (store *S3ImageStore) Open(imageID string, maxSize int) (io.ReadCloser, error) {
+	info, err := store.Find(imageID)
+	if err != nil {
+		return nil, err
+	} else if info == nil {
+		return nil, ErrNotFound
+	}
+
+	key := info.Path
+	if maxSize != 0 {
+		rendition := info.Rendition(maxSize)
+		if rendition == nil {
+			return nil, ErrNotFound
+		}
+		key = rendition.Path
+	}
+
+	content, _, err := store.client.getObject(key)
+	if isS3NotFound(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot open image: %w", err)
+	}
+
+	return content, nil
+}
+
+// AddRendition stores the rendition next to the original and adds it to the metadata of the image
+func (store *S3ImageStore) AddRendition(
+	imageID string,
+	maxSize int,
+	format ImageFormat,
+	content []byte,
+) (*ImageRendition, error) {
+	if imageTypes[format.MimeType] != format.Type {
+		return nil, fmt.Errorf("%w: type %q of %s", ErrUnsupportedImage, format.Type, format.MimeType)
+	}
+
+	rendition := &ImageRendition{
+		ImageFormat: format,
+		MaxSize:     maxSize,
+		Path:        s3RenditionKey(imageID, maxSize, format.Type),
+		Size:        int64(len(content)),
+	}
+
+	for attempt := 0; attempt < s3UpdateAttempts; attempt++ {
+		data, etag, err := store.client.readObject(s3InfoKey(imageID))
+		if isS3NotFound(err) || !isValidS3ID(imageID) {
+			return nil, ErrNotFound
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot read image metadata: %w", err)
+		}
+
+		image := &laptop.Image{}
+		err = proto.Unmarshal(data, image)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse image metadata: %w", err)
+		}
+
+		if attempt == 0 {
+			header := http.Header{"Content-Type": {format.MimeType}}
+			_, err = store.client.putObject(rendition.Path, content, header)
+			if err != nil {
+				return nil, fmt.Errorf("cannot write image rendition: %w", err)
+			}
+		}
+
+		info := toImageInfo(image)
+		renditions := []*ImageRendition{}
+		for _, other := range info.Renditions {
+			if other.MaxSize != maxSize {
+				renditions = append(renditions, other)
+			}
+		}
+		renditions = append(renditions, rendition)
+		sort.Slice(renditions, func(i, j int) bool {
+			return renditions[i].MaxSize < renditions[j].MaxSize
+		})
+		info.Renditions = renditions
+
+		_, err = store.writeInfo(info, conditionalHeader(etag))
+		if isS3Conflict(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		other := *rendition
+		return &other, nil
+	}
+
+	return nil, fmt.Errorf("cannot write image metadata: too many concurrent changes")
+}
+
+func (store *S3ImageStore) List(laptopID string) ([]*ImageInfo, error) {
+	gallery, _, err := store.readGallery(laptopID)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.list(gallery)
+}
+
+// list reads the metadata of the images of the gallery, up to s3ListConcurrency at once
+func (store *S3ImageStore) list(gallery *s3Gallery) ([]*ImageInfo, error) {
+	infos := make([]*ImageInfo, len(gallery.ImageIDs))
+	errs := make([]error, len(gallery.ImageIDs))
+	limit := make(chan struct{}, s3ListConcurrency)
+
+	var wg sync.WaitGroup
+	for position, imageID := range gallery.ImageIDs {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(position int, imageID string) {
+			defer wg.Done()
+			infos[position], errs[position] = store.readInfo(imageID)
+			<-limit
+		}(position, imageID)
+	}
+	wg.Wait()
+
+	images := []*ImageInfo{}
+	for position, info := range infos {
+		if errs[position] != nil {
+			return nil, errs[position]
+		} else if info == nil {
+			// deleted by another replica meanwhile
+			continue
+		}
+
+		info.Position = position
+		info.Primary = gallery.Primary == info.ID
+		images = append(images, info)
+	}
+
+	return images, nil
+}
+
+func (store *S3ImageStore) FindPrimary(laptopID string) (*ImageInfo, error) {
+	gallery, _, err := store.readGallery(laptopID)
+	if err != nil || gallery.Primary == "" {
+		return nil, err
+	}
+
+	return store.Find(gallery.Primary)
+}
+
+func (store *S3ImageStore) Reorder(laptopID string, imageIDs []string) ([]*ImageInfo, error) {
+	gallery, err := store.updateGallery(laptopID, func(gallery *s3Gallery) error {
+		if len(imageIDs) != len(gallery.ImageIDs) {
+			return ErrInvalidImageOrder
+		}
+
+		listed := make(map[string]bool, len(imageIDs))
+		for _, imageID := range imageIDs {
+			if listed[imageID] || gallery.position(imageID) < 0 {
+				return ErrInvalidImageOrder
+			}
+			listed[imageID] = true
+		}
+
+		gallery.ImageIDs = append([]string(nil), imageIDs...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return store.list(gallery)
+}
+
+func (store *S3ImageStore) SetPrimary(imageID string) (*ImageInfo, error) {
+	info, err := store.readInfo(imageID)
+	if err != nil {
+		return nil, err
+	} else if info == nil {
+		return nil, ErrNotFound
+	}
+
+	gallery, err := store.updateGallery(info.LaptopID, func(gallery *s3Gallery) error {
+		if gallery.position(imageID) < 0 {
+			return ErrNotFound
+		}
+
+		gallery.Primary = imageID
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info.Position = gallery.position(imageID)
+	info.Primary = true
+	return info, nil
+}
+
+// Delete removes the image from the gallery before deleting its objects,
+// the first image left becomes the primary image of the laptop if it was the primary one
+func (store *S3ImageStore) Delete(imageID string) error {
+	info, err := store.readInfo(imageID)
+	if err != nil {
+		return err
+	} else if info == nil {
+		return ErrNotFound
+	}
+
+	_, err = store.updateGallery(info.LaptopID, func(gallery *s3Gallery) error {
+		position := gallery.position(imageID)
+		if position < 0 {
+			return ErrNotFound
+		}
+
+		gallery.ImageIDs = append(gallery.ImageIDs[:position:position], gallery.ImageIDs[position+1:]...)
+		if gallery.Primary == imageID {
+			gallery.Primary = ""
+			if len(gallery.ImageIDs) > 0 {
+				gallery.Primary = gallery.ImageIDs[0]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	keys := []string{info.Path}
+	for _, rendition := range info.Renditions {
+		keys = append(keys, rendition.Path)
+	}
+	keys = append(keys, s3InfoKey(imageID))
+
+	for _, key := range keys {
+		err := store.client.deleteObject(key)
+		if err != nil {
+			return fmt.Errorf("cannot delete image: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// join stores the segments followed by the rest of the content at the key,
+// with a single request if they fit in a part and with a multipart upload otherwise
+func (store *S3ImageStore) join(key string, mimeType string, segments []*s3Segment, rest []byte) error {
+	size := int64(len(rest))
+	readers := []io.Reader{}
+	for _, segment := range segments {
+		size += segment.Size
+		readers = append(readers, &s3SegmentReader{client: store.client, key: segment.Key})
+	}
+	readers = append(readers, bytes.NewReader(rest))
+
+	content := io.MultiReader(readers...)
+	defer func() {
+		for _, reader := range readers {
+			if segment, ok := reader.(*s3SegmentReader); ok {
+				segment.Close()
+			}
+		}
+	}()
+
+	header := http.Header{"Content-Type": {mimeType}}
+	if size <= store.partSize {
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return err
+		}
+
+		_, err = store.client.putObject(key, data, header)
+		return err
+	}
+
+	uploadID, err := store.client.createMultipartUpload(key, header)
+	if err != nil {
+		return err
+	}
+
+	parts := []*s3Part{}
+	buffer := make([]byte, store.partSize)
+	for {
+		n, err := io.ReadFull(content, buffer)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			store.client.abortMultipartUpload(key, uploadID)
+			return err
+		}
+
+		part, err := store.client.uploadPart(key, uploadID, len(parts)+1, buffer[:n])
+		if err != nil {
+			store.client.abortMultipartUpload(key, uploadID)
+			return err
+		}
+		parts = append(parts, part)
+	}
+
+	err = store.client.completeMultipartUpload(key, uploadID, parts)
+	if err != nil {
+		store.client.abortMultipartUpload(key, uploadID)
+		return err
+	}
+
+	return nil
+}
+
+// s3SegmentReader only gets the segment once it is read
+type s3SegmentReader struct {
+	client *s3Client
+	key    string
+	body   io.ReadCloser
+}
+
+func (reader *s3SegmentReader) Read(p []byte) (int, error) {
+	if reader.body == nil {
+		body, _, err := reader.client.getObject(reader.key)
+		if err != nil {
+			return 0, fmt.Errorf("cannot read upload segment: %w", err)
+		}
+		reader.body = body
+	}
+
+	return reader.body.Read(p)
+}
+
+func (reader *s3SegmentReader) Close() error {
+	if reader.body == nil {
+		return nil
+	}
+	return reader.body.Close()
+}
+
+type s3ImageWriter struct {
+	store *S3ImageStore
+	hash  hash.Hash
+	info  *ImageInfo
+	// segments are the stored content, buffer is what was written after them
+	segments []*s3Segment
+	buffer   []byte
+	done     bool
+}
+
+func (writer *s3ImageWriter) Write(p []byte) (int, error) {
+	writer.buffer = append(writer.buffer, p...)
+	writer.hash.Write(p)
+	writer.info.Size += int64(len(p))
+
+	if int64(len(writer.buffer)) >= writer.store.partSize {
+		return len(p), writer.persist()
+	}
+	return len(p), nil
+}
+
+func (writer *s3ImageWriter) ID() string {
+	return writer.info.ID
+}
+
+func (writer *s3ImageWriter) Offset() int64 {
+	return writer.info.Size
+}
+
+func (writer *s3ImageWriter) Replay(w io.Writer) error {
+	for _, segment := range writer.segments {
+		reader := &s3SegmentReader{client: writer.store.client, key: segment.Key}
+		_, err := io.Copy(w, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(writer.buffer)
+	return err
+}
+
+// persist stores the buffer as a new segment and records it in the state of the upload
+func (writer *s3ImageWriter) persist() error {
+	if len(writer.buffer) > 0 {
+		segment := &s3Segment{
+			Key:  s3SegmentKey(writer.info.ID, len(writer.segments)+1),
+			Size: int64(len(writer.buffer)),
+		}
+
+		_, err := writer.store.client.putObject(segment.Key, writer.buffer, nil)
+		if err != nil {
+			return fmt.Errorf("cannot write upload segment: %w", err)
+		}
+
+		writer.segments = append(writer.segments, segment)
+		writer.buffer = nil
+	}
+
+	hashState, err := writer.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("cannot save upload checksum: %w", err)
+	}
+
+	state := &s3UploadState{
+		LaptopID: writer.info.LaptopID,
+		Segments: writer.segments,
+		Hash:     hashState,
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("cannot encode upload state: %w", err)
+	}
+
+	_, err = writer.store.client.putObject(s3UploadKey(writer.info.ID), data, nil)
+	if err != nil {
+		return fmt.Errorf("cannot write upload state: %w", err)
+	}
+	return nil
+}
+
+// finish ends the upload, deleting its objects unless it is suspended
+func (writer *s3ImageWriter) finish(keep bool) {
+	writer.done = true
+	if !keep {
+		writer.store.client.deleteObject(s3UploadKey(writer.info.ID))
+		for _, segment := range writer.segments {
+			writer.store.client.deleteObject(segment.Key)
+		}
+	}
+
+	writer.store.mutex.Lock()
+	defer writer.store.mutex.Unlock()
+
+	delete(writer.store.uploading, writer.info.ID)
+}
+
+func (writer *s3ImageWriter) Checksum() string {
+	return hex.EncodeToString(writer.hash.Sum(nil))
+}
+
+// Commit joins the content into the original, then writes the metadata and adds the image to the gallery
+func (writer *s3ImageWriter) Commit(format ImageFormat, details ImageDetails) (*ImageInfo, error) {
+	if writer.done {
+		return nil, fmt.Errorf("image writer is already closed")
+	}
+
+	if imageTypes[format.MimeType] != format.Type {
+		return nil, fmt.Errorf("%w: type %q of %s", ErrUnsupportedImage, format.Type, format.MimeType)
+	}
+	defer writer.finish(false)
+
+	writer.info.Type = format.Type
+	writer.info.MimeType = format.MimeType
+	writer.info.Width = format.Width
+	writer.info.Height = format.Height
+	writer.info.Checksum = writer.Checksum()
+	writer.info.ImageDetails = details
+	writer.info.Path = s3OriginalKey(writer.info.ID, format.Type)
+
+	// without its state the upload cannot be resumed anymore
+	err := writer.store.client.deleteObject(s3UploadKey(writer.info.ID))
+	if err != nil {
+		return nil, fmt.Errorf("cannot write image: %w", err)
+	}
+
+	err = writer.store.join(writer.info.Path, format.MimeType, writer.segments, writer.buffer)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write image: %w", err)
+	}
+
+	writer.info.CreatedAt = time.Now()
+	_, err = writer.store.writeInfo(writer.info, nil)
+	if err != nil {
+		writer.store.client.deleteObject(writer.info.Path)
+		return nil, err
+	}
+
+	gallery, err := writer.store.updateGallery(writer.info.LaptopID, func(gallery *s3Gallery) error {
+		gallery.ImageIDs = append(gallery.ImageIDs, writer.info.ID)
+		if gallery.Primary == "" {
+			gallery.Primary = writer.info.ID
+		}
+		return nil
+	})
+	if err != nil {
+		writer.store.client.deleteObject(s3InfoKey(writer.info.ID))
+		writer.store.client.deleteObject(writer.info.Path)
+		return nil, err
+	}
+
+	info := writer.info.clone()
+	info.Position = gallery.position(info.ID)
+	info.Primary = gallery.Primary == info.ID
+	return info, nil
+}
+
+func (writer *s3ImageWriter) Abort() error {
+	if writer.done {
+		return nil
+	}
+
+	writer.finish(false)
+	return nil
+}
+
+func (writer *s3ImageWriter) Suspend() error {
+	if writer.done {
+		return nil
+	}
+
+	err := writer.persist()
+	writer.finish(true)
+	return err
+}
@@ -0,0 +1,195 @@
+package services_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/arcbjorn/store-management-system/sample"
+	"github.com/arcbjorn/store-management-system/services"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestS3ImageStore(t *testing.T, config services.S3Config) *services.S3ImageStore {
+	store, err := services.NewS3ImageStore(config)
+	require.NoError(t, err)
+	return store
+}
+
+func TestS3ImageStore(t *testing.T) {
+	t.Parallel()
+
+	fake, config := newFakeS3(t)
+	store := newTestS3ImageStore(t, config)
+	laptopID := sample.NewLaptop().Id
+
+	format := services.ImageFormat{MimeType: "image/png", Type: ".png", Width: 800, Height: 600}
+	first := saveTestImage(t, store, laptopID, format, []byte("first"))
+	second := saveTestImage(t, store, laptopID, format, []byte("second"))
+
+	info, err := store.Find(second)
+	require.NoError(t, err)
+	require.Equal(t, laptopID, info.LaptopID)
+	require.Equal(t, 1, info.Position)
+	require.False(t, info.Primary)
+	require.EqualValues(t, len("second"), info.Size)
+	require.Equal(t, "16367aacb67a4a017c8da8ab95682ccb390863780f7114dda0a0e0c55644c7c4", info.Checksum)
+
+	small := services.ImageFormat{MimeType: "image/png", Type: ".png", Width: 128, Height: 96}
+	_, err = store.AddRendition(second, 128, small, []byte("small"))
+	require.NoError(t, err)
+
+	images, err := store.Reorder(laptopID, []string{second, first})
+	require.NoError(t, err)
+	require.Equal(t, second, images[0].ID)
+	require.NotNil(t, images[0].Rendition(128))
+	_, err = store.Reorder(laptopID, []string{second, second})
+	require.ErrorIs(t, err, services.ErrInvalidImageOrder)
+
+	primary, err := store.FindPrimary(laptopID)
+	require.NoError(t, err)
+	require.Equal(t, first, primary.ID)
+
+	_, err = store.SetPrimary(second)
+	require.NoError(t, err)
+
+	content, err := store.Open(second, 128)
+	require.NoError(t, err)
+	data, err := io.ReadAll(content)
+	require.NoError(t, err)
+	require.NoError(t, content.Close())
+	require.Equal(t, "small", string(data))
+
+	_, err = store.Open(first, 512)
+	require.ErrorIs(t, err, services.ErrNotFound)
+
+	// another replica sees the same images
+	images, err = newTestS3ImageStore(t, config).List(laptopID)
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+	require.True(t, images[0].Primary)
+	require.Equal(t, first, images[1].ID)
+
+	require.NoError(t, store.Delete(second))
+	require.ErrorIs(t, store.Delete(second), services.ErrNotFound)
+
+	primary, err = store.FindPrimary(laptopID)
+	require.NoError(t, err)
+	require.Equal(t, first, primary.ID)
+
+	require.NoError(t, store.Delete(first))
+	require.Equal(t, []string{"laptops/" + laptopID + "/gallery"}, fake.keys())
+
+	config.SecretAccessKey = "wrong-secret-key"
+	_, err = newTestS3ImageStore(t, config).Create(laptopID)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "SignatureDoesNotMatch")
+}
+
+func TestS3ImageStoreMultipartUpload(t *testing.T) {
+	t.Parallel()
+
+	fake, config := newFakeS3(t)
+	laptopID := sample.NewLaptop().Id
+
+	content := make([]byte, 12<<20)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	writer, err := newTestS3ImageStore(t, config).Create(laptopID)
+	require.NoError(t, err)
+
+	// the first part is stored once it is complete, the rest on suspend
+	const chunkSize = 1 << 20
+	for offset := 0; offset < 6*chunkSize; offset += chunkSize {
+		_, err = writer.Write(content[offset : offset+chunkSize])
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Suspend())
+
+	// the upload continues through another replica
+	store := newTestS3ImageStore(t, config)
+	upload, err := store.FindUpload(writer.ID())
+	require.NoError(t, err)
+	require.EqualValues(t, 6*chunkSize, upload.Size)
+
+	writer, err = store.Resume(writer.ID())
+	require.NoError(t, err)
+	_, err = store.Resume(writer.ID())
+	require.ErrorIs(t, err, services.ErrUploadInProgress)
+
+	var replayed bytes.Buffer
+	require.NoError(t, writer.Replay(&replayed))
+	require.Equal(t, content[:6*chunkSize], replayed.Bytes())
+
+	_, err = writer.Write(content[6*chunkSize:])
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(content)
+	require.Equal(t, hex.EncodeToString(sum[:]), writer.Checksum())
+
+	info, err := writer.Commit(services.ImageFormat{MimeType: "image/jpeg", Type: ".jpg"}, services.ImageDetails{})
+	require.NoError(t, err)
+	require.EqualValues(t, len(content), info.Size)
+	require.Equal(t, 1, fake.count("CompleteMultipartUpload"))
+	require.Equal(t, 3, fake.count("UploadPart"))
+
+	upload, err = store.FindUpload(info.ID)
+	require.NoError(t, err)
+	require.Nil(t, upload)
+	for _, key := range fake.keys() {
+		require.False(t, strings.HasPrefix(key, "uploads/"), key)
+	}
+
+	stored, err := store.Open(info.ID, 0)
+	require.NoError(t, err)
+	defer stored.Close()
+
+	data, err := io.ReadAll(stored)
+	require.NoError(t, err)
+	require.Equal(t, content, data)
+}
+
+func TestS3ImageStoreReplicas(t *testing.T) {
+	t.Parallel()
+
+	_, config := newFakeS3(t)
+	laptopID := sample.NewLaptop().Id
+	format := services.ImageFormat{MimeType: "image/gif", Type: ".gif"}
+
+	// concurrent changes to the gallery are retried, not lost
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(store *services.S3ImageStore) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				writer, err := store.Create(laptopID)
+				if err == nil {
+					_, err = writer.Write([]byte("image"))
+				}
+				if err == nil {
+					_, err = writer.Commit(format, services.ImageDetails{})
+				}
+				errs <- err
+			}
+		}(newTestS3ImageStore(t, config))
+	}
+	wg.Wait()
+
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	images, err := newTestS3ImageStore(t, config).List(laptopID)
+	require.NoError(t, err)
+	require.Len(t, images, 20)
+	require.True(t, images[0].Primary)
+}
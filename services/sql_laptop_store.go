@@ -0,0 +1,398 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// SQLLaptopStore keeps laptops in a relational database. The whole laptop is
+// stored as protobuf, next to indexed columns that filters are translated to.
+// Watchers only see the changes made through this store instance.
+type SQLLaptopStore struct {
+	// writes are serialized so that watchers get changes in commit order
+	mutex sync.Mutex
+	db    *sql.DB
+	feed  *laptopFeed
+}
+
+func NewSQLLaptopStore(db *sql.DB) *SQLLaptopStore {
+	return &SQLLaptopStore{
+		db:   db,
+		feed: newLaptopFeed(),
+	}
+}
+
+func (store *SQLLaptopStore) Save(laptopDto *laptop.Laptop) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	other := proto.Clone(laptopDto).(*laptop.Laptop)
+	other.Revision = 1
+
+	args, err := laptopColumns(other)
+	if err != nil {
+		return err
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM laptops WHERE id = ?`, other.Id).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("cannot check laptop: %w", err)
+	}
+
+	if exists > 0 {
+		return ErrAlreadyExists
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO laptops (
+			id, revision, brand, name, price_usd, cpu_cores, cpu_ghz, ram_bits, release_year, search_text, data
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		args...,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot insert laptop: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	store.feed.publish(laptop.LaptopEvent_CREATED, other, nil)
+	laptopDto.Revision = other.Revision
+	return nil
+}
+
+func (store *SQLLaptopStore) Find(id string) (*laptop.Laptop, error) {
+	return findSQLLaptop(store.db, id)
+}
+
+func (store *SQLLaptopStore) Update(laptopDto *laptop.Laptop) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	other := proto.Clone(laptopDto).(*laptop.Laptop)
+	other.Revision = laptopDto.Revision + 1
+	other.UpdatedAt = timestamppb.Now()
+
+	args, err := laptopColumns(other)
+	if err != nil {
+		return err
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// watchers are told about a laptop leaving their filter by its state before the update
+	current, err := findSQLLaptop(tx, other.Id)
+	if err != nil {
+		return err
+	} else if current == nil {
+		return ErrNotFound
+	}
+
+	// the revision condition makes the check and the write a single step
+	result, err := tx.Exec(
+		`UPDATE laptops SET
+			revision = ?, brand = ?, name = ?, price_usd = ?, cpu_cores = ?, cpu_ghz = ?,
+			ram_bits = ?, release_year = ?, search_text = ?, data = ?
+		WHERE id = ? AND revision = ?`,
+		append(args[1:], other.Id, laptopDto.Revision)...,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot update laptop: %w", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if updated == 0 {
+		return ErrStaleRevision
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	store.feed.publish(laptop.LaptopEvent_UPDATED, other, current)
+	laptopDto.Revision = other.Revision
+	laptopDto.UpdatedAt = other.UpdatedAt
+	return nil
+}
+
+func (store *SQLLaptopStore) Delete(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := findSQLLaptop(tx, id)
+	if err != nil {
+		return err
+	} else if current == nil {
+		return ErrNotFound
+	}
+
+	_, err = tx.Exec(`DELETE FROM laptops WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("cannot delete laptop: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	store.feed.publish(laptop.LaptopEvent_DELETED, current, nil)
+	return nil
+}
+
+func (store *SQLLaptopStore) List(ctx context.Context, afterID string, limit int) ([]*laptop.Laptop, error) {
+	return store.queryLaptops(ctx, `SELECT data FROM laptops WHERE id > ? ORDER BY id LIMIT ?`, afterID, limit)
+}
+
+func (store *SQLLaptopStore) Search(
+	ctx context.Context,
+	query string,
+	filter *laptop.Filter,
+	found func(laptop *laptop.Laptop) error,
+) error {
+	matches, err := store.findQualified(ctx, query, filter)
+	if err != nil {
+		return err
+	}
+
+	for _, lp := range matches {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := found(lp)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *SQLLaptopStore) Facets(ctx context.Context, query string, filter *laptop.Filter) (*FacetCounts, error) {
+	matches, err := store.findQualified(ctx, query, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return countFacets(matches), nil
+}
+
+func (store *SQLLaptopStore) Watch(
+	ctx context.Context,
+	resumeToken string,
+	filter *laptop.Filter,
+	found func(event *laptop.LaptopEvent) error,
+) error {
+	return store.feed.watch(ctx, resumeToken, filter, found)
+}
+
+// findQualified lets the database narrow the laptops down with its indexes, and
+// checks the criteria that have no column on the laptops it returns
+func (store *SQLLaptopStore) findQualified(
+	ctx context.Context,
+	query string,
+	filter *laptop.Filter,
+) ([]*laptop.Laptop, error) {
+	where, args := filterToSQL(query, filter)
+
+	candidates, err := store.queryLaptops(ctx, `SELECT data FROM laptops WHERE `+where+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []*laptop.Laptop{}
+	for _, lp := range candidates {
+		if isQualified(filter, lp) {
+			matches = append(matches, lp)
+		}
+	}
+
+	// a query without letters or digits has no terms to match, so it does not filter
+	if len(tokenize(query)) == 0 {
+		return matches, nil
+	}
+
+	// rank the matches the same way as the in-memory text index does
+	index := newTextIndex()
+	byID := make(map[string]*laptop.Laptop, len(matches))
+	for _, lp := range matches {
+		index.insert(lp)
+		byID[lp.GetId()] = lp
+	}
+
+	ranked := make([]*laptop.Laptop, 0, len(matches))
+	for _, match := range index.search(query) {
+		ranked = append(ranked, byID[match.id])
+	}
+
+	return ranked, nil
+}
+
+func (store *SQLLaptopStore) queryLaptops(ctx context.Context, query string, args ...interface{}) ([]*laptop.Laptop, error) {
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query laptops: %w", err)
+	}
+	defer rows.Close()
+
+	laptops := []*laptop.Laptop{}
+	for rows.Next() {
+		var data []byte
+		err := rows.Scan(&data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan laptop: %w", err)
+		}
+
+		lp := &laptop.Laptop{}
+		err = proto.Unmarshal(data, lp)
+		if err != nil {
+			return nil, fmt.Errorf("cannot unmarshal laptop: %w", err)
+		}
+
+		laptops = append(laptops, lp)
+	}
+
+	return laptops, rows.Err()
+}
+
+// filterToSQL translates the criteria that have an indexed column into a WHERE clause.
+// Every query term must prefix a token of the search text, which starts with a space.
+func filterToSQL(query string, filter *laptop.Filter) (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	args := []interface{}{}
+
+	add := func(condition string, values ...interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, values...)
+	}
+
+	if filter.GetMaxPriceUsd() > 0 {
+		add("price_usd <= ?", filter.GetMaxPriceUsd())
+	}
+	if filter.GetMinCpuCores() > 0 {
+		add("cpu_cores >= ?", filter.GetMinCpuCores())
+	}
+	if filter.GetMinCpuGhz() > 0 {
+		add("cpu_ghz >= ?", filter.GetMinCpuGhz())
+	}
+	if minRam := sqlRamBits(filter.GetMinRam()); minRam > 0 {
+		add("ram_bits >= ?", minRam)
+	}
+	if filter.GetMinReleaseYear() > 0 {
+		add("release_year >= ?", filter.GetMinReleaseYear())
+	}
+	if filter.GetMaxReleaseYear() > 0 {
+		add("release_year <= ?", filter.GetMaxReleaseYear())
+	}
+
+	if brands := filter.GetBrands(); len(brands) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(brands)), ", ")
+		values := make([]interface{}, len(brands))
+		for i, brand := range brands {
+			values[i] = brand
+		}
+		add("brand COLLATE NOCASE IN ("+placeholders+")", values...)
+	}
+
+	// tokens only hold letters and digits, so they need no escaping in LIKE
+	for _, term := range tokenize(query) {
+		add("search_text LIKE ?", "% "+term+"%")
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// laptopColumns returns the values of the laptops table columns in order
+func laptopColumns(lp *laptop.Laptop) ([]interface{}, error) {
+	data, err := proto.Marshal(lp)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal laptop: %w", err)
+	}
+
+	tokens := []string{}
+	for token := range laptopTokens(lp) {
+		tokens = append(tokens, token)
+	}
+
+	return []interface{}{
+		lp.GetId(),
+		lp.GetRevision(),
+		lp.GetBrand(),
+		lp.GetName(),
+		lp.GetPriceUsd(),
+		lp.GetCpu().GetCoreNumber(),
+		lp.GetCpu().GetMinGhz(),
+		sqlRamBits(lp.GetRam()),
+		lp.GetReleaseYear(),
+		" " + strings.Join(tokens, " "),
+		data,
+	}, nil
+}
+
+// sqlQueryer is implemented by both *sql.DB and *sql.Tx
+type sqlQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func findSQLLaptop(db sqlQueryer, id string) (*laptop.Laptop, error) {
+	var data []byte
+	err := db.QueryRow(`SELECT data FROM laptops WHERE id = ?`, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot find laptop: %w", err)
+	}
+
+	lp := &laptop.Laptop{}
+	err = proto.Unmarshal(data, lp)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal laptop: %w", err)
+	}
+
+	return lp, nil
+}
+
+// sqlRamBits converts the memory to the value of the ram_bits column, which is a signed
+// 64-bit integer, so sizes beyond its range saturate at its maximum
+func sqlRamBits(memory *laptop.Memory) int64 {
+	bits := toBit(memory)
+	if bits > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(bits)
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// sqlMigrations bring the database schema up to date. Each one is applied once,
+// in order, and its index plus one is recorded as the schema version.
+// Migrations must never be edited once released, only appended.
+var sqlMigrations = [][]string{
+	// 1: laptops with indexed columns for the numeric filters, ratings and users
+	{
+		`CREATE TABLE laptops (
+			id           TEXT PRIMARY KEY,
+			revision     INTEGER NOT NULL,
+			brand        TEXT NOT NULL,
+			name         TEXT NOT NULL,
+			price_usd    REAL NOT NULL,
+			cpu_cores    INTEGER NOT NULL,
+			cpu_ghz      REAL NOT NULL,
+			ram_bits     INTEGER NOT NULL,
+			release_year INTEGER NOT NULL,
+			search_text  TEXT NOT NULL,
+			data         BLOB NOT NULL
+		)`,
+		`CREATE INDEX laptops_brand ON laptops (brand COLLATE NOCASE)`,
+		`CREATE INDEX laptops_price_usd ON laptops (price_usd)`,
+		`CREATE INDEX laptops_cpu_cores ON laptops (cpu_cores)`,
+		`CREATE INDEX laptops_cpu_ghz ON laptops (cpu_ghz)`,
+		`CREATE INDEX laptops_ram_bits ON laptops (ram_bits)`,
+		`CREATE INDEX laptops_release_year ON laptops (release_year)`,
+		`CREATE TABLE ratings (
+			laptop_id TEXT PRIMARY KEY,
+			count     INTEGER NOT NULL,
+			sum       REAL NOT NULL
+		)`,
+		`CREATE TABLE users (
+			username        TEXT PRIMARY KEY,
+			hashed_password TEXT NOT NULL,
+			role            TEXT NOT NULL
+		)`,
+	},
+	// 2: one score per user and laptop, the ratings table keeps their totals.
+	// Scores given before have no user, so each becomes the average of its laptop
+	// under one of the reserved legacyRatingUser names, which keeps the totals.
+	{
+		`CREATE TABLE user_ratings (
+			laptop_id TEXT NOT NULL,
+			username  TEXT NOT NULL,
+			score     REAL NOT NULL,
+			PRIMARY KEY (laptop_id, username)
+		)`,
+		`INSERT INTO user_ratings (laptop_id, username, score)
+		WITH RECURSIVE legacy (laptop_id, n, count, sum) AS (
+			SELECT laptop_id, 1, count, sum FROM ratings WHERE count > 0
+			UNION ALL
+			SELECT laptop_id, n + 1, count, sum FROM legacy WHERE n < count
+		)
+		SELECT laptop_id, '#legacy-' || n, sum / count FROM legacy`,
+	},
+	// 3: reviews, with the columns they are listed by, and the voters for them
+	{
+		`CREATE TABLE reviews (
+			id            TEXT PRIMARY KEY,
+			laptop_id     TEXT NOT NULL,
+			author        TEXT NOT NULL,
+			created_at    INTEGER NOT NULL,
+			helpful_votes INTEGER NOT NULL,
+			hidden        INTEGER NOT NULL,
+			data          BLOB NOT NULL,
+			UNIQUE (laptop_id, author)
+		)`,
+		`CREATE INDEX reviews_laptop_created_at ON reviews (laptop_id, created_at)`,
+		`CREATE TABLE review_votes (
+			review_id TEXT NOT NULL,
+			username  TEXT NOT NULL,
+			PRIMARY KEY (review_id, username)
+		)`,
+	},
+	// 4: when each score was given, for the decayed score. Older scores count as given now.
+	{
+		`ALTER TABLE user_ratings ADD COLUMN rated_at INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE user_ratings SET rated_at = CAST(strftime('%s', 'now') AS INTEGER) * 1000000000`,
+	},
+}
+
+// MigrateSQL applies the migrations that the database has not seen yet
+func MigrateSQL(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("cannot create migrations table: %w", err)
+	}
+
+	var current int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return fmt.Errorf("cannot read schema version: %w", err)
+	}
+
+	for version := current + 1; version <= len(sqlMigrations); version++ {
+		err := applyMigration(db, version, sqlMigrations[version-1])
+		if err != nil {
+			return fmt.Errorf("cannot apply migration %d: %w", version, err)
+		}
+
+		log.Printf("applied database migration %d", version)
+	}
+
+	return nil
+}
+
+func applyMigration(db *sql.DB, version int, statements []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,274 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqlRatingBatchSize keeps the laptop IDs of a query well below the SQLite limit of variables
+const sqlRatingBatchSize = 500
+
+type SQLRatingStore struct {
+	db      *sql.DB
+	ranking RatingRanking
+}
+
+func NewSQLRatingStore(db *sql.DB, ranking RatingRanking) *SQLRatingStore {
+	return &SQLRatingStore{db, ranking}
+}
+
+func (store *SQLRatingStore) Add(laptopID string, username string, score float64) (*Rating, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	previous, found, err := findSQLScore(tx, laptopID, username)
+	if err != nil {
+		return nil, err
+	}
+
+	ratedAt := time.Now().UnixNano()
+
+	if found {
+		_, err = tx.Exec(
+			`UPDATE user_ratings SET score = ?, rated_at = ? WHERE laptop_id = ? AND username = ?`,
+			score, ratedAt, laptopID, username,
+		)
+		if err == nil {
+			_, err = tx.Exec(`UPDATE ratings SET sum = sum + ? WHERE laptop_id = ?`, score-previous, laptopID)
+		}
+	} else {
+		_, err = tx.Exec(
+			`INSERT INTO user_ratings (laptop_id, username, score, rated_at) VALUES (?, ?, ?, ?)`,
+			laptopID, username, score, ratedAt,
+		)
+		if err == nil {
+			_, err = tx.Exec(
+				`INSERT INTO ratings (laptop_id, count, sum) VALUES (?, 1, ?)
+				ON CONFLICT (laptop_id) DO UPDATE SET count = count + 1, sum = sum + excluded.sum`,
+				laptopID, score,
+			)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot add rating: %w", err)
+	}
+
+	rating, err := store.findRanked(tx, laptopID)
+	if err != nil {
+		return nil, err
+	}
+
+	return rating, tx.Commit()
+}
+
+func (store *SQLRatingStore) Retract(laptopID string, username string) (*Rating, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	previous, found, err := findSQLScore(tx, laptopID, username)
+	if err != nil {
+		return nil, err
+	} else if !found {
+		return nil, ErrNotFound
+	}
+
+	_, err = tx.Exec(`DELETE FROM user_ratings WHERE laptop_id = ? AND username = ?`, laptopID, username)
+	if err == nil {
+		_, err = tx.Exec(`UPDATE ratings SET count = count - 1, sum = sum - ? WHERE laptop_id = ?`, previous, laptopID)
+	}
+	if err == nil {
+		// an unrated laptop has no rating, so Get and List skip it
+		_, err = tx.Exec(`DELETE FROM ratings WHERE laptop_id = ? AND count = 0`, laptopID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot retract rating: %w", err)
+	}
+
+	rating, err := store.findRanked(tx, laptopID)
+	if err != nil {
+		return nil, err
+	} else if rating == nil {
+		rating = &Rating{LaptopID: laptopID}
+	}
+
+	return rating, tx.Commit()
+}
+
+func (store *SQLRatingStore) Score(laptopID string, username string) (float64, error) {
+	score, found, err := findSQLScore(store.db, laptopID, username)
+	if err != nil {
+		return 0, err
+	} else if !found {
+		return 0, ErrNotFound
+	}
+	return score, nil
+}
+
+func (store *SQLRatingStore) Get(laptopID string) (*Rating, error) {
+	return store.findRanked(store.db, laptopID)
+}
+
+func (store *SQLRatingStore) GetAll(laptopIDs []string) (map[string]*Rating, error) {
+	ratings := make(map[string]*Rating)
+
+	for start := 0; start < len(laptopIDs); start += sqlRatingBatchSize {
+		end := start + sqlRatingBatchSize
+		if end > len(laptopIDs) {
+			end = len(laptopIDs)
+		}
+
+		args := make([]interface{}, 0, end-start)
+		for _, laptopID := range laptopIDs[start:end] {
+			args = append(args, laptopID)
+		}
+
+		placeholders := strings.Repeat("?, ", len(args)-1) + "?"
+		batch, err := store.queryRanked(store.db, `WHERE laptop_id IN (`+placeholders+`)`, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rating := range batch {
+			ratings[rating.LaptopID] = rating
+		}
+	}
+
+	return ratings, nil
+}
+
+func (store *SQLRatingStore) List(afterLaptopID string, limit int) ([]*Rating, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+
+	return store.queryRanked(store.db, `WHERE laptop_id > ? ORDER BY laptop_id LIMIT ?`, afterLaptopID, limit)
+}
+
+func (store *SQLRatingStore) Ranking() RatingRanking {
+	return store.ranking
+}
+
+func (store *SQLRatingStore) Summary(laptopID string) (*RatingSummary, error) {
+	timedScores, err := findSQLScores(store.db, laptopID)
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make([]float64, len(timedScores))
+	for i, score := range timedScores {
+		scores[i] = score.score
+	}
+
+	return summarizeScores(laptopID, scores), nil
+}
+
+// findRanked returns nil if the laptop has not been rated yet
+func (store *SQLRatingStore) findRanked(db sqlQueryer, laptopID string) (*Rating, error) {
+	ratings, err := store.queryRanked(db, `WHERE laptop_id = ?`, laptopID)
+	if err != nil || len(ratings) == 0 {
+		return nil, err
+	}
+	return ratings[0], nil
+}
+
+// queryRanked returns the ratings the condition selects ordered by laptop ID, ranked
+// by their scores, which are read together with the totals in a single query
+func (store *SQLRatingStore) queryRanked(db sqlQueryer, condition string, args ...interface{}) ([]*Rating, error) {
+	rows, err := db.Query(
+		`SELECT r.laptop_id, r.count, r.sum, u.score, u.rated_at
+		FROM (SELECT laptop_id, count, sum FROM ratings `+condition+`) AS r
+		LEFT JOIN user_ratings AS u ON u.laptop_id = r.laptop_id
+		ORDER BY r.laptop_id`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query ratings: %w", err)
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	ratings := []*Rating{}
+	var rating *Rating
+	var scores []timedScore
+
+	for rows.Next() {
+		var laptopID string
+		var count uint32
+		var sum float64
+		var score sql.NullFloat64
+		var ratedAt sql.NullInt64
+		err := rows.Scan(&laptopID, &count, &sum, &score, &ratedAt)
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan rating: %w", err)
+		}
+
+		if rating == nil || rating.LaptopID != laptopID {
+			if rating != nil {
+				store.ranking.rank(rating, scores, now)
+			}
+
+			rating = &Rating{LaptopID: laptopID, Count: count, Sum: sum}
+			ratings = append(ratings, rating)
+			scores = nil
+		}
+
+		if score.Valid {
+			scores = append(scores, timedScore{score.Float64, time.Unix(0, ratedAt.Int64)})
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if rating != nil {
+		store.ranking.rank(rating, scores, now)
+	}
+	return ratings, nil
+}
+
+func findSQLScore(db sqlQueryer, laptopID string, username string) (float64, bool, error) {
+	var score float64
+	err := db.QueryRow(
+		`SELECT score FROM user_ratings WHERE laptop_id = ? AND username = ?`,
+		laptopID, username,
+	).Scan(&score)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, fmt.Errorf("cannot find score: %w", err)
+	}
+
+	return score, true, nil
+}
+
+func findSQLScores(db sqlQueryer, laptopID string) ([]timedScore, error) {
+	rows, err := db.Query(`SELECT score, rated_at FROM user_ratings WHERE laptop_id = ?`, laptopID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query scores: %w", err)
+	}
+	defer rows.Close()
+
+	scores := []timedScore{}
+	for rows.Next() {
+		var score float64
+		var ratedAt int64
+		err := rows.Scan(&score, &ratedAt)
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan score: %w", err)
+		}
+
+		scores = append(scores, timedScore{score, time.Unix(0, ratedAt)})
+	}
+
+	return scores, rows.Err()
+}
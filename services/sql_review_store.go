@@ -0,0 +1,248 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// SQLReviewStore keeps each review as protobuf, next to the columns reviews are listed by
+type SQLReviewStore struct {
+	db *sql.DB
+}
+
+func NewSQLReviewStore(db *sql.DB) *SQLReviewStore {
+	return &SQLReviewStore{db}
+}
+
+func (store *SQLReviewStore) Save(review *laptop.Review) (*laptop.Review, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := timestamppb.Now()
+
+	var id string
+	err = tx.QueryRow(
+		`SELECT id FROM reviews WHERE laptop_id = ? AND author = ?`,
+		review.GetLaptopId(), review.GetAuthor(),
+	).Scan(&id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("cannot find review: %w", err)
+	}
+
+	var other *laptop.Review
+	if id != "" {
+		other, err = findSQLReview(tx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		other.Title = review.GetTitle()
+		other.Body = review.GetBody()
+		other.Pros = review.GetPros()
+		other.Cons = review.GetCons()
+		other.AuthorScore = review.GetAuthorScore()
+		other.UpdatedAt = now
+	} else {
+		other = &laptop.Review{
+			Id:          uuid.New().String(),
+			LaptopId:    review.GetLaptopId(),
+			Author:      review.GetAuthor(),
+			Title:       review.GetTitle(),
+			Body:        review.GetBody(),
+			Pros:        review.GetPros(),
+			Cons:        review.GetCons(),
+			AuthorScore: review.GetAuthorScore(),
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+	}
+
+	err = writeSQLReview(tx, other)
+	if err != nil {
+		return nil, err
+	}
+
+	return other, tx.Commit()
+}
+
+func (store *SQLReviewStore) Find(id string) (*laptop.Review, error) {
+	return findSQLReview(store.db, id)
+}
+
+func (store *SQLReviewStore) List(
+	laptopID string,
+	sortBy laptop.ListReviewsRequest_SortBy,
+	includeHidden bool,
+	after *laptop.Review,
+	limit int,
+) ([]*laptop.Review, error) {
+	query := `SELECT data FROM reviews WHERE laptop_id = ?`
+	args := []interface{}{laptopID}
+
+	if !includeHidden {
+		query += ` AND hidden = 0`
+	}
+
+	// continue right after the given review in the same order as reviewBefore
+	if after != nil {
+		createdAt := after.GetCreatedAt().AsTime().UnixNano()
+		newer := `(created_at < ? OR (created_at = ? AND id > ?))`
+		newerArgs := []interface{}{createdAt, createdAt, after.GetId()}
+
+		if sortBy == laptop.ListReviewsRequest_MOST_HELPFUL {
+			votes := after.GetHelpfulVotes()
+			query += ` AND (helpful_votes < ? OR (helpful_votes = ? AND ` + newer + `))`
+			args = append(args, votes, votes)
+		} else {
+			query += ` AND ` + newer
+		}
+		args = append(args, newerArgs...)
+	}
+
+	if sortBy == laptop.ListReviewsRequest_MOST_HELPFUL {
+		query += ` ORDER BY helpful_votes DESC, created_at DESC, id`
+	} else {
+		query += ` ORDER BY created_at DESC, id`
+	}
+
+	if limit <= 0 {
+		limit = -1
+	}
+	query += ` LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query reviews: %w", err)
+	}
+	defer rows.Close()
+
+	reviews := []*laptop.Review{}
+	for rows.Next() {
+		var data []byte
+		err := rows.Scan(&data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan review: %w", err)
+		}
+
+		review := &laptop.Review{}
+		err = proto.Unmarshal(data, review)
+		if err != nil {
+			return nil, fmt.Errorf("cannot unmarshal review: %w", err)
+		}
+
+		reviews = append(reviews, review)
+	}
+
+	return reviews, rows.Err()
+}
+
+func (store *SQLReviewStore) Vote(reviewID string, username string) (*laptop.Review, error) {
+	return store.change(reviewID, func(tx *sql.Tx, review *laptop.Review) error {
+		result, err := tx.Exec(
+			`INSERT INTO review_votes (review_id, username) VALUES (?, ?) ON CONFLICT DO NOTHING`,
+			reviewID, username,
+		)
+		if err != nil {
+			return fmt.Errorf("cannot add vote: %w", err)
+		}
+
+		added, err := result.RowsAffected()
+		if err != nil {
+			return err
+		} else if added == 0 {
+			return ErrAlreadyExists
+		}
+
+		review.HelpfulVotes++
+		return nil
+	})
+}
+
+func (store *SQLReviewStore) SetHidden(reviewID string, hidden bool) (*laptop.Review, error) {
+	return store.change(reviewID, func(tx *sql.Tx, review *laptop.Review) error {
+		review.Hidden = hidden
+		return nil
+	})
+}
+
+// change applies update to a review and writes it back in one transaction
+func (store *SQLReviewStore) change(reviewID string, update func(tx *sql.Tx, review *laptop.Review) error) (*laptop.Review, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	review, err := findSQLReview(tx, reviewID)
+	if err != nil {
+		return nil, err
+	} else if review == nil {
+		return nil, ErrNotFound
+	}
+
+	err = update(tx, review)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeSQLReview(tx, review)
+	if err != nil {
+		return nil, err
+	}
+
+	return review, tx.Commit()
+}
+
+func writeSQLReview(tx *sql.Tx, review *laptop.Review) error {
+	data, err := proto.Marshal(review)
+	if err != nil {
+		return fmt.Errorf("cannot marshal review: %w", err)
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO reviews (id, laptop_id, author, created_at, helpful_votes, hidden, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			helpful_votes = excluded.helpful_votes, hidden = excluded.hidden, data = excluded.data`,
+		review.GetId(),
+		review.GetLaptopId(),
+		review.GetAuthor(),
+		review.GetCreatedAt().AsTime().UnixNano(),
+		review.GetHelpfulVotes(),
+		review.GetHidden(),
+		data,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot write review: %w", err)
+	}
+
+	return nil
+}
+
+func findSQLReview(db sqlQueryer, id string) (*laptop.Review, error) {
+	var data []byte
+	err := db.QueryRow(`SELECT data FROM reviews WHERE id = ?`, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot find review: %w", err)
+	}
+
+	review := &laptop.Review{}
+	err = proto.Unmarshal(data, review)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal review: %w", err)
+	}
+
+	return review, nil
+}
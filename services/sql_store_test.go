@@ -0,0 +1,275 @@
+package services_test
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/arcbjorn/store-management-system/pb/laptop"
+	"github.com/arcbjorn/store-management-system/sample"
+	"github.com/arcbjorn/store-management-system/services"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	_ "modernc.org/sqlite"
+)
+
+func openTestDatabase(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "store.db"))
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	require.NoError(t, services.MigrateSQL(db))
+	// running the migrations again must be a no-op
+	require.NoError(t, services.MigrateSQL(db))
+	return db
+}
+
+func TestSQLLaptopStore(t *testing.T) {
+	t.Parallel()
+
+	store := services.NewSQLLaptopStore(openTestDatabase(t))
+
+	lp := sample.NewLaptop()
+	require.NoError(t, store.Save(lp))
+	require.Equal(t, uint64(1), lp.Revision)
+	require.ErrorIs(t, store.Save(lp), services.ErrAlreadyExists)
+
+	found, err := store.Find(lp.Id)
+	require.NoError(t, err)
+	requireSameLaptop(t, lp, found)
+
+	stale := proto.Clone(lp).(*laptop.Laptop)
+	lp.PriceUsd = 1234
+	require.NoError(t, store.Update(lp))
+	require.Equal(t, uint64(2), lp.Revision)
+	require.ErrorIs(t, store.Update(stale), services.ErrStaleRevision)
+
+	found, err = store.Find(lp.Id)
+	require.NoError(t, err)
+	require.Equal(t, 1234.0, found.GetPriceUsd())
+
+	other := sample.NewLaptop()
+	require.NoError(t, store.Save(other))
+
+	laptops, err := store.List(context.Background(), "", 10)
+	require.NoError(t, err)
+	require.Len(t, laptops, 2)
+
+	require.NoError(t, store.Delete(lp.Id))
+	require.ErrorIs(t, store.Delete(lp.Id), services.ErrNotFound)
+
+	found, err = store.Find(lp.Id)
+	require.NoError(t, err)
+	require.Nil(t, found)
+}
+
+func TestSQLLaptopStoreSearchMatchesInMemory(t *testing.T) {
+	t.Parallel()
+
+	sqlStore := services.NewSQLLaptopStore(openTestDatabase(t))
+	memoryStore := services.NewInMemoryLaptopStore()
+
+	for i := 0; i < 50; i++ {
+		lp := sample.NewLaptop()
+		require.NoError(t, sqlStore.Save(lp))
+		require.NoError(t, memoryStore.Save(lp))
+	}
+
+	filter := &laptop.Filter{
+		MaxPriceUsd: 2500,
+		MinCpuCores: 4,
+		MinRam:      &laptop.Memory{Value: 8, Unit: laptop.Memory_GIGABYTE},
+	}
+
+	for _, query := range []string{"", "--", "mac", "thinkpad intel"} {
+		search := func(store services.LaptopStore) []string {
+			ids := []string{}
+			err := store.Search(context.Background(), query, filter, func(lp *laptop.Laptop) error {
+				ids = append(ids, lp.GetId())
+				return nil
+			})
+			require.NoError(t, err)
+			return ids
+		}
+
+		require.ElementsMatch(t, search(memoryStore), search(sqlStore), "query %q", query)
+	}
+}
+
+func TestSQLLaptopStoreLargeRam(t *testing.T) {
+	t.Parallel()
+
+	sqlStore := services.NewSQLLaptopStore(openTestDatabase(t))
+	memoryStore := services.NewInMemoryLaptopStore()
+
+	// sizes beyond the range of the ram column still compare as the largest ones
+	for _, value := range []uint64{16, 1 << 40, math.MaxUint64} {
+		lp := sample.NewLaptop()
+		lp.Ram = &laptop.Memory{Value: value, Unit: laptop.Memory_TERABYTE}
+		require.NoError(t, sqlStore.Save(lp))
+		require.NoError(t, memoryStore.Save(lp))
+	}
+
+	filter := &laptop.Filter{MinRam: &laptop.Memory{Value: 1 << 30, Unit: laptop.Memory_TERABYTE}}
+	for _, store := range []services.LaptopStore{sqlStore, memoryStore} {
+		found := 0
+		err := store.Search(context.Background(), "", filter, func(lp *laptop.Laptop) error {
+			require.Greater(t, lp.GetRam().GetValue(), uint64(16))
+			found++
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 2, found)
+	}
+}
+
+func TestSQLRatingAndUserStores(t *testing.T) {
+	t.Parallel()
+
+	db := openTestDatabase(t)
+
+	ratingStore := services.NewSQLRatingStore(db, services.DefaultRatingRanking())
+	laptopID := sample.NewLaptop().Id
+
+	rating, err := ratingStore.Get(laptopID)
+	require.NoError(t, err)
+	require.Nil(t, rating)
+
+	_, err = ratingStore.Add(laptopID, "user1", 4)
+	require.NoError(t, err)
+	_, err = ratingStore.Add(laptopID, "user2", 3)
+	require.NoError(t, err)
+	rating, err = ratingStore.Add(laptopID, "user2", 5)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), rating.Count)
+	require.Equal(t, 9.0, rating.Sum)
+
+	ratings, err := ratingStore.List("", 10)
+	require.NoError(t, err)
+	require.Equal(t, []*services.Rating{rating}, ratings)
+
+	// more laptops than fit in one query
+	laptopIDs := []string{}
+	for i := 0; i < 1200; i++ {
+		laptopIDs = append(laptopIDs, sample.NewLaptop().Id)
+	}
+	laptopIDs[700] = laptopID
+	all, err := ratingStore.GetAll(laptopIDs)
+	require.NoError(t, err)
+	require.Equal(t, map[string]*services.Rating{laptopID: rating}, all)
+
+	score, err := ratingStore.Score(laptopID, "user2")
+	require.NoError(t, err)
+	require.Equal(t, 5.0, score)
+
+	rating, err = ratingStore.Retract(laptopID, "user1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), rating.Count)
+	require.Equal(t, 5.0, rating.Sum)
+
+	_, err = ratingStore.Retract(laptopID, "user1")
+	require.ErrorIs(t, err, services.ErrNotFound)
+	_, err = ratingStore.Score(laptopID, "user1")
+	require.ErrorIs(t, err, services.ErrNotFound)
+
+	userStore := services.NewSQLUserStore(db)
+	user, err := services.NewUser("user1", "secret", "user")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+	require.ErrorIs(t, userStore.Save(user), services.ErrAlreadyExists)
+
+	found, err := userStore.Find("user1")
+	require.NoError(t, err)
+	require.True(t, found.IsCorrectPassword("secret"))
+	require.Equal(t, "user", found.Role)
+}
+
+func TestSQLMigrationKeepsRatingTotals(t *testing.T) {
+	t.Parallel()
+
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "store.db"))
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	// the ratings of a database at version 1 are totals without users
+	for _, statement := range []string{
+		`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, applied_at TIMESTAMP)`,
+		`INSERT INTO schema_migrations (version) VALUES (1)`,
+		`CREATE TABLE ratings (laptop_id TEXT PRIMARY KEY, count INTEGER NOT NULL, sum REAL NOT NULL)`,
+		`INSERT INTO ratings (laptop_id, count, sum) VALUES ('legacy', 3, 12)`,
+	} {
+		_, err = db.Exec(statement)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, services.MigrateSQL(db))
+
+	ratingStore := services.NewSQLRatingStore(db, services.DefaultRatingRanking())
+	rating, err := ratingStore.Get("legacy")
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), rating.Count)
+	require.Equal(t, 12.0, rating.Sum)
+
+	summary, err := ratingStore.Summary("legacy")
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), summary.Count)
+	require.Equal(t, 4.0, summary.Median)
+
+	_, err = ratingStore.Add("legacy", "user1", 8)
+	require.NoError(t, err)
+	rating, err = ratingStore.Retract("legacy", "user1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), rating.Count)
+	require.Equal(t, 12.0, rating.Sum)
+}
+
+func TestSQLReviewStore(t *testing.T) {
+	t.Parallel()
+
+	store := services.NewSQLReviewStore(openTestDatabase(t))
+	laptopID := sample.NewLaptop().Id
+
+	ids := []string{}
+	for _, author := range []string{"user1", "user2", "user3"} {
+		review, err := store.Save(&laptop.Review{LaptopId: laptopID, Author: author, Title: "title"})
+		require.NoError(t, err)
+		ids = append(ids, review.GetId())
+	}
+
+	edited, err := store.Save(&laptop.Review{LaptopId: laptopID, Author: "user1", Title: "edited"})
+	require.NoError(t, err)
+	require.Equal(t, ids[0], edited.GetId())
+	require.Equal(t, "edited", edited.GetTitle())
+
+	_, err = store.Vote(ids[1], "user1")
+	require.NoError(t, err)
+	_, err = store.Vote(ids[1], "user1")
+	require.ErrorIs(t, err, services.ErrAlreadyExists)
+
+	_, err = store.SetHidden(ids[2], true)
+	require.NoError(t, err)
+
+	// page through the visible reviews one at a time
+	listed := []string{}
+	var after *laptop.Review
+	for {
+		reviews, err := store.List(laptopID, laptop.ListReviewsRequest_MOST_HELPFUL, false, after, 1)
+		require.NoError(t, err)
+		if len(reviews) == 0 {
+			break
+		}
+
+		listed = append(listed, reviews[0].GetId())
+		after = reviews[0]
+	}
+	require.Equal(t, []string{ids[1], ids[0]}, listed)
+
+	reviews, err := store.List(laptopID, laptop.ListReviewsRequest_NEWEST, true, nil, 0)
+	require.NoError(t, err)
+	require.Len(t, reviews, 3)
+	require.Equal(t, ids[2], reviews[0].GetId())
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+type SQLUserStore struct {
+	db *sql.DB
+}
+
+func NewSQLUserStore(db *sql.DB) *SQLUserStore {
+	return &SQLUserStore{db}
+}
+
+func (store *SQLUserStore) Save(user *User) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	existing, err := findSQLUser(tx, user.Username)
+	if err != nil {
+		return err
+	} else if existing != nil {
+		return ErrAlreadyExists
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO users (username, hashed_password, role) VALUES (?, ?, ?)`,
+		user.Username, user.HashedPassword, user.Role,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot insert user: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (store *SQLUserStore) Find(username string) (*User, error) {
+	return findSQLUser(store.db, username)
+}
+
+func findSQLUser(db sqlQueryer, username string) (*User, error) {
+	user := &User{}
+	err := db.QueryRow(
+		`SELECT username, hashed_password, role FROM users WHERE username = ?`,
+		username,
+	).Scan(&user.Username, &user.HashedPassword, &user.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot find user: %w", err)
+	}
+
+	return user, nil
+}